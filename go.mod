@@ -1,11 +1,14 @@
 module github.com/michaelestrin/cloudmqtt
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/edgexfoundry/app-functions-sdk-go v0.0.0-20190529014030-0fb6f9a5f83e
 	github.com/edgexfoundry/go-mod-core-contracts v0.1.0
+	github.com/edgexfoundry/go-mod-registry v0.1.0
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/google/uuid v1.1.0
+	github.com/klauspost/compress v1.15.9
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.3.0
 	golang.org/x/net v0.0.0-20190522155817-f3200d17e092 // indirect
@@ -17,16 +17,66 @@ package contract
 import (
 	"context"
 	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/edgexfoundry/go-mod-registry/pkg/types"
+	"time"
 )
 
-// Sender defines function contract for transmitting bytes to Cloud.
-type Sender func(data []byte) bool
+// Sender defines function contract for transmitting bytes to Cloud; ctx carries the correlation ID and trace context
+// of the content, if any.
+type Sender func(ctx context.Context, data []byte) bool
 
-// Notifier defines function contract for notifying Cloud of newly added device's metadata.
-type Notifier func(event *models.Event) bool
+// Message defines northbound content queued for transmission to Cloud; Device names the device the content originated
+// from (empty if content is not specific to a single device), CorrelationId identifies the EdgeX request the content
+// originated from in log messages (empty if none), Traceparent is the W3C trace context of the span awaiting its
+// transmission (empty if none), Priority orders it relative to other content (higher values first), Pushed is called
+// once Data has been transmitted, and Dropped (if not nil) is called instead if Data will not be transmitted because it
+// was dropped or abandoned.
+type Message struct {
+	Data          []byte
+	Device        string
+	CorrelationId string
+	Traceparent   string
+	Priority      int
+	Pushed        func()
+	Dropped       func()
+}
+
+// Publisher defines function contract for queueing a message for transmission to Cloud.
+type Publisher func(message Message)
+
+// Filter defines function contract for removing unwanted readings from an event before it is marshalled; returns
+// false if the event should not be sent northbound.
+type Filter func(event *models.Event) bool
+
+// Prioritizer defines function contract for determining an event's priority for northbound transmission.
+type Prioritizer func(event *models.Event) int
+
+// Notifier defines function contract for notifying Cloud of newly added device's metadata; the notification is
+// abandoned if ctx is done first.
+type Notifier func(ctx context.Context, event *models.Event) bool
+
+// Tracker defines function contract for noting the device an event was received from; ctx carries the correlation ID
+// and trace context of the EdgeX request the event originated from.  Must not block.
+type Tracker func(ctx context.Context, event *models.Event)
+
+// Command is a southbound command received from Cloud.
+type Command struct {
+	// Payload is the content of the message
+	Payload []byte
+	// ResponseTopic is the MQTT 5 response topic of the message (empty if none or MQTT 3.1.1)
+	ResponseTopic string
+	// CorrelationData is the MQTT 5 correlation data of the message (empty if none or MQTT 3.1.1)
+	CorrelationData []byte
+	// Traceparent is the W3C trace context carried by the message's MQTT 5 traceparent user property (empty if none or
+	// MQTT 3.1.1)
+	Traceparent string
+	// Reply returns a Sender that transmits content to the specified topic over the connection the command was
+	// received on
+	Reply func(topicName string) Sender
+}
 
 // Receiver defines function contract for handling southbound command received from Cloud.
-type Receiver func(command string)
+type Receiver func(command Command)
 
 // Marshaller defines function contract for marshalling type to []byte; supports unit testing.
 type Marshaller func(v interface{}) ([]byte, error)
@@ -41,6 +91,117 @@ type MetadataClient interface {
 	DeviceForName(name string, ctx context.Context) (models.Device, error)
 }
 
+// DeviceProfileClient defines interface for loading device profiles from EdgeX core-metadata service; defined to
+// facilitate unit testing.
+type DeviceProfileClient interface {
+	// DeviceProfileForName loads the device profile for the specified name
+	DeviceProfileForName(name string, ctx context.Context) (models.DeviceProfile, error)
+}
+
+// DeviceServiceClient defines interface for loading device services from EdgeX core-metadata service; defined to
+// facilitate unit testing.
+type DeviceServiceClient interface {
+	// DeviceServiceForName loads the device service for the specified name
+	DeviceServiceForName(name string, ctx context.Context) (models.DeviceService, error)
+}
+
+// AddressableClient defines interface for loading addressables from EdgeX core-metadata service; defined to facilitate
+// unit testing.
+type AddressableClient interface {
+	// AddressableForName loads the addressable for the specified name
+	AddressableForName(name string, ctx context.Context) (models.Addressable, error)
+}
+
+// CommandCatalogueClient defines interface for loading devices' available commands from EdgeX core-command service;
+// defined to facilitate unit testing.
+type CommandCatalogueClient interface {
+	// Devices loads all devices and their commands
+	Devices(ctx context.Context) ([]models.CommandResponse, error)
+}
+
+// CommandClient defines interface for issuing commands to devices via EdgeX core-command service; defined to
+// facilitate unit testing.
+type CommandClient interface {
+	// Get issues a get of the named device's named command and returns core-command's response
+	Get(ctx context.Context, deviceName string, commandName string) (string, error)
+	// Put issues a put of body to the named device's named command and returns core-command's response
+	Put(ctx context.Context, deviceName string, commandName string, body string) (string, error)
+}
+
+// RegistryClient defines interface for resolving EdgeX services through the service registry (e.g. Consul); defined
+// to facilitate unit testing.
+type RegistryClient interface {
+	// GetServiceEndpoint returns the endpoint information for the specified service
+	GetServiceEndpoint(serviceId string) (types.ServiceEndpoint, error)
+}
+
+// Connection defines interface for reporting the state of the connection to Cloud.
+type Connection interface {
+	// Connected returns true if the connection is open
+	Connected() bool
+	// Subscribed returns true if the subscription for southbound commands is in place
+	Subscribed() bool
+	// LastSent returns the time content was last sent successfully (zero if never)
+	LastSent() time.Time
+}
+
+// Client defines interface for the northbound MQTT connection to Cloud; implemented for MQTT 3.1.1 and MQTT 5.
+type Client interface {
+	Connection
+	// EventSender transmits content to the event topic
+	EventSender(ctx context.Context, content []byte) bool
+	// NewDeviceSender transmits content to the new device topic
+	NewDeviceSender(ctx context.Context, content []byte) bool
+	// SenderForTopic returns a Sender that transmits content to the specified topic
+	SenderForTopic(topicName string) Sender
+	// SenderForTopicAndQos returns a Sender that transmits content to the specified topic with the specified quality
+	// of service
+	SenderForTopicAndQos(topicName string, qos byte) Sender
+	// CleanUp unsubscribes from southbound commands
+	CleanUp()
+}
+
+// Pinger defines function contract for checking an EdgeX service is reachable; the check is abandoned if ctx is done
+// first.
+type Pinger func(ctx context.Context) error
+
+// Metrics defines interface for recording service metrics.
+type Metrics interface {
+	// Increment adds delta to the named counter
+	Increment(name string, delta int64)
+	// Set sets the named gauge to value
+	Set(name string, value int64)
+	// Observe adds value (in seconds) to the named histogram
+	Observe(name string, value float64)
+}
+
+// Span describes a completed unit of traced work; identifiers are hex-encoded, Attributes holds key/value pairs, and
+// Error is empty if the work succeeded.
+type Span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   []string
+	Error        string
+}
+
+// SpanExporter defines function contract for exporting completed spans.
+type SpanExporter func(spans []Span) error
+
+// EndSpan defines function contract for ending a span with the work's outcome (nil if successful) and further key/value
+// attributes.
+type EndSpan func(err error, attributes ...string)
+
+// Tracer defines interface for recording spans of traced work.
+type Tracer interface {
+	// Start starts a span named name as a child of the span carried by ctx (or a new trace if ctx carries none) with
+	// the specified key/value attributes; it returns ctx carrying the new span and the function ending it
+	Start(ctx context.Context, name string, attributes ...string) (context.Context, EndSpan)
+}
+
 // EdgeXContext defines interface for interacting with Applications Functions SDK's edgexcontext; defined to facilitate
 // unit testing.
 type EdgeXContext interface {
@@ -16,14 +16,26 @@ package cloudmqtt
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"github.com/edgexfoundry/app-functions-sdk-go/appsdk"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/metadata"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	registryTypes "github.com/edgexfoundry/go-mod-registry/pkg/types"
+	"github.com/edgexfoundry/go-mod-registry/registry"
+	"github.com/google/uuid"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
+	"math"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -37,36 +49,871 @@ func setting(loggingClient logger.LoggingClient, settings map[string]string, key
 	return
 }
 
-// FactoryTransport returns a function that can be called by the EdgeX Applications Functions SDK.
-func FactoryTransport(sdk *appsdk.AppFunctionsSDK) *transport {
+// optionalSetting function translates setting's key to value (or returns defaultValue if the requested key does not
+// exist).
+func optionalSetting(settings map[string]string, key string, defaultValue string) string {
+	if value, ok := settings[key]; ok && len(value) > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// intSetting function translates optional setting's key to an integer value (or logs and exits if the value is not an
+// integer).
+func intSetting(loggingClient logger.LoggingClient, settings map[string]string, key string, defaultValue int) int {
+	value, err := strconv.Atoi(optionalSetting(settings, key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.intSetting invalid setting: %s (%v)", key, err))
+		os.Exit(-1)
+	}
+	return value
+}
+
+// positiveIntSetting function translates optional setting's key to an integer value (or logs and exits if the value is
+// not an integer greater than zero).
+func positiveIntSetting(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	key string,
+	defaultValue int) int {
+
+	value := intSetting(loggingClient, settings, key, defaultValue)
+	if value <= 0 {
+		loggingClient.Error(fmt.Sprintf("main.positiveIntSetting invalid setting: %s (%d)", key, value))
+		os.Exit(-1)
+	}
+	return value
+}
+
+// qosSetting function translates optional setting's key to an MQTT quality of service (or logs and exits if the value
+// is not an integer); a value other than 0, 1, or 2 is logged and replaced by defaultValue.
+func qosSetting(loggingClient logger.LoggingClient, settings map[string]string, key string, defaultValue byte) byte {
+	value := intSetting(loggingClient, settings, key, int(defaultValue))
+	if value < 0 || value > 2 {
+		loggingClient.Warn(fmt.Sprintf("main.qosSetting invalid setting: %s (%d); using %d", key, value, defaultValue))
+		return defaultValue
+	}
+	return byte(value)
+}
+
+// boolSetting function translates optional setting's key to a boolean value (or logs and exits if the value is not a
+// boolean).
+func boolSetting(loggingClient logger.LoggingClient, settings map[string]string, key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(optionalSetting(settings, key, strconv.FormatBool(defaultValue)))
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.boolSetting invalid setting: %s (%v)", key, err))
+		os.Exit(-1)
+	}
+	return value
+}
+
+// listSetting function translates optional setting's key to a list of the comma-separated values it contains.
+func listSetting(settings map[string]string, key string) (values []string) {
+	for _, value := range strings.Split(optionalSetting(settings, key, ""), ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return
+}
+
+// filterRules function returns the include and exclude rules configured for the specified kind of name.
+func filterRules(settings map[string]string, kind string) impl.FilterRules {
+	return impl.FilterRules{
+		Include: listSetting(settings, "filterInclude"+kind),
+		Exclude: listSetting(settings, "filterExclude"+kind),
+	}
+}
+
+// mapSetting function translates optional setting's key to the map of comma-separated name=value pairs it contains
+// (or logs and exits if a pair is malformed).
+func mapSetting(loggingClient logger.LoggingClient, settings map[string]string, key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range listSetting(settings, key) {
+		nameAndValue := strings.SplitN(pair, "=", 2)
+		if len(nameAndValue) != 2 {
+			loggingClient.Error(fmt.Sprintf("main.mapSetting invalid setting: %s (%s)", key, pair))
+			os.Exit(-1)
+		}
+		values[strings.TrimSpace(nameAndValue[0])] = strings.TrimSpace(nameAndValue[1])
+	}
+	return values
+}
+
+// floatValue function translates a setting's value to a float (or logs and exits if the value is not a number).
+func floatValue(loggingClient logger.LoggingClient, key string, value string) float64 {
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.floatValue invalid setting: %s (%v)", key, err))
+		os.Exit(-1)
+	}
+	return result
+}
+
+// floatSetting function translates optional setting's key to a float value (or logs and exits if the value is not a
+// number).
+func floatSetting(loggingClient logger.LoggingClient, settings map[string]string, key string, defaultValue float64) float64 {
+	return floatValue(loggingClient, key, optionalSetting(settings, key, strconv.FormatFloat(defaultValue, 'f', -1, 64)))
+}
+
+// rateLimit function returns the rate limit configured with the specified prefix; burst defaults to one second's worth
+// of tokens.
+func rateLimit(loggingClient logger.LoggingClient, settings map[string]string, prefix string) impl.RateLimit {
+	perSecond := floatSetting(loggingClient, settings, prefix+"PerSecond", 0)
+	return impl.RateLimit{
+		PerSecond: perSecond,
+		Burst:     intSetting(loggingClient, settings, prefix+"Burst", int(math.Ceil(perSecond))),
+	}
+}
+
+// floatMapSetting function translates optional setting's key to the map of comma-separated name=value pairs it
+// contains, where each value is a number (or logs and exits if a pair is malformed).
+func floatMapSetting(loggingClient logger.LoggingClient, settings map[string]string, key string) map[string]float64 {
+	values := make(map[string]float64)
+	for name, value := range mapSetting(loggingClient, settings, key) {
+		values[name] = floatValue(loggingClient, key, value)
+	}
+	return values
+}
+
+// deadbandRules function returns the deadband rules configured for each reading name.
+func deadbandRules(loggingClient logger.LoggingClient, settings map[string]string) map[string]impl.DeadbandRule {
+	rules := make(map[string]impl.DeadbandRule)
+	for name, value := range mapSetting(loggingClient, settings, "deadbandAbsolute") {
+		rule := rules[name]
+		rule.Absolute = floatValue(loggingClient, "deadbandAbsolute", value)
+		rules[name] = rule
+	}
+	for name, value := range mapSetting(loggingClient, settings, "deadbandPercent") {
+		rule := rules[name]
+		rule.Percent = floatValue(loggingClient, "deadbandPercent", value)
+		rules[name] = rule
+	}
+	for name, value := range mapSetting(loggingClient, settings, "deadbandHeartbeatInSeconds") {
+		rule := rules[name]
+		rule.Heartbeat = time.Duration(floatValue(loggingClient, "deadbandHeartbeatInSeconds", value) * float64(time.Second))
+		rules[name] = rule
+	}
+	return rules
+}
+
+// qosAtLeastOnce is the quality of service with which events and new device notifications are published.
+const qosAtLeastOnce = 1
+
+// compressedSender function returns a Sender that transmits content to topicName; if compression is enabled for the
+// topic identified by key, content compressed with the configured scheme is instead sent to topicName/scheme.
+func compressedSender(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	key string,
+	mqtt contract.Client,
+	topicName string,
+	qos byte) contract.Sender {
+
+	send := mqtt.SenderForTopicAndQos(topicName, qos)
+	scheme := optionalSetting(settings, "compression", "")
+	if len(scheme) == 0 || !boolSetting(loggingClient, settings, key, false) {
+		return send
+	}
+
+	compressor, err := impl.NewCompressor(
+		loggingClient,
+		scheme,
+		intSetting(loggingClient, settings, "compressionThreshold", 0),
+		send,
+		mqtt.SenderForTopicAndQos(topicName+"/"+scheme, qos))
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.compressedSender failed: %v", err))
+		os.Exit(-1)
+	}
+	return compressor.Send
+}
+
+// bootId identifies this run of the service in every envelope it sends.
+var bootId = uuid.New().String()
+
+// envelopedMarshaller function wraps marshal with an envelope identifying messageType if envelopes are enabled.
+func envelopedMarshaller(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	messageType string,
+	marshal contract.Marshaller) contract.Marshaller {
+
+	if !boolSetting(loggingClient, settings, "envelope", false) {
+		return marshal
+	}
+
+	gatewayId := optionalSetting(settings, "gatewayId", setting(loggingClient, settings, "clientId"))
+	return impl.NewEnvelope(gatewayId, bootId, messageType, marshal).Marshal
+}
+
+// endpoint returns the endpoint parameters for the specified EdgeX service's API route; uriKey names the setting
+// providing the service's address, which is required unless the service is resolved through the registry.
+func endpoint(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	serviceKey string,
+	uriKey string,
+	route string,
+	useRegistry bool) types.EndpointParams {
+
+	uri := optionalSetting(settings, uriKey, "")
+	if !useRegistry {
+		uri = setting(loggingClient, settings, uriKey)
+	}
+	return types.EndpointParams{
+		ServiceKey:  serviceKey,
+		Path:        route,
+		UseRegistry: useRegistry,
+		Url:         uri + route,
+		Interval:    clients.ClientMonitorDefault,
+	}
+}
+
+// sdkConfiguration is the part of the SDK's configuration file that locates the registry.
+type sdkConfiguration struct {
+	Registry struct {
+		Host string
+		Port int
+		Type string
+	}
+}
+
+// flagValue function returns the value of the command line flag registered by the SDK under name (or an empty string
+// if no such flag is registered).
+func flagValue(name string) string {
+	if f := flag.Lookup(name); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+// sdkConfigurationFile function returns the path and name of the configuration file loaded by the SDK, located the
+// same way the SDK locates it: by the -c/--confdir and -p/--profile flags and the EDGEX_CONF_DIR environment variable.
+func sdkConfigurationFile() string {
+	dir := flagValue("confdir")
+	if len(dir) == 0 {
+		dir = os.Getenv("EDGEX_CONF_DIR")
+	}
+	if len(dir) == 0 {
+		dir = "./res"
+	}
+	return filepath.Join(dir, flagValue("profile"), "configuration.toml")
+}
+
+// registryClient returns a client for the registry used to resolve EdgeX services, or nil if the service was not
+// started with the SDK's -r/--registry flag or the client cannot be created; the registry is the one configured by
+// the [Registry] section of the SDK's configuration.
+func registryClient(sdk *appsdk.AppFunctionsSDK) contract.RegistryClient {
+	if useRegistry, _ := strconv.ParseBool(flagValue("registry")); !useRegistry {
+		return nil
+	}
+
+	file := sdkConfigurationFile()
+	var configuration sdkConfiguration
+	if _, err := toml.DecodeFile(file, &configuration); err != nil {
+		sdk.LoggingClient.Error(fmt.Sprintf("main.registryClient DecodeFile(%s) failed: %v", file, err))
+		return nil
+	}
+
+	client, err := registry.NewRegistryClient(
+		registryTypes.Config{
+			Host:       configuration.Registry.Host,
+			Port:       configuration.Registry.Port,
+			Type:       configuration.Registry.Type,
+			ServiceKey: sdk.ServiceKey,
+		})
+	if err != nil {
+		sdk.LoggingClient.Error(fmt.Sprintf("main.registryClient NewRegistryClient failed: %v", err))
+		return nil
+	}
+	return client
+}
+
+// tracer function returns the tracer configured by the tracingExporter setting and the function that exports the spans
+// it has yet to export; spans are not recorded if the setting is omitted.
+func tracer(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	metrics contract.Metrics) (contract.Tracer, contract.CleanUp) {
+
+	var export contract.SpanExporter
+	switch exporter := optionalSetting(settings, "tracingExporter", ""); exporter {
+	case "":
+		return impl.NewNopTracer(), func() {}
+	case "otlp":
+		export = impl.NewOtlpExporter(
+			optionalSetting(settings, "tracingEndpoint", "http://localhost:4318"),
+			time.Duration(intSetting(loggingClient, settings, "tracingTimeoutInSeconds", 10))*time.Second).Export
+	case "file":
+		export = impl.NewFileExporter(optionalSetting(settings, "tracingFile", "./traces.json")).Export
+	default:
+		loggingClient.Error(fmt.Sprintf("main.tracer invalid setting: tracingExporter (%s)", exporter))
+		os.Exit(-1)
+	}
+
+	t := impl.NewTracer(
+		loggingClient,
+		metrics,
+		export,
+		intSetting(loggingClient, settings, "tracingQueueSize", 2048),
+		time.Duration(intSetting(loggingClient, settings, "tracingExportIntervalInSeconds", 5))*time.Second)
+	return t, t.CleanUp
+}
+
+// mqttClient function returns the MQTT client selected by the mqttVersion setting, 3.1.1 (the default) or 5, and a
+// function returning the server it is connected to.  When server lists more than one server, the client fails over
+// between them according to the failover settings (or logs and exits if no server accepts a connection).
+func mqttClient(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	metrics contract.Metrics,
+	receiver contract.Receiver) (contract.Client, func() string) {
+
+	eventTopic := setting(loggingClient, settings, "eventTopic")
+	commandTopic := setting(loggingClient, settings, "commandTopic")
+	var connect func(server string) (contract.Client, error)
+	switch version := optionalSetting(settings, "mqttVersion", "3.1.1"); version {
+	case "3.1.1":
+		connect = func(server string) (contract.Client, error) {
+			return impl.NewMqttInstanceForCloud(
+				loggingClient,
+				metrics,
+				setting(loggingClient, settings, "certFile"),
+				setting(loggingClient, settings, "keyFile"),
+				setting(loggingClient, settings, "clientId"),
+				setting(loggingClient, settings, "userName"),
+				setting(loggingClient, settings, "password"),
+				server,
+				eventTopic,
+				setting(loggingClient, settings, "newDeviceTopic"),
+				commandTopic,
+				receiver)
+		}
+	case "5":
+		topicAliases := listSetting(settings, "topicAliases")
+		if len(topicAliases) == 0 {
+			topicAliases = []string{eventTopic}
+		}
+		options := impl.Mqtt5Options{
+			MessageExpiry: time.Duration(intSetting(loggingClient, settings, "messageExpiryInSeconds", 0)) * time.Second,
+			ResponseTopic: optionalSetting(settings, "responseTopic", ""),
+			TopicAliases:  topicAliases,
+		}
+		connect = func(server string) (contract.Client, error) {
+			return impl.NewMqtt5InstanceForCloud(
+				loggingClient,
+				metrics,
+				setting(loggingClient, settings, "certFile"),
+				setting(loggingClient, settings, "keyFile"),
+				setting(loggingClient, settings, "clientId"),
+				setting(loggingClient, settings, "userName"),
+				setting(loggingClient, settings, "password"),
+				server,
+				eventTopic,
+				setting(loggingClient, settings, "newDeviceTopic"),
+				commandTopic,
+				receiver,
+				options)
+		}
+	default:
+		loggingClient.Error(fmt.Sprintf("main.mqttClient invalid setting: mqttVersion (%s)", version))
+		os.Exit(-1)
+	}
+
+	servers := listSetting(settings, "server")
+	if len(servers) <= 1 {
+		server := setting(loggingClient, settings, "server")
+		client, err := connect(server)
+		if err != nil {
+			loggingClient.Error(fmt.Sprintf("main.mqttClient connect failed: %v", err), impl.LogFieldError, err.Error())
+			os.Exit(-1)
+		}
+		return client, func() string { return server }
+	}
+
+	checkInterval := positiveIntSetting(loggingClient, settings, "failoverCheckIntervalInSeconds", 5)
+	probeTimeout := positiveIntSetting(loggingClient, settings, "failoverProbeTimeoutInSeconds", 2)
+	failover, err := impl.NewFailover(
+		loggingClient,
+		metrics,
+		servers,
+		connect,
+		impl.NewServerProbe(time.Duration(probeTimeout)*time.Second).Probe,
+		impl.FailoverPolicy{
+			FailoverAfter: time.Duration(intSetting(loggingClient, settings, "failoverAfterInSeconds", 30)) * time.Second,
+			FailbackAfter: time.Duration(intSetting(loggingClient, settings, "failbackAfterInSeconds", 300)) * time.Second,
+			CheckInterval: time.Duration(checkInterval) * time.Second,
+		})
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.mqttClient NewFailover failed: %v", err), impl.LogFieldError, err.Error())
+		os.Exit(-1)
+	}
+	return failover, failover.ActiveServer
+}
+
+// brokerNamePattern matches the names allowed in the brokers setting.
+var brokerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// brokerNames function returns the names listed in the brokers setting (or logs and exits if a name is invalid or
+// repeated); a single unnamed broker is configured if the setting is omitted.
+func brokerNames(loggingClient logger.LoggingClient, settings map[string]string) []string {
+	names := listSetting(settings, "brokers")
+	if len(names) == 0 {
+		return []string{""}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !brokerNamePattern.MatchString(name) || seen[name] {
+			loggingClient.Error(fmt.Sprintf("main.brokerNames invalid setting: brokers (%s)", name))
+			os.Exit(-1)
+		}
+		seen[name] = true
+	}
+	return names
+}
+
+// brokerSettings function returns settings as seen by the named broker: each <name>_<key> setting overrides <key>.
+// Unless overridden, the deadband state file and rate limit spool directory are made specific to the broker so that
+// brokers do not share state.
+func brokerSettings(settings map[string]string, name string) map[string]string {
+	if len(name) == 0 {
+		return settings
+	}
+
+	prefix := name + "_"
+	merged := make(map[string]string, len(settings))
+	for key, value := range settings {
+		merged[key] = value
+	}
+	for key, value := range settings {
+		if strings.HasPrefix(key, prefix) {
+			merged[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	if _, ok := settings[prefix+"deadbandStateFile"]; !ok {
+		if file := optionalSetting(settings, "deadbandStateFile", ""); len(file) > 0 {
+			extension := filepath.Ext(file)
+			merged["deadbandStateFile"] = strings.TrimSuffix(file, extension) + "-" + name + extension
+		}
+	}
+	if _, ok := settings[prefix+"rateLimitSpoolDirectory"]; !ok {
+		spool := optionalSetting(settings, "rateLimitSpoolDirectory", "./spool")
+		merged["rateLimitSpoolDirectory"] = filepath.Join(spool, name)
+	}
+	return merged
+}
+
+// brokerMetrics defines interface for recording a broker's metrics and reading the counters reported in its status.
+type brokerMetrics interface {
+	contract.Metrics
+	statusCounter
+}
+
+// services contains the components shared by every broker's transport.
+type services struct {
+	started          time.Time
+	tracer           contract.Tracer
+	endpointer       clients.Endpointer
+	metadataClient   contract.MetadataClient
+	metadataEndpoint func(route string) types.EndpointParams
+	commandEndpoint  func(route string) types.EndpointParams
+	receiver         contract.Receiver
+	lastError        func() (string, time.Time)
+}
+
+// brokerTransport function returns the transport for the broker configured by settings and the broker's MQTT client;
+// the client is cleaned up separately from the transport so that it outlives the shared command handler.
+func brokerTransport(
+	loggingClient logger.LoggingClient,
+	settings map[string]string,
+	metrics brokerMetrics,
+	shared services) (*transport, contract.Client) {
+
+	tracer, endpointer, metadataEndpoint := shared.tracer, shared.endpointer, shared.metadataEndpoint
+	marshaller := json.Marshal
+	shutdown := impl.NewShutdown(
+		time.Duration(intSetting(loggingClient, settings, "shutdownGraceInSeconds", 10)) * time.Second)
+	mqtt, activeServer := mqttClient(loggingClient, settings, metrics, shared.receiver)
+
+	filter, err := impl.NewFilter(
+		loggingClient,
+		shared.metadataClient,
+		metrics,
+		time.Duration(intSetting(loggingClient, settings, "profileLookupTimeoutInSeconds", 2))*time.Second,
+		time.Duration(intSetting(loggingClient, settings, "metadataCacheNegativeTtlInSeconds", 30))*time.Second,
+		filterRules(settings, "Devices"),
+		filterRules(settings, "Profiles"),
+		filterRules(settings, "Readings"))
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.FactoryTransport NewFilter failed: %v", err))
+		os.Exit(-1)
+	}
+
+	deadband := impl.NewDeadband(
+		loggingClient,
+		metrics,
+		deadbandRules(loggingClient, settings),
+		optionalSetting(settings, "deadbandStateFile", ""),
+		time.Duration(intSetting(loggingClient, settings, "deadbandSaveIntervalInSeconds", 60))*time.Second)
+
+	filters := []contract.Filter{filter.Filter}
+	var cleanUps []contract.CleanUp
+
+	if window := intSetting(loggingClient, settings, "aggregateWindowInSeconds", 0); window > 0 {
+		aggregator, err := impl.NewAggregator(
+			loggingClient,
+			envelopedMarshaller(loggingClient, settings, impl.MessageTypeAggregate, marshaller),
+			impl.FilterRules{Include: listSetting(settings, "aggregateReadings")},
+			time.Duration(window)*time.Second,
+			boolSetting(loggingClient, settings, "aggregateSuppressRaw", false),
+			impl.NewRetryPublisher(
+				loggingClient,
+				metrics,
+				tracer,
+				1*time.Second,
+				shutdown,
+				mqtt.SenderForTopic(setting(loggingClient, settings, "aggregateTopic"))).Publish)
+		if err != nil {
+			loggingClient.Error(fmt.Sprintf("main.FactoryTransport NewAggregator failed: %v", err))
+			os.Exit(-1)
+		}
+		filters = append(filters, aggregator.Filter)
+		cleanUps = append(cleanUps, aggregator.CleanUp)
+	}
+	filters = append(filters, deadband.Filter)
+	cleanUps = append(cleanUps, deadband.CleanUp)
+
+	var profileClient contract.DeviceProfileClient
+	if boolSetting(loggingClient, settings, "notifyIncludeProfile", false) {
+		profileClient = metadata.NewDeviceProfileClient(
+			metadataEndpoint(clients.ApiDeviceProfileRoute),
+			endpointer)
+	}
+	var serviceClient contract.DeviceServiceClient
+	if boolSetting(loggingClient, settings, "notifyIncludeService", false) {
+		serviceClient = metadata.NewDeviceServiceClient(
+			metadataEndpoint(clients.ApiDeviceServiceRoute),
+			endpointer)
+	}
+	var addressableClient contract.AddressableClient
+	if boolSetting(loggingClient, settings, "notifyIncludeAddressable", false) {
+		addressableClient = metadata.NewAddressableClient(
+			metadataEndpoint(clients.ApiAddressableRoute),
+			endpointer)
+	}
+	notifier := impl.NewNotifier(
+		loggingClient,
+		metrics,
+		tracer,
+		compressedSender(
+			loggingClient,
+			settings,
+			"compressNewDevices",
+			mqtt,
+			setting(loggingClient, settings, "newDeviceTopic"),
+			qosAtLeastOnce),
+		envelopedMarshaller(loggingClient, settings, impl.MessageTypeDevice, marshaller),
+		shared.metadataClient,
+		profileClient,
+		serviceClient,
+		addressableClient)
+
+	eventSender := compressedSender(
+		loggingClient,
+		settings,
+		"compressEvents",
+		mqtt,
+		setting(loggingClient, settings, "eventTopic"),
+		qosAtLeastOnce)
+	publisher := impl.NewRetryPublisher(loggingClient, metrics, tracer, 1*time.Second, shutdown, eventSender).Publish
+	var windowCleanUp contract.CleanUp
+	if inFlightWindow := intSetting(loggingClient, settings, "inFlightWindow", 1); inFlightWindow > 1 {
+		window := impl.NewWindowPublisher(
+			loggingClient,
+			metrics,
+			tracer,
+			inFlightWindow,
+			1*time.Second,
+			shutdown,
+			eventSender)
+		publisher = window.Publish
+		windowCleanUp = window.CleanUp
+	}
+	// events are marshalled bare and enveloped only once they are past the rate limiter and ordering, so an envelope
+	// sequence gap indicates a lost event rather than one dropped deliberately.
+	var eventEnvelope contract.Marshaller
+	if boolSetting(loggingClient, settings, "envelope", false) {
+		eventEnvelope = envelopedMarshaller(loggingClient, settings, impl.MessageTypeEvent, marshaller)
+	}
+
+	if batchMaxCount := intSetting(loggingClient, settings, "batchMaxCount", 1); batchMaxCount > 1 {
+		batcher := impl.NewBatcher(
+			loggingClient,
+			envelopedMarshaller(loggingClient, settings, impl.MessageTypeEventBatch, marshaller),
+			batchMaxCount,
+			intSetting(loggingClient, settings, "batchMaxBytes", 131072),
+			time.Duration(intSetting(loggingClient, settings, "batchMaxLatencyInMilliseconds", 1000))*time.Millisecond,
+			publisher)
+		publisher = batcher.Publish
+		cleanUps = append(cleanUps, batcher.CleanUp)
+	} else if eventEnvelope != nil {
+		publisher = impl.EnvelopedPublisher(loggingClient, eventEnvelope, publisher)
+	}
+	if windowCleanUp != nil {
+		cleanUps = append(cleanUps, windowCleanUp)
+	}
+
+	globalRateLimit := rateLimit(loggingClient, settings, "rateLimit")
+	deviceRateLimit := rateLimit(loggingClient, settings, "rateLimitPerDevice")
+	if globalRateLimit.PerSecond > 0 || deviceRateLimit.PerSecond > 0 {
+		limiter, err := impl.NewRateLimiter(
+			loggingClient,
+			metrics,
+			globalRateLimit,
+			deviceRateLimit,
+			optionalSetting(settings, "rateLimitPolicy", impl.RateLimitDropNewest),
+			intSetting(loggingClient, settings, "rateLimitQueueSize", 1000),
+			intSetting(loggingClient, settings, "rateLimitSampleInterval", 10),
+			optionalSetting(settings, "rateLimitSpoolDirectory", "./spool"),
+			publisher)
+		if err != nil {
+			loggingClient.Error(fmt.Sprintf("main.FactoryTransport NewRateLimiter failed: %v", err))
+			os.Exit(-1)
+		}
+		publisher = limiter.Publish
+		cleanUps = append([]contract.CleanUp{limiter.CleanUp}, cleanUps...)
+	}
+
+	priorityRules := impl.PriorityRules{
+		Devices:  listSetting(settings, "priorityDevices"),
+		Readings: listSetting(settings, "priorityReadings"),
+		Above:    floatMapSetting(loggingClient, settings, "priorityAbove"),
+		Below:    floatMapSetting(loggingClient, settings, "priorityBelow"),
+	}
+	prioritizer, err := impl.NewPrioritizer(priorityRules)
+	if err != nil {
+		loggingClient.Error(fmt.Sprintf("main.FactoryTransport NewPrioritizer failed: %v", err))
+		os.Exit(-1)
+	}
+	if !priorityRules.Empty() {
+		alarmPublisher := impl.NewRetryPublisher(
+			loggingClient,
+			metrics,
+			tracer,
+			1*time.Second,
+			shutdown,
+			compressedSender(
+				loggingClient,
+				settings,
+				"compressEvents",
+				mqtt,
+				setting(loggingClient, settings, "alarmTopic"),
+				qosSetting(loggingClient, settings, "alarmQos", qosAtLeastOnce))).Publish
+		if boolSetting(loggingClient, settings, "envelope", false) {
+			// high priority events are sent out of order with other events, so they are enveloped individually with a
+			// sequence of their own.
+			alarmPublisher = impl.EnvelopedPublisher(
+				loggingClient,
+				envelopedMarshaller(loggingClient, settings, impl.MessageTypeAlarm, marshaller),
+				alarmPublisher)
+		}
+		lanes := impl.NewLanes(
+			intSetting(loggingClient, settings, "priorityQueueSize", 16),
+			alarmPublisher,
+			publisher)
+		publisher = lanes.Publish
+		cleanUps = append([]contract.CleanUp{lanes.CleanUp}, cleanUps...)
+	}
+	var notified func(deviceName string)
+	if boolSetting(loggingClient, settings, "orderMetadataFirst", false) {
+		ordering := impl.NewOrdering(
+			loggingClient,
+			metrics,
+			positiveIntSetting(loggingClient, settings, "orderMetadataFirstMaxHeld", 100),
+			publisher)
+		publisher = ordering.Publish
+		notified = ordering.Release
+		cleanUps = append([]contract.CleanUp{ordering.CleanUp}, cleanUps...)
+	}
+	if catalogueTopic := optionalSetting(settings, "catalogueTopic", ""); len(catalogueTopic) > 0 {
+		catalogue := impl.NewCataloguePublisher(
+			loggingClient,
+			impl.NewCommandCatalogueClient(shared.commandEndpoint(clients.ApiDeviceRoute), endpointer),
+			envelopedMarshaller(loggingClient, settings, impl.MessageTypeCatalogue, marshaller),
+			mqtt.SenderForTopic(catalogueTopic),
+			time.Duration(intSetting(loggingClient, settings, "catalogueIntervalInSeconds", 300))*time.Second,
+			time.Duration(intSetting(loggingClient, settings, "catalogueTimeoutInSeconds", 10))*time.Second)
+		release := notified
+		notified = func(deviceName string) {
+			if release != nil {
+				release(deviceName)
+			}
+			catalogue.Refresh()
+		}
+		cleanUps = append([]contract.CleanUp{catalogue.CleanUp}, cleanUps...)
+	}
+	tracker := impl.NewDeviceTracker(
+		loggingClient,
+		metrics,
+		notifier.Notify,
+		intSetting(loggingClient, settings, "notifyWorkers", 4),
+		time.Duration(intSetting(loggingClient, settings, "notifyTimeoutInSeconds", 10))*time.Second,
+		intSetting(loggingClient, settings, "notifyQueueSize", 64),
+		time.Duration(intSetting(loggingClient, settings, "notifyRetryInitialBackoffInSeconds", 1))*time.Second,
+		time.Duration(intSetting(loggingClient, settings, "notifyRetryMaxBackoffInSeconds", 300))*time.Second,
+		notified)
+	cleanUps = append([]contract.CleanUp{shutdown.Begin, tracker.CleanUp}, cleanUps...)
+
+	if statusTopic := optionalSetting(settings, "statusTopic", ""); len(statusTopic) > 0 {
+		heartbeat := impl.NewHeartbeat(
+			loggingClient,
+			envelopedMarshaller(loggingClient, settings, impl.MessageTypeStatus, marshaller),
+			mqtt.SenderForTopic(statusTopic),
+			time.Duration(intSetting(loggingClient, settings, "statusIntervalInSeconds", 60))*time.Second,
+			func() interface{} {
+				lastError, lastErrorTime := shared.lastError()
+				return gatewayStatus(
+					shared.started,
+					time.Now(),
+					metrics,
+					tracker.Known(),
+					tracker.Pending(),
+					activeServer(),
+					lastError,
+					lastErrorTime)
+			})
+		cleanUps = append([]contract.CleanUp{heartbeat.CleanUp}, cleanUps...)
+	}
+
+	transport := NewTransport(
+		loggingClient,
+		metrics,
+		tracer,
+		impl.FilterChain(filters...),
+		prioritizer.Prioritize,
+		publisher,
+		tracker.Track,
+		marshaller,
+		func() {
+			for _, cleanUp := range cleanUps {
+				cleanUp()
+			}
+		})
+	return transport, mqtt
+}
+
+// FactoryTransport returns a function that can be called by the EdgeX Applications Functions SDK; it fans each event
+// out to the transport of every configured broker.
+func FactoryTransport(sdk *appsdk.AppFunctionsSDK) *fanout {
+	started := time.Now()
+	errorRecorder := impl.NewErrorRecorder(sdk.LoggingClient)
+	sdk.LoggingClient = errorRecorder
 	settings := sdk.ApplicationSettings()
 
-	mqtt := impl.NewMqttInstanceForCloud(
+	registry := impl.NewMetrics()
+	tracer, tracerCleanUp := tracer(sdk.LoggingClient, settings, registry)
+
+	var endpointer clients.Endpointer
+	registryCleanUp := func() {}
+	if registryClient := registryClient(sdk); registryClient != nil {
+		resolver := impl.NewRegistryEndpoint(sdk.LoggingClient, registryClient)
+		endpointer, registryCleanUp = resolver, resolver.CleanUp
+	}
+	commandEndpoint := func(route string) types.EndpointParams {
+		return endpoint(
+			sdk.LoggingClient,
+			settings,
+			clients.CoreCommandServiceKey,
+			"edgeXCommandUri",
+			route,
+			endpointer != nil)
+	}
+	metadataEndpoint := func(route string) types.EndpointParams {
+		return endpoint(
+			sdk.LoggingClient,
+			settings,
+			clients.CoreMetaDataServiceKey,
+			"edgeXMetaDataUri",
+			route,
+			endpointer != nil)
+	}
+
+	var commandClient contract.CommandClient
+	if boolSetting(sdk.LoggingClient, settings, "executeCommands", false) {
+		commandClient = impl.NewCommandClient(commandEndpoint(clients.ApiDeviceRoute), endpointer)
+	}
+	commandHandler := impl.NewCommandHandler(
 		sdk.LoggingClient,
-		setting(sdk.LoggingClient, settings, "certFile"),
-		setting(sdk.LoggingClient, settings, "keyFile"),
-		setting(sdk.LoggingClient, settings, "clientId"),
-		setting(sdk.LoggingClient, settings, "userName"),
-		setting(sdk.LoggingClient, settings, "password"),
-		setting(sdk.LoggingClient, settings, "server"),
-		setting(sdk.LoggingClient, settings, "eventTopic"),
-		setting(sdk.LoggingClient, settings, "newDeviceTopic"),
-		setting(sdk.LoggingClient, settings, "commandTopic"),
-		impl.NewCommandHandler(sdk.LoggingClient).Receiver)
+		registry,
+		tracer,
+		commandClient,
+		envelopedMarshaller(sdk.LoggingClient, settings, impl.MessageTypeCommandResponse, json.Marshal),
+		intSetting(sdk.LoggingClient, settings, "commandWorkers", 4),
+		time.Duration(intSetting(sdk.LoggingClient, settings, "commandTimeoutInSeconds", 10))*time.Second,
+		intSetting(sdk.LoggingClient, settings, "commandQueueSize", 64))
 
-	marshaller := json.Marshal
+	var metadataClient contract.MetadataClient = metadata.NewDeviceClient(
+		metadataEndpoint(clients.ApiDeviceRoute),
+		endpointer)
+	if ttl := intSetting(sdk.LoggingClient, settings, "metadataCacheTtlInSeconds", 300); ttl > 0 {
+		metadataClient = impl.NewMetadataCache(
+			registry,
+			metadataClient,
+			time.Duration(ttl)*time.Second,
+			time.Duration(intSetting(sdk.LoggingClient, settings, "metadataCacheNegativeTtlInSeconds", 30))*time.Second)
+	}
 
-	metadataClient := metadata.NewDeviceClient(
-		types.EndpointParams{
-			ServiceKey:  clients.CoreMetaDataServiceKey,
-			Path:        clients.ApiDeviceRoute,
-			UseRegistry: false,
-			Url:         setting(sdk.LoggingClient, settings, "edgeXMetaDataUri") + clients.ApiDeviceRoute,
-			Interval:    clients.ClientMonitorDefault,
-		},
-		nil)
+	shared := services{
+		started:          started,
+		tracer:           tracer,
+		endpointer:       endpointer,
+		metadataClient:   metadataClient,
+		metadataEndpoint: metadataEndpoint,
+		commandEndpoint:  commandEndpoint,
+		receiver:         commandHandler.Receiver,
+		lastError:        errorRecorder.LastError,
+	}
+	var brokers []broker
+	var connections []contract.Connection
+	cleanUps := []contract.CleanUp{registryCleanUp, commandHandler.CleanUp}
+	for _, name := range brokerNames(sdk.LoggingClient, settings) {
+		var metrics brokerMetrics = registry
+		var loggingClient logger.LoggingClient = sdk.LoggingClient
+		if len(name) > 0 {
+			metrics = registry.WithLabel(impl.LogFieldBroker, name)
+			loggingClient = impl.NewFieldLogger(sdk.LoggingClient, impl.LogFieldBroker, name)
+		}
+		transport, mqtt := brokerTransport(loggingClient, brokerSettings(settings, name), metrics, shared)
+		brokers = append(brokers, broker{name: name, transport: transport, metrics: metrics})
+		connections = append(connections, mqtt)
+		cleanUps = append(cleanUps, mqtt.CleanUp)
+	}
+	cleanUps = append(cleanUps, tracerCleanUp)
 
-	notifier := impl.NewNotifier(sdk.LoggingClient, mqtt.NewDeviceSender, marshaller, metadataClient)
+	if address := optionalSetting(settings, "httpListenAddress", ""); len(address) > 0 {
+		health := impl.NewHealth(
+			impl.NewConnections(connections...),
+			func() int64 { return registry.Sum(MetricOutboundBacklog) },
+			impl.NewPinger(metadataEndpoint(clients.ApiPingRoute), endpointer).Ping,
+			time.Duration(intSetting(sdk.LoggingClient, settings, "healthTimeoutInSeconds", 2))*time.Second,
+			int64(intSetting(sdk.LoggingClient, settings, "readinessMaxBacklog", 1000)))
+		server := impl.NewServer(sdk.LoggingClient, address)
+		server.Handle("/metrics", registry)
+		server.Handle("/health", http.HandlerFunc(health.Live))
+		server.Handle("/ready", http.HandlerFunc(health.Ready))
+		server.Start()
+		cleanUps = append([]contract.CleanUp{server.CleanUp}, cleanUps...)
+	}
 
-	return NewTransport(sdk.LoggingClient, 1*time.Second, mqtt.EventSender, notifier.Notify, marshaller, mqtt.CleanUp)
+	return NewFanout(
+		sdk.LoggingClient,
+		brokers,
+		intSetting(sdk.LoggingClient, settings, "brokerQueueSize", 1000),
+		func() {
+			for _, cleanUp := range cleanUps {
+				cleanUp()
+			}
+		})
 }
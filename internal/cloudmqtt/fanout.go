@@ -0,0 +1,189 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package cloudmqtt
+
+import (
+	"fmt"
+	"github.com/edgexfoundry/app-functions-sdk-go/appcontext"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
+	"sync"
+	"sync/atomic"
+)
+
+const MetricFanoutDropped = "cloudmqtt_fanout_dropped_total"
+
+// sharedContext is a receiver wrapping the EdgeX context of an event sent to several brokers; the event is marked as
+// pushed once every broker has pushed it.
+type sharedContext struct {
+	EdgeXContext contract.EdgeXContext
+	remaining    int32
+}
+
+// MarkAsPushed method implements EdgeXContext contract.
+func (c *sharedContext) MarkAsPushed() error {
+	if atomic.AddInt32(&c.remaining, -1) == 0 {
+		return c.EdgeXContext.MarkAsPushed()
+	}
+	return nil
+}
+
+// skipped function accounts for an event a broker will not push (because it was filtered out, could not be
+// marshalled, or was dropped) by marking it as pushed, so an event is settled the same way whether it is sent to one
+// broker or several; if the event is shared with other brokers it is marked as pushed once they have pushed it.
+func skipped(
+	loggingClient logger.LoggingClient,
+	EdgeXContext contract.EdgeXContext,
+	correlationId string,
+	eventId string,
+	deviceName string) {
+
+	if err := EdgeXContext.MarkAsPushed(); err != nil {
+		loggingClient.Error(
+			err.Error(),
+			impl.LogFieldCorrelationId, correlationId,
+			impl.LogFieldEventId, eventId,
+			impl.LogFieldDevice, deviceName,
+			impl.LogFieldError, err.Error())
+	}
+}
+
+// fanoutItem contains an event queued for a broker and the context that delivered it.
+type fanoutItem struct {
+	EdgeXContext contract.EdgeXContext
+	event        models.Event
+}
+
+// broker contains a named broker connection's transport and the metrics it records.
+type broker struct {
+	name      string
+	transport *transport
+	metrics   contract.Metrics
+}
+
+// fanoutBroker contains a broker and the queue of events awaiting its transport.
+type fanoutBroker struct {
+	broker
+	queue chan fanoutItem
+}
+
+// fanout is a receiver that sends each event to the transport of every configured broker; each broker has its own
+// queue and worker so that a slow broker does not block the others.
+type fanout struct {
+	loggingClient logger.LoggingClient
+	brokers       []*fanoutBroker
+	wg            sync.WaitGroup
+	cleanUp       contract.CleanUp
+}
+
+// NewFanout is a constructor that returns a configured fanout receiver whose Run() method can be included in a call to
+// the EdgeX Applications Functions SDK's SetFunctionsPipeline() method.  Each broker queues up to queueSize events;
+// a single broker's transport is called directly.  cleanUp is called once every broker's transport has been cleaned
+// up.
+func NewFanout(
+	loggingClient logger.LoggingClient,
+	brokers []broker,
+	queueSize int,
+	cleanUp contract.CleanUp) *fanout {
+
+	f := &fanout{
+		loggingClient: loggingClient,
+		cleanUp:       cleanUp,
+	}
+	for _, broker := range brokers {
+		b := &fanoutBroker{broker: broker}
+		if len(brokers) > 1 {
+			b.queue = make(chan fanoutItem, queueSize)
+			f.wg.Add(1)
+			go f.worker(b)
+		}
+		f.brokers = append(f.brokers, b)
+	}
+	return f
+}
+
+// fanoutDroppedLogMessage function formats and returns the log message for when an event is not sent to a broker
+// because the broker's queue is full.
+func fanoutDroppedLogMessage(brokerName string, eventId string) string {
+	return fmt.Sprintf("fan-out to %s dropped %s (queue full)", brokerName, eventId)
+}
+
+// worker method runs the broker's transport for each event queued for it.
+func (f *fanout) worker(b *fanoutBroker) {
+	defer f.wg.Done()
+	for item := range b.queue {
+		b.transport.run(item.EdgeXContext, item.event)
+	}
+}
+
+// copyEvent function returns a copy of event whose readings can be filtered independently of the original's.
+func copyEvent(event models.Event) models.Event {
+	event.Readings = append([]models.Reading(nil), event.Readings...)
+	return event
+}
+
+// run method is internal implementation delegated to by publicly accessible Run(); implemented to facilitate
+// unit testing
+func (f *fanout) run(EdgeXContext contract.EdgeXContext, params ...interface{}) (bool, interface{}) {
+	if len(f.brokers) == 1 {
+		return f.brokers[0].transport.run(EdgeXContext, params...)
+	}
+
+	for _, param := range params {
+		event, ok := param.(models.Event)
+		if !ok {
+			continue
+		}
+		shared := &sharedContext{EdgeXContext: EdgeXContext, remaining: int32(len(f.brokers))}
+		for _, b := range f.brokers {
+			select {
+			case b.queue <- fanoutItem{EdgeXContext: shared, event: copyEvent(event)}:
+			default:
+				f.loggingClient.Warn(
+					fanoutDroppedLogMessage(b.name, event.ID),
+					impl.LogFieldCorrelationId, correlationIdFor(EdgeXContext, &event),
+					impl.LogFieldEventId, event.ID,
+					impl.LogFieldDevice, event.Device,
+					impl.LogFieldBroker, b.name)
+				b.metrics.Increment(MetricFanoutDropped, 1)
+				skipped(f.loggingClient, shared, correlationIdFor(EdgeXContext, &event), event.ID, event.Device)
+			}
+		}
+	}
+	return true, params
+}
+
+// Run method is an EdgeX Applications Function SDK-compatible function that can be included in a call to its
+// SetFunctionsPipeline() method.
+func (f *fanout) Run(EdgeXContext *appcontext.Context, params ...interface{}) (bool, interface{}) {
+	return f.run(EdgeXContext, params[0])
+}
+
+// CleanUp method waits for each broker's queued events to be handed to its transport, cleans up each transport, and
+// then performs the remaining end of execution clean up activity.
+func (f *fanout) CleanUp() {
+	for _, b := range f.brokers {
+		if b.queue != nil {
+			close(b.queue)
+		}
+	}
+	f.wg.Wait()
+	for _, b := range f.brokers {
+		b.transport.CleanUp()
+	}
+	f.cleanUp()
+}
@@ -0,0 +1,249 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package cloudmqtt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+//  SUT factory
+//
+
+func newFanoutBroker(name string, metrics contract.Metrics, filter contract.Filter, publish contract.Publisher) broker {
+	return broker{
+		name: name,
+		transport: NewTransport(
+			stub.NewLoggerStub(),
+			metrics,
+			impl.NewNopTracer(),
+			filter,
+			prioritizeImpl(impl.PriorityNormal),
+			publish,
+			func(ctx context.Context, event *models.Event) {},
+			json.Marshal,
+			func() {}),
+		metrics: metrics,
+	}
+}
+
+//
+//  utility and helper functions
+//
+
+func waitForPublished(publisher *stub.Publisher, count int) []contract.Message {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if published := publisher.Published(); len(published) >= count {
+			return published
+		}
+	}
+	return publisher.Published()
+}
+
+//
+//  unit tests
+//
+
+func TestFanoutWithSingleBrokerRunsTransportDirectly(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{newFanoutBroker("", impl.NewMetrics(), newFilterImpl().filter, publisher.Publish)},
+		1,
+		func() {})
+	defer sut.CleanUp()
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+
+	assert.Equal(t, 1, len(publisher.Published()))
+}
+
+func TestFanoutSendsEachEventToEveryBrokerAndMarksPushedOnceAllHavePushed(t *testing.T) {
+	aws, support := stub.NewPublisherImpl(), stub.NewPublisherImpl()
+	registry := impl.NewMetrics()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{
+			newFanoutBroker("aws", registry.WithLabel("broker", "aws"), newFilterImpl().filter, aws.Publish),
+			newFanoutBroker("support", registry.WithLabel("broker", "support"), newFilterImpl().filter, support.Publish),
+		},
+		4,
+		func() {})
+	defer sut.CleanUp()
+	EdgeXContext := newEdgeXContextImpl()
+
+	sut.run(EdgeXContext, stub.NewEvent())
+
+	assert.Equal(t, 1, len(waitForPublished(aws, 1)))
+	assert.Equal(t, 1, len(waitForPublished(support, 1)))
+	aws.PushAll()
+	assert.Equal(t, 0, EdgeXContext.MarkAsPushedCalledCount)
+	support.PushAll()
+	assert.Equal(t, 1, EdgeXContext.MarkAsPushedCalledCount)
+	assert.Equal(t, int64(1), registry.Counter(`cloudmqtt_events_received_total{broker="aws"}`))
+	assert.Equal(t, int64(1), registry.Counter(`cloudmqtt_events_received_total{broker="support"}`))
+}
+
+func TestFanoutDropsEventsForBrokerWhoseQueueIsFullWithoutBlockingOthers(t *testing.T) {
+	fast := stub.NewPublisherImpl()
+	blocked, release := make(chan struct{}), make(chan struct{})
+	registry := impl.NewMetrics()
+	loggingClient := stub.NewLoggerStub()
+	sut := NewFanout(
+		loggingClient,
+		[]broker{
+			newFanoutBroker("fast", registry.WithLabel("broker", "fast"), newFilterImpl().filter, fast.Publish),
+			newFanoutBroker(
+				"slow",
+				registry.WithLabel("broker", "slow"),
+				newFilterImpl().filter,
+				func(message contract.Message) {
+					blocked <- struct{}{}
+					<-release
+				}),
+		},
+		1,
+		func() {})
+	events := []models.Event{stub.NewEvent(), stub.NewEvent(), stub.NewEvent()}
+	dropped := newEdgeXContextImpl()
+
+	sut.run(newEdgeXContextImpl(), events[0])
+	<-blocked
+	waitForPublished(fast, 1)
+	sut.run(newEdgeXContextImpl(), events[1])
+	waitForPublished(fast, 2)
+	sut.run(dropped, events[2])
+
+	assert.Equal(t, 3, len(waitForPublished(fast, 3)))
+	assert.True(t, loggingClient.SpecificWarningOccurred(fanoutDroppedLogMessage("slow", events[2].ID)))
+	assert.Equal(t, int64(1), registry.Counter(`cloudmqtt_fanout_dropped_total{broker="slow"}`))
+	assert.Equal(t, int64(0), registry.Counter(`cloudmqtt_fanout_dropped_total{broker="fast"}`))
+	fast.PushAll()
+	assert.Equal(t, 1, dropped.MarkAsPushedCalledCount)
+
+	close(release)
+	go func() {
+		for range blocked {
+		}
+	}()
+	sut.CleanUp()
+	close(blocked)
+}
+
+func TestFanoutMarksPushedOnceOtherBrokersHavePushedEventFilteredOutByOne(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{
+			newFanoutBroker("all", impl.NewMetrics(), newFilterImpl().filter, publisher.Publish),
+			newFanoutBroker(
+				"none",
+				impl.NewMetrics(),
+				func(event *models.Event) bool { return false },
+				stub.NewPublisherImpl().Publish),
+		},
+		4,
+		func() {})
+	EdgeXContext := newEdgeXContextImpl()
+
+	sut.run(EdgeXContext, stub.NewEvent())
+	sut.CleanUp()
+	publisher.PushAll()
+
+	assert.Equal(t, 1, len(publisher.Published()))
+	assert.Equal(t, 1, EdgeXContext.MarkAsPushedCalledCount)
+}
+
+func TestFanoutMarksPushedOnceOtherBrokersHavePushedEventDroppedByOne(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{
+			newFanoutBroker("all", impl.NewMetrics(), newFilterImpl().filter, publisher.Publish),
+			newFanoutBroker(
+				"dropping",
+				impl.NewMetrics(),
+				newFilterImpl().filter,
+				func(message contract.Message) { message.Dropped() }),
+		},
+		4,
+		func() {})
+	EdgeXContext := newEdgeXContextImpl()
+
+	sut.run(EdgeXContext, stub.NewEvent())
+	sut.CleanUp()
+	assert.Equal(t, 0, EdgeXContext.MarkAsPushedCalledCount)
+	publisher.PushAll()
+
+	assert.Equal(t, 1, EdgeXContext.MarkAsPushedCalledCount)
+}
+
+func TestFanoutGivesEachBrokerItsOwnCopyOfReadings(t *testing.T) {
+	all, filtered := stub.NewPublisherImpl(), stub.NewPublisherImpl()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{
+			newFanoutBroker("all", impl.NewMetrics(), newFilterImpl().filter, all.Publish),
+			newFanoutBroker(
+				"filtered",
+				impl.NewMetrics(),
+				func(event *models.Event) bool {
+					event.Readings[0].Value = "filtered"
+					event.Readings = event.Readings[:0]
+					return true
+				},
+				filtered.Publish),
+		},
+		4,
+		func() {})
+	event := stub.NewEvent()
+	event.Readings = []models.Reading{{Name: "temperature", Value: "20"}}
+
+	sut.run(newEdgeXContextImpl(), event)
+	sut.CleanUp()
+
+	var sent models.Event
+	assert.Nil(t, json.Unmarshal(waitForPublished(all, 1)[0].Data, &sent))
+	assert.Equal(t, "20", sent.Readings[0].Value)
+	assert.Nil(t, json.Unmarshal(waitForPublished(filtered, 1)[0].Data, &sent))
+	assert.Empty(t, sent.Readings)
+}
+
+func TestFanoutCleanUpDrainsQueuesBeforeCleaningUp(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	cleanUp := newCleanUpImpl()
+	sut := NewFanout(
+		stub.NewLoggerStub(),
+		[]broker{
+			newFanoutBroker("first", impl.NewMetrics(), newFilterImpl().filter, publisher.Publish),
+			newFanoutBroker("second", impl.NewMetrics(), newFilterImpl().filter, publisher.Publish),
+		},
+		4,
+		cleanUp.CleanUp)
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	sut.CleanUp()
+
+	assert.Equal(t, 2, len(publisher.Published()))
+	assert.Equal(t, 1, cleanUp.CleanUpCalledCount)
+}
@@ -0,0 +1,248 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReadingSummary is the summary of a reading's numeric values over a window.
+type ReadingSummary struct {
+	Name  string  `json:"name"`
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Last  float64 `json:"last"`
+}
+
+// DeviceSummary is the structure transmitted northbound for each device at the end of each window; Start and End
+// are milliseconds since the epoch.
+type DeviceSummary struct {
+	Device   string           `json:"device"`
+	Start    int64            `json:"start"`
+	End      int64            `json:"end"`
+	Readings []ReadingSummary `json:"readings"`
+}
+
+// aggregate is a receiver wrapping windowed aggregation of numeric readings.
+type aggregate struct {
+	loggingClient logger.LoggingClient
+	marshal       contract.Marshaller
+	publish       contract.Publisher
+	readings      *matcher
+	window        time.Duration
+	suppressRaw   bool
+	now           func() time.Time
+	mutex         sync.Mutex
+	start         time.Time
+	summaries     map[string]map[string]*ReadingSummary
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewAggregator is a constructor that returns an instance of aggregate configured to summarize the numeric readings
+// whose names are included by readingRules over tumbling windows of the specified duration and publish the summaries
+// at the end of each window; if suppressRaw is true, the summarized readings are removed from events.
+func NewAggregator(
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	readingRules FilterRules,
+	window time.Duration,
+	suppressRaw bool,
+	publish contract.Publisher) (*aggregate, error) {
+
+	return newAggregator(loggingClient, marshal, readingRules, window, suppressRaw, publish, time.Now)
+}
+
+// newAggregator function implements NewAggregator with an injectable clock.
+func newAggregator(
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	readingRules FilterRules,
+	window time.Duration,
+	suppressRaw bool,
+	publish contract.Publisher,
+	now func() time.Time) (*aggregate, error) {
+
+	readings, err := newMatcher(readingRules)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aggregate{
+		loggingClient: loggingClient,
+		marshal:       marshal,
+		publish:       publish,
+		readings:      readings,
+		window:        window,
+		suppressRaw:   suppressRaw,
+		now:           now,
+		summaries:     make(map[string]map[string]*ReadingSummary),
+		done:          make(chan struct{}),
+	}
+	a.start = a.now().Truncate(window)
+	a.wg.Add(1)
+	go a.windower()
+	return a, nil
+}
+
+// windower method is executed as goroutine by constructor and is responsible for publishing summaries at the end of
+// each window.
+func (a *aggregate) windower() {
+	defer a.wg.Done()
+
+	for {
+		now := a.now()
+		timer := time.NewTimer(now.Truncate(a.window).Add(a.window).Sub(now))
+		select {
+		case <-a.done:
+			stopTimer(timer)
+			a.flush(a.now())
+			return
+		case <-timer.C:
+			a.flush(a.now())
+		}
+	}
+}
+
+// milliseconds function returns t in milliseconds since the epoch.
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// aggregateMarshalFailedLogMessage function formats and returns the log message for when an attempt to marshal a
+// device summary fails.
+func aggregateMarshalFailedLogMessage(deviceName string, errorMessage string) string {
+	return fmt.Sprintf("marshal failed for summary of %s (%s)", deviceName, errorMessage)
+}
+
+// aggregateSentLogMessage function formats and returns the log message for when a device summary has been sent.
+func aggregateSentLogMessage(deviceName string) string {
+	return fmt.Sprintf("summary sent for %s", deviceName)
+}
+
+// flush method ends the current window at now and publishes a summary for each device with readings in the window.
+func (a *aggregate) flush(now time.Time) {
+	a.mutex.Lock()
+	summaries := a.summaries
+	start := a.start
+	a.summaries = make(map[string]map[string]*ReadingSummary)
+	a.start = now.Truncate(a.window)
+	a.mutex.Unlock()
+
+	deviceNames := make([]string, 0, len(summaries))
+	for deviceName := range summaries {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	sort.Strings(deviceNames)
+
+	for _, deviceName := range deviceNames {
+		summary := DeviceSummary{Device: deviceName, Start: milliseconds(start), End: milliseconds(now)}
+		for _, reading := range summaries[deviceName] {
+			summary.Readings = append(summary.Readings, *reading)
+		}
+		sort.Slice(summary.Readings, func(i, j int) bool { return summary.Readings[i].Name < summary.Readings[j].Name })
+
+		bytes, err := a.marshal(summary)
+		if err != nil {
+			a.loggingClient.Error(
+				aggregateMarshalFailedLogMessage(deviceName, err.Error()),
+				LogFieldDevice, deviceName,
+				LogFieldError, err.Error())
+			continue
+		}
+
+		name := deviceName
+		a.publish(
+			contract.Message{
+				Data: bytes,
+				Pushed: func() {
+					a.loggingClient.Debug(aggregateSentLogMessage(name), LogFieldDevice, name)
+				},
+			})
+	}
+}
+
+// add method includes value in the current window's summary of the device's reading; the mean is kept as a running
+// mean so that it cannot overflow.
+func (a *aggregate) add(deviceName string, readingName string, value float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	readings, ok := a.summaries[deviceName]
+	if !ok {
+		readings = make(map[string]*ReadingSummary)
+		a.summaries[deviceName] = readings
+	}
+
+	summary, ok := readings[readingName]
+	if !ok {
+		readings[readingName] = &ReadingSummary{Name: readingName, Count: 1, Min: value, Max: value, Mean: value, Last: value}
+		return
+	}
+
+	summary.Count++
+	summary.Min = math.Min(summary.Min, value)
+	summary.Max = math.Max(summary.Max, value)
+	summary.Mean += value/float64(summary.Count) - summary.Mean/float64(summary.Count)
+	summary.Last = value
+}
+
+// finiteValue function returns the value of a numeric reading; ok is false if the reading is not numeric or its value
+// is not finite (NaN and infinities cannot be represented in a JSON summary).
+func finiteValue(reading models.Reading) (value float64, ok bool) {
+	value, err := strconv.ParseFloat(reading.Value, 64)
+	return value, err == nil && !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// Filter method implements Filter contract; it adds included numeric readings with finite values to the current window
+// and, if raw readings are suppressed, removes them from the event.  Other readings are left in the event.
+func (a *aggregate) Filter(event *models.Event) bool {
+	if len(event.Readings) == 0 {
+		return true
+	}
+
+	readings := make([]models.Reading, 0, len(event.Readings))
+	for _, reading := range event.Readings {
+		if a.readings.included(reading.Name) {
+			if value, ok := finiteValue(reading); ok {
+				a.add(event.Device, reading.Name, value)
+				if a.suppressRaw {
+					continue
+				}
+			}
+		}
+		readings = append(readings, reading)
+	}
+
+	event.Readings = readings
+	return len(readings) > 0
+}
+
+// CleanUp method publishes the summaries for the current (partial) window and ensures the windower() goroutine has
+// completed.
+func (a *aggregate) CleanUp() {
+	close(a.done)
+	a.wg.Wait()
+}
@@ -0,0 +1,270 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/google/uuid"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const aggregateWindowForTesting = time.Hour
+
+//
+//  SUT factory
+//
+
+func newAggregatorSUT(
+	t *testing.T,
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	readingRules FilterRules,
+	suppressRaw bool,
+	publisher *stub.Publisher,
+	now time.Time) *aggregate {
+
+	sut, err := newAggregator(
+		loggingClient,
+		marshal,
+		readingRules,
+		aggregateWindowForTesting,
+		suppressRaw,
+		publisher.Publish,
+		func() time.Time { return now })
+	assert.Nil(t, err)
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func startOfWindowForTesting() time.Time {
+	return time.Now().Truncate(aggregateWindowForTesting)
+}
+
+func newEventWithReadingValues(deviceName string, nameAndValues ...string) models.Event {
+	event := stub.NewEventForDevice(deviceName)
+	for i := 0; i+1 < len(nameAndValues); i += 2 {
+		event.Readings = append(
+			event.Readings,
+			models.Reading{Id: uuid.New().String(), Device: deviceName, Name: nameAndValues[i], Value: nameAndValues[i+1]})
+	}
+	return event
+}
+
+func unmarshalSummaries(t *testing.T, publisher *stub.Publisher) (result []DeviceSummary) {
+	for _, message := range publisher.Published() {
+		var summary DeviceSummary
+		assert.Nil(t, json.Unmarshal(message.Data, &summary))
+		result = append(result, summary)
+	}
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestNewAggregatorWithInvalidRegularExpressionReturnsError(t *testing.T) {
+	sut, err := NewAggregator(
+		stub.NewLoggerStub(),
+		json.Marshal,
+		FilterRules{Include: []string{"re:("}},
+		aggregateWindowForTesting,
+		false,
+		stub.NewPublisherImpl().Publish)
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestAggregateSummarizesReadingsPerDeviceAtEndOfWindow(t *testing.T) {
+	start := startOfWindowForTesting()
+	publisher := stub.NewPublisherImpl()
+	sut := newAggregatorSUT(t, stub.NewLoggerStub(), json.Marshal, FilterRules{}, false, publisher, start.Add(time.Minute))
+	defer sut.CleanUp()
+	events := []models.Event{
+		newEventWithReadingValues("device1", "temperature", "20", "humidity", "50"),
+		newEventWithReadingValues("device1", "temperature", "26"),
+		newEventWithReadingValues("device1", "temperature", "23"),
+		newEventWithReadingValues("device2", "temperature", "10"),
+	}
+	for i := range events {
+		assert.True(t, sut.Filter(&events[i]))
+	}
+
+	end := start.Add(aggregateWindowForTesting)
+	sut.flush(end)
+
+	assert.Equal(
+		t,
+		[]DeviceSummary{
+			{
+				Device: "device1",
+				Start:  milliseconds(start),
+				End:    milliseconds(end),
+				Readings: []ReadingSummary{
+					{Name: "humidity", Count: 1, Min: 50, Max: 50, Mean: 50, Last: 50},
+					{Name: "temperature", Count: 3, Min: 20, Max: 26, Mean: 23, Last: 23},
+				},
+			},
+			{
+				Device:   "device2",
+				Start:    milliseconds(start),
+				End:      milliseconds(end),
+				Readings: []ReadingSummary{{Name: "temperature", Count: 1, Min: 10, Max: 10, Mean: 10, Last: 10}},
+			},
+		},
+		unmarshalSummaries(t, publisher))
+}
+
+func TestAggregateNextWindowStartsEmpty(t *testing.T) {
+	start := startOfWindowForTesting()
+	publisher := stub.NewPublisherImpl()
+	sut := newAggregatorSUT(t, stub.NewLoggerStub(), json.Marshal, FilterRules{}, false, publisher, start)
+	defer sut.CleanUp()
+	event := newEventWithReadingValues("device", "temperature", "20")
+	sut.Filter(&event)
+
+	sut.flush(start.Add(aggregateWindowForTesting))
+	sut.flush(start.Add(2 * aggregateWindowForTesting))
+
+	assert.Equal(t, 1, len(publisher.Published()))
+}
+
+func TestAggregateRawReadingsAreSentUnlessSuppressed(t *testing.T) {
+	tests := []struct {
+		name        string
+		suppressRaw bool
+		expected    []string
+	}{
+		{"not suppressed", false, []string{"temperature", "state", "humidity"}},
+		{"suppressed", true, []string{"state", "humidity"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sut := newAggregatorSUT(
+				t,
+				stub.NewLoggerStub(),
+				json.Marshal,
+				FilterRules{Exclude: []string{"humidity"}},
+				test.suppressRaw,
+				stub.NewPublisherImpl(),
+				startOfWindowForTesting())
+			defer sut.CleanUp()
+			event := newEventWithReadingValues("device", "temperature", "20", "state", "open", "humidity", "50")
+
+			assert.True(t, sut.Filter(&event))
+			assert.Equal(t, test.expected, readingNames(event))
+		})
+	}
+}
+
+func TestAggregateEventWithAllReadingsSuppressedIsRejected(t *testing.T) {
+	sut := newAggregatorSUT(
+		t,
+		stub.NewLoggerStub(),
+		json.Marshal,
+		FilterRules{},
+		true,
+		stub.NewPublisherImpl(),
+		startOfWindowForTesting())
+	defer sut.CleanUp()
+	event := newEventWithReadingValues("device", "temperature", "20")
+
+	assert.False(t, sut.Filter(&event))
+}
+
+func TestAggregateNonFiniteReadingsAreNotSummarized(t *testing.T) {
+	start := startOfWindowForTesting()
+	publisher := stub.NewPublisherImpl()
+	sut := newAggregatorSUT(t, stub.NewLoggerStub(), json.Marshal, FilterRules{}, true, publisher, start)
+	defer sut.CleanUp()
+	event := newEventWithReadingValues(
+		"device",
+		"temperature", "20",
+		"temperature", "NaN",
+		"temperature", "+Inf",
+		"temperature", "-Inf")
+
+	assert.True(t, sut.Filter(&event))
+	assert.Equal(t, []string{"temperature", "temperature", "temperature"}, readingNames(event))
+
+	end := start.Add(aggregateWindowForTesting)
+	sut.flush(end)
+
+	assert.Equal(
+		t,
+		[]DeviceSummary{
+			{
+				Device:   "device",
+				Start:    milliseconds(start),
+				End:      milliseconds(end),
+				Readings: []ReadingSummary{{Name: "temperature", Count: 1, Min: 20, Max: 20, Mean: 20, Last: 20}},
+			},
+		},
+		unmarshalSummaries(t, publisher))
+}
+
+func TestAggregateMeanOfLargeValuesDoesNotOverflow(t *testing.T) {
+	start := startOfWindowForTesting()
+	publisher := stub.NewPublisherImpl()
+	sut := newAggregatorSUT(t, stub.NewLoggerStub(), json.Marshal, FilterRules{}, false, publisher, start)
+	defer sut.CleanUp()
+	event := newEventWithReadingValues("device", "temperature", "1e308", "temperature", "1e308")
+	sut.Filter(&event)
+
+	sut.flush(start.Add(aggregateWindowForTesting))
+
+	summaries := unmarshalSummaries(t, publisher)
+	assert.Equal(t, 1, len(summaries))
+	assert.Equal(t, 1e308, summaries[0].Readings[0].Mean)
+}
+
+func TestAggregatePartialWindowPublishedOnCleanUp(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newAggregatorSUT(t, stub.NewLoggerStub(), json.Marshal, FilterRules{}, false, publisher, startOfWindowForTesting())
+	event := newEventWithReadingValues("device", "temperature", "20")
+	sut.Filter(&event)
+
+	sut.CleanUp()
+
+	assert.Equal(t, 1, len(publisher.Published()))
+}
+
+func TestAggregateMarshalFailureLogsError(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	errorMessage := uuid.New().String()
+	publisher := stub.NewPublisherImpl()
+	marshal := func(v interface{}) ([]byte, error) { return nil, errors.New(errorMessage) }
+	start := startOfWindowForTesting()
+	sut := newAggregatorSUT(t, loggingClient, marshal, FilterRules{}, false, publisher, start)
+	defer sut.CleanUp()
+	event := newEventWithReadingValues("device", "temperature", "20")
+	sut.Filter(&event)
+
+	sut.flush(start.Add(aggregateWindowForTesting))
+
+	assert.Equal(t, 0, len(publisher.Published()))
+	assert.True(t, loggingClient.SpecificErrorOccurred(aggregateMarshalFailedLogMessage("device", errorMessage)))
+}
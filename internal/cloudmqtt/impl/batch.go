@@ -0,0 +1,167 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+	"time"
+)
+
+// batch is a receiver wrapping a Publisher implementation that combines messages into a single array message.
+type batch struct {
+	loggingClient logger.LoggingClient
+	marshal       contract.Marshaller
+	publish       contract.Publisher
+	maxCount      int
+	maxBytes      int
+	maxLatency    time.Duration
+	messages      chan contract.Message
+	wg            sync.WaitGroup
+}
+
+// NewBatcher is a constructor that returns an instance of batch configured to publish a batch once it contains
+// maxCount messages, once it contains maxBytes of content, or once maxLatency has elapsed since its first message was
+// added (whichever occurs first).
+func NewBatcher(
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	maxCount int,
+	maxBytes int,
+	maxLatency time.Duration,
+	publish contract.Publisher) *batch {
+
+	b := &batch{
+		loggingClient: loggingClient,
+		marshal:       marshal,
+		publish:       publish,
+		maxCount:      maxCount,
+		maxBytes:      maxBytes,
+		maxLatency:    maxLatency,
+		messages:      make(chan contract.Message, maxCount),
+	}
+	b.wg.Add(1)
+	go b.batcher()
+	return b
+}
+
+// batchMarshalFailedLogMessage function formats and returns the log message for when an attempt to marshal a batch
+// fails.
+func batchMarshalFailedLogMessage(count int, errorMessage string) string {
+	return fmt.Sprintf("marshal failed for batch of %d (%s)", count, errorMessage)
+}
+
+// flush method publishes pending messages as a single array message whose Pushed() and Dropped() call each contained
+// message's Pushed() and Dropped(); if the array cannot be marshalled, each pending message is published individually.
+func (b *batch) flush(pending []contract.Message) {
+	if len(pending) == 0 {
+		return
+	}
+
+	contents := make([]json.RawMessage, len(pending))
+	for index, message := range pending {
+		contents[index] = message.Data
+	}
+
+	data, err := b.marshal(contents)
+	if err != nil {
+		b.loggingClient.Error(batchMarshalFailedLogMessage(len(pending), err.Error()), LogFieldError, err.Error())
+		for _, message := range pending {
+			b.publish(message)
+		}
+		return
+	}
+
+	b.publish(
+		contract.Message{
+			Data: data,
+			Pushed: func() {
+				for _, message := range pending {
+					message.Pushed()
+				}
+			},
+			Dropped: func() {
+				for _, message := range pending {
+					discard(message)
+				}
+			},
+		})
+}
+
+// stopTimer function stops timer and drains its channel if it has already fired.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// batcher method is executed as goroutine by constructor and is responsible for accumulating messages and publishing
+// them when one of the configured limits is reached.
+func (b *batch) batcher() {
+	defer b.wg.Done()
+
+	timer := time.NewTimer(b.maxLatency)
+	stopTimer(timer)
+
+	var pending []contract.Message
+	size := 0
+	flush := func() {
+		stopTimer(timer)
+		b.flush(pending)
+		pending = nil
+		size = 0
+	}
+
+	for {
+		select {
+		case message, ok := <-b.messages:
+			if !ok {
+				flush()
+				return
+			}
+
+			if len(pending) > 0 && size+len(message.Data) > b.maxBytes {
+				flush()
+			}
+			if len(pending) == 0 {
+				timer.Reset(b.maxLatency)
+			}
+			pending = append(pending, message)
+			size += len(message.Data)
+			if len(pending) >= b.maxCount || size >= b.maxBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// Publish method implements Publisher contract; it adds the message to the current batch.
+func (b *batch) Publish(message contract.Message) {
+	b.messages <- message
+}
+
+// CleanUp method publishes any pending batch and ensures the batcher() goroutine has completed.
+func (b *batch) CleanUp() {
+	close(b.messages)
+	b.wg.Wait()
+}
@@ -0,0 +1,176 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/helper"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const (
+	batchMaxCountForTesting   = 3
+	batchMaxBytesForTesting   = 64
+	batchMaxLatencyForTesting = 50 * time.Millisecond
+)
+
+//
+//  test stubs
+//
+
+type pushedImpl struct {
+	PushedCalledCount  int
+	DroppedCalledCount int
+}
+
+func (p *pushedImpl) Pushed() {
+	p.PushedCalledCount++
+}
+
+func (p *pushedImpl) Dropped() {
+	p.DroppedCalledCount++
+}
+
+//
+//  SUT factory
+//
+
+func newBatcherSUT(loggingClient logger.LoggingClient, marshal contract.Marshaller, publisher *stub.Publisher) *batch {
+	return NewBatcher(
+		loggingClient,
+		marshal,
+		batchMaxCountForTesting,
+		batchMaxBytesForTesting,
+		batchMaxLatencyForTesting,
+		publisher.Publish)
+}
+
+//
+//  utility and helper functions
+//
+
+func newMessage(data string, pushed *pushedImpl) contract.Message {
+	return contract.Message{Data: []byte(data), Pushed: pushed.Pushed, Dropped: pushed.Dropped}
+}
+
+func unmarshalBatch(t *testing.T, message contract.Message) (result []string) {
+	assert.Nil(t, json.Unmarshal(message.Data, &result))
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestBatchPublishedWhenMaxCountReached(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newMessage(`"1"`, pushed))
+	sut.Publish(newMessage(`"2"`, pushed))
+	sut.Publish(newMessage(`"3"`, pushed))
+	sut.Publish(newMessage(`"4"`, pushed))
+	sut.CleanUp()
+
+	published := publisher.Published()
+	assert.Len(t, published, 2)
+	assert.Equal(t, []string{"1", "2", "3"}, unmarshalBatch(t, published[0]))
+	assert.Equal(t, []string{"4"}, unmarshalBatch(t, published[1]))
+}
+
+func TestBatchPublishedBeforeMaxBytesExceeded(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+	pushed := &pushedImpl{}
+	large := `"` + string(contentOfSize(batchMaxBytesForTesting-2)) + `"`
+
+	sut.Publish(newMessage(`"1"`, pushed))
+	sut.Publish(newMessage(large, pushed))
+	sut.CleanUp()
+
+	published := publisher.Published()
+	assert.Len(t, published, 2)
+	assert.Equal(t, []string{"1"}, unmarshalBatch(t, published[0]))
+}
+
+func TestBatchPublishedWhenMaxLatencyElapsed(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+
+	sut.Publish(newMessage(`"1"`, &pushedImpl{}))
+	time.Sleep(4 * batchMaxLatencyForTesting)
+
+	assert.Len(t, publisher.Published(), 1)
+	sut.CleanUp()
+}
+
+func TestBatchPendingMessagesPublishedOnCleanUp(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+
+	sut.Publish(newMessage(`"1"`, &pushedImpl{}))
+	sut.CleanUp()
+
+	assert.Len(t, publisher.Published(), 1)
+}
+
+func TestBatchPushedNotCalledUntilBatchPushed(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newMessage(`"1"`, pushed))
+	sut.Publish(newMessage(`"2"`, pushed))
+	sut.CleanUp()
+
+	assert.Equal(t, 0, pushed.PushedCalledCount)
+	publisher.PushAll()
+	assert.Equal(t, 2, pushed.PushedCalledCount)
+}
+
+func TestBatchDroppedCallsDroppedOfEachMessage(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(stub.NewLoggerStub(), json.Marshal, publisher)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newMessage(`"1"`, pushed))
+	sut.Publish(newMessage(`"2"`, pushed))
+	sut.CleanUp()
+	publisher.Published()[0].Dropped()
+
+	assert.Equal(t, 0, pushed.PushedCalledCount)
+	assert.Equal(t, 2, pushed.DroppedCalledCount)
+}
+
+func TestBatchMarshalFailurePublishesMessagesIndividuallyAndLogsError(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	publisher := stub.NewPublisherImpl()
+	sut := newBatcherSUT(loggingClient, helper.FactoryJsonMarshalFuncReturnsFailureOnFirstCall(), publisher)
+
+	sut.Publish(newMessage(`"1"`, &pushedImpl{}))
+	sut.Publish(newMessage(`"2"`, &pushedImpl{}))
+	sut.CleanUp()
+
+	published := publisher.Published()
+	assert.Len(t, published, 2)
+	assert.Equal(t, []byte(`"1"`), published[0].Data)
+	assert.True(t, loggingClient.SpecificErrorOccurred(batchMarshalFailedLogMessage(2, helper.JsonMarshalFuncFailureMessage)))
+}
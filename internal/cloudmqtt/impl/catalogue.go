@@ -0,0 +1,208 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CatalogueCommand describes a command that can be issued to a device via core-command: Get lists the values a get
+// may return and Put lists the parameters a put accepts; each is nil if the command does not support it.
+type CatalogueCommand struct {
+	Device  string   `json:"device"`
+	Command string   `json:"command"`
+	Get     []string `json:"get"`
+	Put     []string `json:"put"`
+}
+
+// commandCatalogueClient is a receiver wrapping the EdgeX core-command device endpoint.
+type commandCatalogueClient struct {
+	url *endpointUrl
+}
+
+// NewCommandCatalogueClient is a constructor that returns an instance of commandCatalogueClient configured to query
+// the core-command endpoint described by params; as for the EdgeX clients, endpoint resolves the endpoint if
+// params.UseRegistry is true.
+func NewCommandCatalogueClient(params types.EndpointParams, endpoint clients.Endpointer) *commandCatalogueClient {
+	return &commandCatalogueClient{url: newEndpointUrl(params, endpoint)}
+}
+
+// Devices method implements CommandCatalogueClient contract.
+func (c *commandCatalogueClient) Devices(ctx context.Context) ([]models.CommandResponse, error) {
+	url := c.url.get()
+	data, err := clients.GetRequest(url, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []models.CommandResponse
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// catalogue is a receiver wrapping a query-and-forward implementation for the devices' available commands; the
+// catalogue is sent at startup and again whenever it changes.
+type catalogue struct {
+	loggingClient logger.LoggingClient
+	client        contract.CommandCatalogueClient
+	marshal       contract.Marshaller
+	send          contract.Sender
+	interval      time.Duration
+	timeout       time.Duration
+	sent          []byte
+	refresh       chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewCataloguePublisher is a constructor that returns an instance of catalogue configured to query client every
+// interval (each query abandoned after timeout) and send the catalogue if it differs from the catalogue last sent.
+func NewCataloguePublisher(
+	loggingClient logger.LoggingClient,
+	client contract.CommandCatalogueClient,
+	marshal contract.Marshaller,
+	send contract.Sender,
+	interval time.Duration,
+	timeout time.Duration) *catalogue {
+
+	c := &catalogue{
+		loggingClient: loggingClient,
+		client:        client,
+		marshal:       marshal,
+		send:          send,
+		interval:      interval,
+		timeout:       timeout,
+		refresh:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.poller()
+	return c
+}
+
+// catalogueCallFailedLogMessage function formats and returns the log message for when a core-command call fails.
+func catalogueCallFailedLogMessage(errorMessage string) string {
+	return fmt.Sprintf("command catalogue call failed (%s)", errorMessage)
+}
+
+// catalogueSentLogMessage function formats and returns the log message for when the catalogue is sent.
+func catalogueSentLogMessage(count int) string {
+	return fmt.Sprintf("command catalogue sent (%d commands)", count)
+}
+
+// commands function returns the catalogue entries for devices, ordered by device and command name.
+func commands(devices []models.CommandResponse) []CatalogueCommand {
+	result := []CatalogueCommand{}
+	for _, device := range devices {
+		for _, command := range device.Commands {
+			entry := CatalogueCommand{Device: device.Name, Command: command.Name}
+			if len(command.Get.Path) > 0 {
+				entry.Get = []string{}
+				for _, response := range command.Get.Responses {
+					entry.Get = append(entry.Get, response.ExpectedValues...)
+				}
+			}
+			if len(command.Put.Path) > 0 {
+				entry.Put = append([]string{}, command.Put.ParameterNames...)
+			}
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Device != result[j].Device {
+			return result[i].Device < result[j].Device
+		}
+		return result[i].Command < result[j].Command
+	})
+	return result
+}
+
+// publish method queries core-command and sends the catalogue if it has changed; a catalogue that cannot be sent is
+// sent by a later call.
+func (c *catalogue) publish() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var devices []models.CommandResponse
+	err := abandonable(ctx, func() (err error) {
+		devices, err = c.client.Devices(ctx)
+		return
+	})
+	if err != nil {
+		c.loggingClient.Error(catalogueCallFailedLogMessage(err.Error()), LogFieldError, err.Error())
+		return
+	}
+
+	entries := commands(devices)
+	data, err := json.Marshal(entries)
+	if err != nil || bytes.Equal(data, c.sent) {
+		return
+	}
+
+	content, err := c.marshal(entries)
+	if err != nil {
+		c.loggingClient.Error(marshalFailedLogMessage("command catalogue", err.Error()), LogFieldError, err.Error())
+		return
+	}
+	if c.send(context.Background(), content) {
+		c.sent = data
+		c.loggingClient.Debug(catalogueSentLogMessage(len(entries)))
+	}
+}
+
+// poller method is executed as goroutine by constructor and is responsible for publishing the catalogue at startup,
+// every interval, and when refreshed.
+func (c *catalogue) poller() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.publish()
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.refresh:
+		}
+	}
+}
+
+// Refresh method requests that the catalogue be queried without waiting for the next interval; must not block.
+func (c *catalogue) Refresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// CleanUp method ensures the poller() goroutine has completed.
+func (c *catalogue) CleanUp() {
+	close(c.done)
+	c.wg.Wait()
+}
@@ -0,0 +1,170 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+// commandCatalogueClientImpl returns the devices set most recently, or err if not nil.
+type commandCatalogueClientImpl struct {
+	mutex   sync.Mutex
+	devices []models.CommandResponse
+	err     error
+}
+
+func (c *commandCatalogueClientImpl) Devices(ctx context.Context) ([]models.CommandResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.devices, c.err
+}
+
+func (c *commandCatalogueClientImpl) Set(devices []models.CommandResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.devices = devices
+}
+
+// catalogueSenderImpl records sent content; thread-safe.
+type catalogueSenderImpl struct {
+	mutex sync.Mutex
+	sent  [][]byte
+}
+
+func (s *catalogueSenderImpl) Send(ctx context.Context, data []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sent = append(s.sent, data)
+	return true
+}
+
+func (s *catalogueSenderImpl) Sent() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]byte(nil), s.sent...)
+}
+
+//
+//  SUT factory
+//
+
+func newCatalogueSUT(client *commandCatalogueClientImpl, sender *catalogueSenderImpl) *catalogue {
+	return NewCataloguePublisher(stub.NewLoggerStub(), client, json.Marshal, sender.Send, time.Hour, time.Second)
+}
+
+//
+//  utility and helper functions
+//
+
+func newCommandResponse(deviceName string, commands ...models.Command) models.CommandResponse {
+	return models.CommandResponse{Name: deviceName, Commands: commands}
+}
+
+func newCatalogueCommand(name string, getPath string, expectedValues []string, putPath string, parameterNames []string) models.Command {
+	command := models.Command{Name: name}
+	command.Get.Path = getPath
+	command.Get.Responses = []models.Response{{ExpectedValues: expectedValues}}
+	command.Put.Path = putPath
+	command.Put.ParameterNames = parameterNames
+	return command
+}
+
+// waitForSent waits until sender has been called count times.
+func waitForSent(sender *catalogueSenderImpl, count int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(sender.Sent()) >= count {
+			return
+		}
+	}
+}
+
+func unmarshalCatalogue(t *testing.T, data []byte) (result []CatalogueCommand) {
+	assert.Nil(t, json.Unmarshal(data, &result))
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestCatalogueSentAtStartupOrderedByDeviceAndCommand(t *testing.T) {
+	client := &commandCatalogueClientImpl{
+		devices: []models.CommandResponse{
+			newCommandResponse("device2", newCatalogueCommand("b", "/b", []string{"value"}, "", nil)),
+			newCommandResponse(
+				"device1",
+				newCatalogueCommand("b", "", nil, "/b", []string{"min", "max"}),
+				newCatalogueCommand("a", "/a", []string{"value"}, "/a", []string{"value"})),
+		},
+	}
+	sender := &catalogueSenderImpl{}
+	sut := newCatalogueSUT(client, sender)
+
+	waitForSent(sender, 1)
+	sut.CleanUp()
+
+	assert.Equal(
+		t,
+		[]CatalogueCommand{
+			{Device: "device1", Command: "a", Get: []string{"value"}, Put: []string{"value"}},
+			{Device: "device1", Command: "b", Put: []string{"min", "max"}},
+			{Device: "device2", Command: "b", Get: []string{"value"}},
+		},
+		unmarshalCatalogue(t, sender.Sent()[0]))
+}
+
+func TestCatalogueSentAgainOnlyWhenChanged(t *testing.T) {
+	device1 := newCommandResponse("device1", newCatalogueCommand("a", "/a", nil, "", nil))
+	device2 := newCommandResponse("device2", newCatalogueCommand("a", "/a", nil, "", nil))
+	client := &commandCatalogueClientImpl{devices: []models.CommandResponse{device1}}
+	sender := &catalogueSenderImpl{}
+	sut := newCatalogueSUT(client, sender)
+
+	waitForSent(sender, 1)
+	sut.Refresh()
+	client.Set([]models.CommandResponse{device1, device2})
+	sut.Refresh()
+	waitForSent(sender, 2)
+	sut.Refresh()
+	sut.CleanUp()
+
+	sent := sender.Sent()
+	assert.Equal(t, 2, len(sent))
+	assert.Equal(t, 2, len(unmarshalCatalogue(t, sent[1])))
+}
+
+func TestCatalogueCallFailureLogsErrorAndSendsNothing(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	client := &commandCatalogueClientImpl{err: errors.New("errorMessage")}
+	sender := &catalogueSenderImpl{}
+	sut := NewCataloguePublisher(loggingClient, client, json.Marshal, sender.Send, time.Hour, time.Second)
+
+	sut.CleanUp()
+
+	assert.Empty(t, sender.Sent())
+	assert.True(t, loggingClient.SpecificErrorOccurred(catalogueCallFailedLogMessage("errorMessage")))
+}
@@ -15,20 +15,141 @@
 package impl
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
-// receiver is a receiver providing a sample receiver that logs inbound commands.
+const (
+	MetricCommandsReceived       = "cloudmqtt_commands_received_total"
+	MetricCommandsFailed         = "cloudmqtt_commands_failed_total"
+	MetricCommandResponsesFailed = "cloudmqtt_command_responses_failed_total"
+)
+
+const (
+	CommandMethodGet = "get"
+	CommandMethodPut = "put"
+)
+
+const (
+	commandRejectedQueueFull      = "command rejected (queue full)"
+	commandRejectedShuttingDown   = "command rejected (shutting down)"
+	commandMissingDeviceOrCommand = "device and command are required"
+)
+
+// commandClient is a receiver wrapping the EdgeX core-command device endpoint for issuing commands by name.
+type commandClient struct {
+	url *endpointUrl
+}
+
+// NewCommandClient is a constructor that returns an instance of commandClient configured to issue commands via the
+// core-command endpoint described by params; as for the EdgeX clients, endpoint resolves the endpoint if
+// params.UseRegistry is true.
+func NewCommandClient(params types.EndpointParams, endpoint clients.Endpointer) *commandClient {
+	return &commandClient{url: newEndpointUrl(params, endpoint)}
+}
+
+// commandUrl method returns the URL of the named device's named command.
+func (c *commandClient) commandUrl(deviceName string, commandName string) string {
+	return c.url.get() + "/name/" + url.PathEscape(deviceName) + "/command/" + url.PathEscape(commandName)
+}
+
+// Get method implements CommandClient contract.
+func (c *commandClient) Get(ctx context.Context, deviceName string, commandName string) (string, error) {
+	data, err := clients.GetRequest(c.commandUrl(deviceName, commandName), ctx)
+	return string(data), err
+}
+
+// Put method implements CommandClient contract.
+func (c *commandClient) Put(ctx context.Context, deviceName string, commandName string, body string) (string, error) {
+	return clients.PutRequest(c.commandUrl(deviceName, commandName), []byte(body), ctx)
+}
+
+// commandRequest is the structure received on the command topic.  ResponseTopic and CorrelationData identify where
+// and how the result is sent when the message does not carry the MQTT 5 properties of the same name (e.g. MQTT 3.1.1).
+type commandRequest struct {
+	Device          string `json:"device"`
+	Command         string `json:"command"`
+	Method          string `json:"method"`
+	Body            string `json:"body"`
+	ResponseTopic   string `json:"responseTopic"`
+	CorrelationData string `json:"correlationData"`
+}
+
+// commandResponse is the structure sent to a command's response topic; Result is core-command's response (embedded
+// as is if it is JSON) and Error describes why the command failed.
+type commandResponse struct {
+	CorrelationData string          `json:"correlationData,omitempty"`
+	Device          string          `json:"device"`
+	Command         string          `json:"command"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// queuedCommand is a command awaiting a worker along with the trace context of its receipt.
+type queuedCommand struct {
+	command     contract.Command
+	traceparent string
+}
+
+// commandHandler is a receiver that issues southbound commands via core-command and sends each command's result to
+// its response topic.
 type commandHandler struct {
 	loggingClient logger.LoggingClient
+	metrics       contract.Metrics
+	tracer        contract.Tracer
+	client        contract.CommandClient
+	marshal       contract.Marshaller
+	timeout       time.Duration
+	mutex         sync.Mutex
+	closed        bool
+	work          chan queuedCommand
+	wg            sync.WaitGroup
 }
 
-// NewCommandHandler is a constructor that returns an instance of receiver.
-func NewCommandHandler(loggingClient logger.LoggingClient) *commandHandler {
-	return &commandHandler{
+// NewCommandHandler is a constructor that returns an instance of commandHandler configured to issue commands via
+// client using workers goroutines, each command abandoned after timeout; up to queueSize commands may await a worker.
+// Results are marshalled by marshal.  If client is nil commands are logged but not issued.
+func NewCommandHandler(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
+	client contract.CommandClient,
+	marshal contract.Marshaller,
+	workers int,
+	timeout time.Duration,
+	queueSize int) *commandHandler {
+
+	c := &commandHandler{
 		loggingClient: loggingClient,
+		metrics:       metrics,
+		tracer:        tracer,
+		client:        client,
+		marshal:       marshal,
+		timeout:       timeout,
+	}
+	if client == nil {
+		return c
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	c.work = make(chan queuedCommand, queueSize)
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.worker()
 	}
+	return c
 }
 
 // receivedCommandLogMessage function formats and returns the log message when a command is received.
@@ -36,10 +157,175 @@ func receivedCommandLogMessage(command string) string {
 	return fmt.Sprintf("command received: %s", command)
 }
 
-// Receiver method implements Receiver contract; it logs the incoming command but could be extended to interpret
-// the string content and call an endpoint on the EdgeX core-command service.
-func (c *commandHandler) Receiver(command string) {
-	c.loggingClient.Debug(receivedCommandLogMessage(command))
+// commandFailedLogMessage function formats and returns the log message for when a command fails.
+func commandFailedLogMessage(deviceName string, commandName string, errorMessage string) string {
+	return fmt.Sprintf("command %s failed for %s (%s)", commandName, deviceName, errorMessage)
+}
+
+// commandResponseFailedLogMessage function formats and returns the log message for when a command's result cannot be
+// sent to its response topic.
+func commandResponseFailedLogMessage(topicName string) string {
+	return fmt.Sprintf("command response to %s failed", topicName)
+}
+
+// parseCommand function decodes a command; the MQTT 5 response topic and correlation data take precedence over the
+// fields of the same name.
+func parseCommand(command contract.Command) (commandRequest, error) {
+	var request commandRequest
+	err := json.Unmarshal(command.Payload, &request)
+	if len(command.ResponseTopic) > 0 {
+		request.ResponseTopic = command.ResponseTopic
+	}
+	if len(command.CorrelationData) > 0 {
+		request.CorrelationData = string(command.CorrelationData)
+	}
+	switch {
+	case err != nil:
+		return request, fmt.Errorf("invalid command: %v", err)
+	case len(request.Device) == 0 || len(request.Command) == 0:
+		return request, errors.New(commandMissingDeviceOrCommand)
+	}
+	return request, nil
+}
+
+// issue method issues a command via core-command and returns core-command's response.
+func (c *commandHandler) issue(ctx context.Context, request commandRequest) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	switch strings.ToLower(request.Method) {
+	case "", CommandMethodGet:
+		return c.client.Get(ctx, request.Device, request.Command)
+	case CommandMethodPut:
+		return c.client.Put(ctx, request.Device, request.Command, request.Body)
+	}
+	return "", fmt.Errorf("unsupported method: %s", request.Method)
+}
+
+// respond method sends the result of a command to its response topic (if any).
+func (c *commandHandler) respond(
+	ctx context.Context,
+	command contract.Command,
+	request commandRequest,
+	result string,
+	err error) {
+
+	if len(request.ResponseTopic) == 0 || command.Reply == nil {
+		return
+	}
+
+	response := commandResponse{
+		CorrelationData: request.CorrelationData,
+		Device:          request.Device,
+		Command:         request.Command,
+	}
+	if err != nil {
+		response.Error = err.Error()
+	} else if len(result) > 0 {
+		response.Result = json.RawMessage(result)
+		if !json.Valid(response.Result) {
+			response.Result, _ = json.Marshal(result)
+		}
+	}
+
+	bytes, err := c.marshal(response)
+	if err == nil && command.Reply(request.ResponseTopic)(ctx, bytes) {
+		return
+	}
+	args := []interface{}{LogFieldCorrelationId, request.CorrelationData, LogFieldTopic, request.ResponseTopic}
+	if err != nil {
+		args = append(args, LogFieldError, err.Error())
+	}
+	c.loggingClient.Warn(commandResponseFailedLogMessage(request.ResponseTopic), args...)
+	c.metrics.Increment(MetricCommandResponsesFailed, 1)
+}
+
+// execute method issues a command and sends its result to its response topic; ctx carries the command's correlation
+// data as its correlation ID so core-command receives it as the correlation-id header.  Execution is traced as a span.
+func (c *commandHandler) execute(queued queuedCommand) {
+	request, err := parseCommand(queued.command)
+	ctx, end := c.tracer.Start(
+		WithTraceparent(WithCorrelationId(context.Background(), request.CorrelationData), queued.traceparent),
+		"command.Execute",
+		LogFieldDevice, request.Device,
+		"command", request.Command)
+
+	var result string
+	if err == nil {
+		result, err = c.issue(ctx, request)
+	}
+	end(err)
+	c.completed(ctx, queued.command, request, result, err)
+}
+
+// completed method records the result of a command and sends it to the command's response topic.
+func (c *commandHandler) completed(
+	ctx context.Context,
+	command contract.Command,
+	request commandRequest,
+	result string,
+	err error) {
+
+	if err != nil {
+		c.loggingClient.Warn(
+			commandFailedLogMessage(request.Device, request.Command, err.Error()),
+			LogFieldCorrelationId, request.CorrelationData,
+			LogFieldDevice, request.Device,
+			LogFieldError, err.Error())
+		c.metrics.Increment(MetricCommandsFailed, 1)
+	}
+	c.respond(ctx, command, request, result, err)
+}
+
+// worker method is executed as goroutine by constructor and is responsible for executing queued commands.
+func (c *commandHandler) worker() {
+	defer c.wg.Done()
+
+	for queued := range c.work {
+		c.execute(queued)
+	}
+}
+
+// Receiver method implements Receiver contract; it logs the incoming command and queues it to be issued via
+// core-command.  A command that cannot be queued is rejected and the rejection sent to its response topic.  Receipt is
+// traced as a span, a child of the span carried by the command's traceparent (if any).
+func (c *commandHandler) Receiver(command contract.Command) {
+	ctx, end := c.tracer.Start(WithTraceparent(context.Background(), command.Traceparent), "command.Receive")
+	defer end(nil)
+
+	c.loggingClient.Debug(receivedCommandLogMessage(string(command.Payload)))
+	c.metrics.Increment(MetricCommandsReceived, 1)
+	if c.client == nil {
+		return
+	}
+
+	rejection := commandRejectedShuttingDown
+	c.mutex.Lock()
+	if !c.closed {
+		select {
+		case c.work <- queuedCommand{command: command, traceparent: Traceparent(ctx)}:
+			c.mutex.Unlock()
+			return
+		default:
+			rejection = commandRejectedQueueFull
+		}
+	}
+	c.mutex.Unlock()
+
+	request, _ := parseCommand(command)
+	c.completed(WithCorrelationId(ctx, request.CorrelationData), command, request, "", errors.New(rejection))
+}
+
+// CleanUp method rejects further commands and ensures the worker() goroutines have executed the commands queued.
+func (c *commandHandler) CleanUp() {
+	if c.client == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.closed = true
+	close(c.work)
+	c.mutex.Unlock()
 
-	// translate incoming command string into call to appropriate core-command endpoint
+	c.wg.Wait()
 }
@@ -15,19 +15,92 @@
 package impl
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	"github.com/google/uuid"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
+//
+//  test stubs
+//
+
+// commandClientImpl is a CommandClient returning result and err, recording the commands issued.
+type commandClientImpl struct {
+	result string
+	err    error
+	mutex  sync.Mutex
+	issued []string
+}
+
+func (c *commandClientImpl) Get(ctx context.Context, deviceName string, commandName string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.issued = append(c.issued, "get "+deviceName+" "+commandName+" "+CorrelationId(ctx))
+	return c.result, c.err
+}
+
+func (c *commandClientImpl) Put(
+	ctx context.Context,
+	deviceName string,
+	commandName string,
+	body string) (string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.issued = append(c.issued, "put "+deviceName+" "+commandName+" "+body)
+	return c.result, c.err
+}
+
+func (c *commandClientImpl) Issued() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.issued...)
+}
+
+// reply is a response sent by replyRecorderImpl.
+type reply struct {
+	topic         string
+	correlationId string
+	response      commandResponse
+}
+
+// replyRecorderImpl records the responses sent to response topics.
+type replyRecorderImpl struct {
+	mutex   sync.Mutex
+	replies []reply
+}
+
+func (r *replyRecorderImpl) Reply(topicName string) contract.Sender {
+	return func(ctx context.Context, data []byte) bool {
+		var response commandResponse
+		_ = json.Unmarshal(data, &response)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.replies = append(r.replies, reply{topic: topicName, correlationId: CorrelationId(ctx), response: response})
+		return true
+	}
+}
+
+func (r *replyRecorderImpl) Replies() []reply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]reply(nil), r.replies...)
+}
+
 //
 //  SUT factory
 //
 
-func newCommandHandlerSUT(loggingClient logger.LoggingClient) *commandHandler {
-	return NewCommandHandler(loggingClient)
+func newCommandHandlerSUT(loggingClient logger.LoggingClient, client contract.CommandClient) *commandHandler {
+	return NewCommandHandler(loggingClient, NewMetrics(), NewNopTracer(), client, json.Marshal, 1, time.Second, 4)
 }
 
 //
@@ -37,9 +110,147 @@ func newCommandHandlerSUT(loggingClient logger.LoggingClient) *commandHandler {
 func TestHandlerCallLogsDebug(t *testing.T) {
 	loggingClient := stub.NewLoggerStub()
 	command := uuid.New().String()
-	sut := newCommandHandlerSUT(loggingClient)
+	sut := newCommandHandlerSUT(loggingClient, nil)
 
-	sut.Receiver(command)
+	sut.Receiver(contract.Command{Payload: []byte(command)})
 
 	assert.True(t, loggingClient.SpecificDebugOccurred(receivedCommandLogMessage(command)))
 }
+
+func TestCommandResultIsSentToMqtt5ResponseTopicWithCorrelationData(t *testing.T) {
+	client := &commandClientImpl{result: `{"device":"device"}`}
+	recorder := &replyRecorderImpl{}
+	sut := newCommandHandlerSUT(stub.NewLoggerStub(), client)
+
+	sut.Receiver(
+		contract.Command{
+			Payload:         []byte(`{"device":"device","command":"command","responseTopic":"ignored"}`),
+			ResponseTopic:   "responses",
+			CorrelationData: []byte("correlation"),
+			Reply:           recorder.Reply,
+		})
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"get device command correlation"}, client.Issued())
+	replies := recorder.Replies()
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, "responses", replies[0].topic)
+	assert.Equal(t, "correlation", replies[0].correlationId)
+	assert.Equal(t, "correlation", replies[0].response.CorrelationData)
+	assert.Equal(t, `{"device":"device"}`, string(replies[0].response.Result))
+	assert.Equal(t, "", replies[0].response.Error)
+}
+
+func TestCommandResponseTopicFallsBackToCommandFields(t *testing.T) {
+	client := &commandClientImpl{result: "accepted"}
+	recorder := &replyRecorderImpl{}
+	sut := newCommandHandlerSUT(stub.NewLoggerStub(), client)
+	payload := `{"device":"device","command":"command","method":"PUT","body":"{\"Min\":\"1\"}",` +
+		`"responseTopic":"responses","correlationData":"correlation"}`
+
+	sut.Receiver(contract.Command{Payload: []byte(payload), Reply: recorder.Reply})
+	sut.CleanUp()
+
+	assert.Equal(t, []string{`put device command {"Min":"1"}`}, client.Issued())
+	replies := recorder.Replies()
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, "responses", replies[0].topic)
+	assert.Equal(t, "correlation", replies[0].response.CorrelationData)
+	assert.Equal(t, `"accepted"`, string(replies[0].response.Result))
+}
+
+func TestCommandFailureIsSentToResponseTopic(t *testing.T) {
+	client := &commandClientImpl{err: errors.New("device unreachable")}
+	recorder := &replyRecorderImpl{}
+	loggingClient := stub.NewLoggerStub()
+	metrics := NewMetrics()
+	sut := NewCommandHandler(loggingClient, metrics, NewNopTracer(), client, json.Marshal, 1, time.Second, 4)
+
+	sut.Receiver(
+		contract.Command{
+			Payload:       []byte(`{"device":"device","command":"command"}`),
+			ResponseTopic: "responses",
+			Reply:         recorder.Reply,
+		})
+	sut.CleanUp()
+
+	replies := recorder.Replies()
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, "device unreachable", replies[0].response.Error)
+	message := commandFailedLogMessage("device", "command", "device unreachable")
+	assert.True(t, loggingClient.SpecificWarningOccurred(message))
+	assert.Equal(t, int64(1), metrics.Counter(MetricCommandsFailed))
+}
+
+func TestInvalidCommandIsNotIssued(t *testing.T) {
+	for name, payload := range map[string]string{
+		"notJson":         "command",
+		"missingCommand":  `{"device":"device"}`,
+		"unsupportedVerb": `{"device":"device","command":"command","method":"delete"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &commandClientImpl{}
+			recorder := &replyRecorderImpl{}
+			sut := newCommandHandlerSUT(stub.NewLoggerStub(), client)
+
+			sut.Receiver(contract.Command{Payload: []byte(payload), ResponseTopic: "responses", Reply: recorder.Reply})
+			sut.CleanUp()
+
+			assert.Equal(t, 0, len(client.Issued()))
+			replies := recorder.Replies()
+			assert.Equal(t, 1, len(replies))
+			assert.NotEqual(t, "", replies[0].response.Error)
+		})
+	}
+}
+
+func TestCommandWithoutResponseTopicIsIssuedWithoutResponse(t *testing.T) {
+	client := &commandClientImpl{result: "{}"}
+	recorder := &replyRecorderImpl{}
+	sut := newCommandHandlerSUT(stub.NewLoggerStub(), client)
+
+	sut.Receiver(contract.Command{Payload: []byte(`{"device":"device","command":"command"}`), Reply: recorder.Reply})
+	sut.CleanUp()
+
+	assert.Equal(t, 1, len(client.Issued()))
+	assert.Equal(t, 0, len(recorder.Replies()))
+}
+
+func TestCommandReceivedAfterCleanUpIsRejected(t *testing.T) {
+	client := &commandClientImpl{}
+	recorder := &replyRecorderImpl{}
+	sut := newCommandHandlerSUT(stub.NewLoggerStub(), client)
+	sut.CleanUp()
+
+	sut.Receiver(
+		contract.Command{
+			Payload:       []byte(`{"device":"device","command":"command"}`),
+			ResponseTopic: "responses",
+			Reply:         recorder.Reply,
+		})
+
+	assert.Equal(t, 0, len(client.Issued()))
+	replies := recorder.Replies()
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, commandRejectedShuttingDown, replies[0].response.Error)
+}
+
+func TestCommandReceiveSpanIsChildOfInboundTraceparent(t *testing.T) {
+	exporter := &spanExporterImpl{}
+	tracer := newTracerSUT(NewMetrics(), exporter, 16)
+	sut := NewCommandHandler(stub.NewLoggerStub(), NewMetrics(), tracer, nil, json.Marshal, 1, time.Second, 4)
+
+	sut.Receiver(
+		contract.Command{
+			Payload:     []byte(`{"device":"device","command":"command"}`),
+			Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		})
+	sut.CleanUp()
+	tracer.CleanUp()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "command.Receive", spans[0].Name)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].TraceId)
+	assert.Equal(t, "b7ad6b7169203331", spans[0].ParentSpanId)
+}
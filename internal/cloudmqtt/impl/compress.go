@@ -0,0 +1,154 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+)
+
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+	CompressionZstd    = "zstd"
+)
+
+// encoder defines function contract for compressing content.
+type encoder func(content []byte) ([]byte, error)
+
+// contentEncodingKey is the context key under which the compression scheme of the content being sent is carried.
+type contentEncodingKey struct{}
+
+// WithContentEncoding function returns a copy of ctx carrying the compression scheme of the content being sent.
+func WithContentEncoding(ctx context.Context, scheme string) context.Context {
+	return context.WithValue(ctx, contentEncodingKey{}, scheme)
+}
+
+// ContentEncoding function returns the compression scheme carried by ctx (empty if the content is not compressed).
+func ContentEncoding(ctx context.Context) string {
+	scheme, _ := ctx.Value(contentEncodingKey{}).(string)
+	return scheme
+}
+
+// compress is a receiver wrapping a Sender implementation with payload compression.
+type compress struct {
+	loggingClient  logger.LoggingClient
+	send           contract.Sender
+	sendCompressed contract.Sender
+	scheme         string
+	minimumSize    int
+	encode         encoder
+}
+
+// NewCompressor is a constructor that returns an instance of compress configured to compress content of at least
+// minimumSize bytes using the specified scheme (gzip, deflate, or zstd) and send the compressed bytes as is via
+// sendCompressed; all other content is sent via send.
+func NewCompressor(
+	loggingClient logger.LoggingClient,
+	scheme string,
+	minimumSize int,
+	send contract.Sender,
+	sendCompressed contract.Sender) (*compress, error) {
+
+	encode, err := encoderForScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compress{
+		loggingClient:  loggingClient,
+		send:           send,
+		sendCompressed: sendCompressed,
+		scheme:         scheme,
+		minimumSize:    minimumSize,
+		encode:         encode,
+	}, nil
+}
+
+// encoderForScheme function returns the encoder implementation for the specified compression scheme.
+func encoderForScheme(scheme string) (encoder, error) {
+	switch scheme {
+	case CompressionGzip:
+		return gzipEncode, nil
+	case CompressionDeflate:
+		return deflateEncode, nil
+	case CompressionZstd:
+		zstdEncoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return func(content []byte) ([]byte, error) {
+			return zstdEncoder.EncodeAll(content, nil), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression scheme: %s", scheme)
+}
+
+// gzipEncode function compresses content using gzip.
+func gzipEncode(content []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// deflateEncode function compresses content using raw deflate.
+func deflateEncode(content []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// compressFailedLogMessage function formats and returns the log message for when an attempt to compress fails.
+func compressFailedLogMessage(scheme string, errorMessage string) string {
+	return fmt.Sprintf("%s compression failed (%s)", scheme, errorMessage)
+}
+
+// Send method implements Sender contract; content smaller than the configured threshold is passed through unchanged,
+// otherwise it is compressed and sent with ctx carrying the compression scheme.  Content that fails to compress is sent
+// uncompressed.
+func (c *compress) Send(ctx context.Context, content []byte) bool {
+	if len(content) < c.minimumSize {
+		return c.send(ctx, content)
+	}
+
+	encoded, err := c.encode(content)
+	if err != nil {
+		c.loggingClient.Warn(compressFailedLogMessage(c.scheme, err.Error()), LogFieldError, err.Error())
+		return c.send(ctx, content)
+	}
+
+	return c.sendCompressed(WithContentEncoding(ctx, c.scheme), encoded)
+}
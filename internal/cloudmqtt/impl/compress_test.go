@@ -0,0 +1,147 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const minimumSizeForTesting = 64
+
+//
+//  SUT factory
+//
+
+func newCompressorSUT(
+	t *testing.T,
+	loggingClient logger.LoggingClient,
+	scheme string,
+	sender contract.Sender,
+	compressedSender contract.Sender) *compress {
+
+	sut, err := NewCompressor(loggingClient, scheme, minimumSizeForTesting, sender, compressedSender)
+	assert.Nil(t, err)
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func contentOfSize(size int) []byte {
+	return []byte(strings.Repeat("a", size))
+}
+
+func decode(t *testing.T, scheme string, data []byte) []byte {
+	var result []byte
+	var err error
+	switch scheme {
+	case CompressionGzip:
+		var reader *gzip.Reader
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+		assert.Nil(t, err)
+		result, err = ioutil.ReadAll(reader)
+	case CompressionDeflate:
+		result, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	case CompressionZstd:
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(nil)
+		assert.Nil(t, err)
+		result, err = decoder.DecodeAll(data, nil)
+	}
+	assert.Nil(t, err)
+	return result
+}
+
+//
+//  unit tests
+//
+
+func TestNewCompressorWithUnsupportedSchemeReturnsError(t *testing.T) {
+	sut, err := NewCompressor(
+		stub.NewLoggerStub(),
+		"unsupported",
+		minimumSizeForTesting,
+		stub.NewSenderImpl().Send,
+		stub.NewSenderImpl().Send)
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestSendBelowMinimumSizeIsNotCompressed(t *testing.T) {
+	sender, compressedSender := stub.NewSenderImpl(), stub.NewSenderImpl()
+	sut := newCompressorSUT(t, stub.NewLoggerStub(), CompressionGzip, sender.Send, compressedSender.Send)
+	content := contentOfSize(minimumSizeForTesting - 1)
+
+	sut.Send(context.Background(), content)
+
+	assert.Len(t, sender.Sent, 1)
+	assert.Equal(t, content, sender.Sent[0].Data)
+	assert.Empty(t, compressedSender.Sent)
+}
+
+func TestSendAtMinimumSizeIsCompressedForEachScheme(t *testing.T) {
+	for _, scheme := range []string{CompressionGzip, CompressionDeflate, CompressionZstd} {
+		sender, compressedSender := stub.NewSenderImpl(), stub.NewSenderImpl()
+		sut := newCompressorSUT(t, stub.NewLoggerStub(), scheme, sender.Send, compressedSender.Send)
+		content := contentOfSize(minimumSizeForTesting)
+
+		sut.Send(context.Background(), content)
+
+		assert.Empty(t, sender.Sent)
+		assert.Len(t, compressedSender.Sent, 1)
+		assert.Equal(t, scheme, ContentEncoding(compressedSender.Sent[0].Ctx))
+		assert.Equal(t, content, decode(t, scheme, compressedSender.Sent[0].Data))
+	}
+}
+
+func TestSendReturnsSenderResult(t *testing.T) {
+	compressedSender := stub.NewSenderImplWithResultFunc(func() bool { return false })
+	sut := newCompressorSUT(t, stub.NewLoggerStub(), CompressionGzip, stub.NewSenderImpl().Send, compressedSender.Send)
+
+	assert.False(t, sut.Send(context.Background(), contentOfSize(minimumSizeForTesting)))
+}
+
+func TestSendCompressionFailureSendsUncompressedContentAndLogsWarning(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	sender, compressedSender := stub.NewSenderImpl(), stub.NewSenderImpl()
+	sut := newCompressorSUT(t, loggingClient, CompressionGzip, sender.Send, compressedSender.Send)
+	sut.encode = func(content []byte) ([]byte, error) { return nil, errors.New("failed") }
+	content := contentOfSize(minimumSizeForTesting)
+
+	sut.Send(context.Background(), content)
+
+	assert.Len(t, sender.Sent, 1)
+	assert.Equal(t, content, sender.Sent[0].Data)
+	assert.Empty(t, compressedSender.Sent)
+	assert.True(t, loggingClient.SpecificWarningOccurred(compressFailedLogMessage(CompressionGzip, "failed")))
+}
+
+func TestContentEncodingWithoutSchemeIsEmpty(t *testing.T) {
+	assert.Empty(t, ContentEncoding(context.Background()))
+}
@@ -0,0 +1,238 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const MetricDeadbandSuppressedReadings = "cloudmqtt_deadband_suppressed_readings_total"
+
+// DeadbandRule defines when a reading is sent northbound: when its value changes by more than Absolute, when its value
+// changes by more than Percent of the last sent value, or when Heartbeat has elapsed since the last sent value.  Zero
+// values disable the corresponding test.
+type DeadbandRule struct {
+	Absolute  float64
+	Percent   float64
+	Heartbeat time.Duration
+}
+
+// deadbandState is the last value sent for a device's reading and when it was sent (in milliseconds since the epoch).
+type deadbandState struct {
+	Value string `json:"value"`
+	Sent  int64  `json:"sent"`
+}
+
+// deadband is a receiver wrapping report-by-exception filtering of readings.
+type deadband struct {
+	loggingClient logger.LoggingClient
+	metrics       contract.Metrics
+	rules         map[string]DeadbandRule
+	stateFile     string
+	saveInterval  time.Duration
+	now           func() time.Time
+	mutex         sync.Mutex
+	states        map[string]deadbandState
+	changed       bool
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewDeadband is a constructor that returns an instance of deadband configured with rules keyed by reading name; the
+// last sent values are loaded from stateFile (if specified) and saved to it every saveInterval (if greater than zero)
+// and at CleanUp so they survive a restart.
+func NewDeadband(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	rules map[string]DeadbandRule,
+	stateFile string,
+	saveInterval time.Duration) *deadband {
+
+	d := &deadband{
+		loggingClient: loggingClient,
+		metrics:       metrics,
+		rules:         rules,
+		stateFile:     stateFile,
+		saveInterval:  saveInterval,
+		now:           time.Now,
+		states:        make(map[string]deadbandState),
+		done:          make(chan struct{}),
+	}
+	d.load()
+	if len(stateFile) > 0 && saveInterval > 0 {
+		d.wg.Add(1)
+		go d.saver()
+	}
+	return d
+}
+
+// deadbandStateLogMessage function formats and returns the log message for when the state file cannot be loaded or
+// saved.
+func deadbandStateLogMessage(operation string, stateFile string, errorMessage string) string {
+	return fmt.Sprintf("deadband %s failed for %s (%s)", operation, stateFile, errorMessage)
+}
+
+// load method reads last sent values from the state file.
+func (d *deadband) load() {
+	if len(d.stateFile) == 0 {
+		return
+	}
+
+	bytes, err := ioutil.ReadFile(d.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.loggingClient.Warn(deadbandStateLogMessage("load", d.stateFile, err.Error()), LogFieldError, err.Error())
+		}
+		return
+	}
+
+	if err := json.Unmarshal(bytes, &d.states); err != nil {
+		d.loggingClient.Warn(deadbandStateLogMessage("load", d.stateFile, err.Error()), LogFieldError, err.Error())
+	}
+}
+
+// write method replaces the state file with bytes; the bytes are written to a temporary file that is then renamed so
+// a failure part way through never leaves a truncated state file behind.
+func (d *deadband) write(bytes []byte) error {
+	temporaryFile := d.stateFile + ".tmp"
+	if err := ioutil.WriteFile(temporaryFile, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, d.stateFile)
+}
+
+// save method writes last sent values to the state file if they have changed since they were last saved.
+func (d *deadband) save() {
+	if len(d.stateFile) == 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	if !d.changed {
+		d.mutex.Unlock()
+		return
+	}
+	bytes, err := json.Marshal(d.states)
+	d.changed = false
+	d.mutex.Unlock()
+	if err == nil {
+		err = d.write(bytes)
+	}
+	if err != nil {
+		d.mutex.Lock()
+		d.changed = true
+		d.mutex.Unlock()
+		d.loggingClient.Warn(deadbandStateLogMessage("save", d.stateFile, err.Error()), LogFieldError, err.Error())
+	}
+}
+
+// saver method is executed as goroutine by constructor and is responsible for saving the last sent values every
+// saveInterval.
+func (d *deadband) saver() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.save()
+		}
+	}
+}
+
+// exceeded function returns true if value differs from last by more than rule's absolute or percentage deadband;
+// non-numeric values exceed the deadband whenever they change.
+func exceeded(rule DeadbandRule, last string, value string) bool {
+	lastValue, lastErr := strconv.ParseFloat(last, 64)
+	newValue, newErr := strconv.ParseFloat(value, 64)
+	if lastErr != nil || newErr != nil {
+		return last != value
+	}
+
+	change := math.Abs(newValue - lastValue)
+	if rule.Absolute > 0 && change > rule.Absolute {
+		return true
+	}
+	if rule.Percent > 0 && change > math.Abs(lastValue)*rule.Percent/100 {
+		return true
+	}
+	return rule.Absolute <= 0 && rule.Percent <= 0 && change > 0
+}
+
+// send method returns true if reading, from deviceName's event, should be sent northbound and, if so, records it as
+// the last sent value.  The value is recorded as it passes the filter rather than once it has been delivered, so
+// delivery is at most once: if the event is later dropped or fails to send, the value is not sent again until it
+// changes beyond the deadband or the heartbeat elapses.
+func (d *deadband) send(deviceName string, reading models.Reading, rule DeadbandRule, now time.Time) bool {
+	key := deviceName + "/" + reading.Name
+	nowInMilliseconds := now.UnixNano() / int64(time.Millisecond)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	last, ok := d.states[key]
+	if ok &&
+		!exceeded(rule, last.Value, reading.Value) &&
+		(rule.Heartbeat <= 0 || nowInMilliseconds-last.Sent < int64(rule.Heartbeat/time.Millisecond)) {
+		return false
+	}
+
+	d.states[key] = deadbandState{Value: reading.Value, Sent: nowInMilliseconds}
+	d.changed = true
+	return true
+}
+
+// Filter method implements Filter contract; it removes readings whose value is within the deadband configured for the
+// reading's name and whose heartbeat has not elapsed.  Readings without a configured rule are not affected.
+func (d *deadband) Filter(event *models.Event) bool {
+	if len(event.Readings) == 0 {
+		return true
+	}
+
+	now := d.now()
+	readings := make([]models.Reading, 0, len(event.Readings))
+	for _, reading := range event.Readings {
+		rule, ok := d.rules[reading.Name]
+		if !ok || d.send(event.Device, reading, rule, now) {
+			readings = append(readings, reading)
+		}
+	}
+
+	if suppressed := len(event.Readings) - len(readings); suppressed > 0 {
+		d.metrics.Increment(MetricDeadbandSuppressedReadings, int64(suppressed))
+	}
+	event.Readings = readings
+	return len(readings) > 0
+}
+
+// CleanUp method ensures the saver() goroutine has completed and saves the last sent values to the state file.
+func (d *deadband) CleanUp() {
+	close(d.done)
+	d.wg.Wait()
+	d.save()
+}
@@ -0,0 +1,164 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//
+//  SUT factory
+//
+
+func newDeadbandSUT(rules map[string]DeadbandRule, stateFile string, now *time.Time) *deadband {
+	sut := NewDeadband(stub.NewLoggerStub(), NewMetrics(), rules, stateFile, 0)
+	sut.now = func() time.Time {
+		return *now
+	}
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func newEventWithReadingValue(readingName string, value string) models.Event {
+	event := stub.NewEvent()
+	event.Readings = []models.Reading{{Device: event.Device, Name: readingName, Value: value}}
+	return event
+}
+
+func filterValues(sut *deadband, readingName string, values ...string) (results []bool) {
+	for _, value := range values {
+		event := newEventWithReadingValue(readingName, value)
+		results = append(results, sut.Filter(&event))
+	}
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestDeadbandReadingWithoutRuleIsAlwaysSent(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{}, "", &now)
+
+	assert.Equal(t, []bool{true, true}, filterValues(sut, "temperature", "1", "1"))
+}
+
+func TestDeadbandAbsoluteSuppressesSmallChanges(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{"temperature": {Absolute: 0.5}}, "", &now)
+
+	assert.Equal(t, []bool{true, false, false, true}, filterValues(sut, "temperature", "20", "20.5", "19.6", "20.6"))
+}
+
+func TestDeadbandPercentSuppressesSmallChanges(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{"pressure": {Percent: 10}}, "", &now)
+
+	assert.Equal(t, []bool{true, false, true}, filterValues(sut, "pressure", "100", "109", "111"))
+}
+
+func TestDeadbandNonNumericValueIsSentOnlyWhenChanged(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{"state": {Absolute: 1}}, "", &now)
+
+	assert.Equal(t, []bool{true, false, true}, filterValues(sut, "state", "open", "open", "closed"))
+}
+
+func TestDeadbandHeartbeatSendsUnchangedValue(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{"temperature": {Absolute: 5, Heartbeat: time.Minute}}, "", &now)
+
+	assert.Equal(t, []bool{true, false}, filterValues(sut, "temperature", "20", "20"))
+	now = now.Add(time.Minute)
+	assert.Equal(t, []bool{true, false}, filterValues(sut, "temperature", "20", "20"))
+}
+
+func TestDeadbandSuppressedReadingsAreRemovedAndCounted(t *testing.T) {
+	now := time.Now()
+	metrics := NewMetrics()
+	sut := NewDeadband(stub.NewLoggerStub(), metrics, map[string]DeadbandRule{"temperature": {Absolute: 1}}, "", 0)
+	sut.now = func() time.Time { return now }
+	first := newEventWithReadings("device", "temperature", "humidity")
+	second := newEventWithReadings("device", "temperature", "humidity")
+
+	sut.Filter(&first)
+	assert.True(t, sut.Filter(&second))
+
+	assert.Equal(t, []string{"humidity"}, readingNames(second))
+	assert.Equal(t, int64(1), metrics.Counter(MetricDeadbandSuppressedReadings))
+}
+
+func TestDeadbandStateIsPersistedAcrossInstances(t *testing.T) {
+	directory, err := ioutil.TempDir("", "deadband")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	stateFile := filepath.Join(directory, "deadband.json")
+	now := time.Now()
+	rules := map[string]DeadbandRule{"temperature": {Absolute: 1}}
+
+	first := newDeadbandSUT(rules, stateFile, &now)
+	filterValues(first, "temperature", "20")
+	first.CleanUp()
+	second := newDeadbandSUT(rules, stateFile, &now)
+
+	assert.Equal(t, []bool{false}, filterValues(second, "temperature", "20"))
+}
+
+func TestDeadbandStateIsKeyedByEventDevice(t *testing.T) {
+	now := time.Now()
+	sut := newDeadbandSUT(map[string]DeadbandRule{"temperature": {Absolute: 1}}, "", &now)
+	first := stub.NewEventForDevice("device1")
+	first.Readings = []models.Reading{{Name: "temperature", Value: "20"}}
+	second := stub.NewEventForDevice("device2")
+	second.Readings = []models.Reading{{Name: "temperature", Value: "20"}}
+
+	assert.True(t, sut.Filter(&first))
+	assert.True(t, sut.Filter(&second))
+}
+
+func TestDeadbandStateIsSavedPeriodically(t *testing.T) {
+	directory, err := ioutil.TempDir("", "deadband")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	stateFile := filepath.Join(directory, "deadband.json")
+	rules := map[string]DeadbandRule{"temperature": {Absolute: 1}}
+	sut := NewDeadband(stub.NewLoggerStub(), NewMetrics(), rules, stateFile, time.Millisecond)
+	defer sut.CleanUp()
+
+	filterValues(sut, "temperature", "20")
+
+	for i := 0; i < 1000; i++ {
+		if _, err := os.Stat(stateFile); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	now := time.Now()
+	second := newDeadbandSUT(rules, stateFile, &now)
+	assert.Equal(t, []bool{false}, filterValues(second, "temperature", "20"))
+	_, err = os.Stat(stateFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
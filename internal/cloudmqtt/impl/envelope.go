@@ -0,0 +1,122 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+	"time"
+)
+
+const (
+	EnvelopeSchemaVersion = 1
+
+	MessageTypeEvent           = "event"
+	MessageTypeEventBatch      = "eventBatch"
+	MessageTypeAlarm           = "alarm"
+	MessageTypeDevice          = "device"
+	MessageTypeAggregate       = "aggregate"
+	MessageTypeCatalogue       = "catalogue"
+	MessageTypeStatus          = "status"
+	MessageTypeCommandResponse = "commandResponse"
+)
+
+// envelopeContent is the structure transmitted northbound in place of the bare marshalled type.
+type envelopeContent struct {
+	GatewayId     string      `json:"gatewayId"`
+	BootId        string      `json:"bootId"`
+	Type          string      `json:"type"`
+	Sequence      uint64      `json:"sequence"`
+	Timestamp     int64       `json:"timestamp"`
+	SchemaVersion int         `json:"schemaVersion"`
+	Payload       interface{} `json:"payload"`
+}
+
+// envelope is a receiver wrapping a Marshaller implementation that adds gateway identity and sequencing to each
+// marshalled type; bootId distinguishes a sequence restarted by a service restart from a redelivered message.
+type envelope struct {
+	gatewayId   string
+	bootId      string
+	messageType string
+	marshal     contract.Marshaller
+	mutex       sync.Mutex
+	sequence    uint64
+}
+
+// NewEnvelope is a constructor that returns an instance of envelope configured to identify marshalled content as
+// messageType sent by gatewayId during the run of the service identified by bootId.
+func NewEnvelope(gatewayId string, bootId string, messageType string, marshal contract.Marshaller) *envelope {
+	return &envelope{
+		gatewayId:   gatewayId,
+		bootId:      bootId,
+		messageType: messageType,
+		marshal:     marshal,
+	}
+}
+
+// Marshal method implements Marshaller contract; it marshals v wrapped in an envelope whose sequence number is one
+// greater than that of the last successfully marshalled envelope of the same message type.
+func (e *envelope) Marshal(v interface{}) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	bytes, err := e.marshal(
+		envelopeContent{
+			GatewayId:     e.gatewayId,
+			BootId:        e.bootId,
+			Type:          e.messageType,
+			Sequence:      e.sequence + 1,
+			Timestamp:     time.Now().UnixNano() / int64(time.Millisecond),
+			SchemaVersion: EnvelopeSchemaVersion,
+			Payload:       v,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	e.sequence++
+	return bytes, nil
+}
+
+// envelopeFailedLogMessage function formats and returns the log message for when a message's data cannot be wrapped in
+// an envelope.
+func envelopeFailedLogMessage(correlationId string, errorMessage string) string {
+	return fmt.Sprintf("envelope failed for %s (%s)", correlationId, errorMessage)
+}
+
+// EnvelopedPublisher function returns a Publisher that wraps each message's already marshalled (JSON) data in an
+// envelope via marshal before publishing it via publish; a message whose data cannot be wrapped is published as is.
+func EnvelopedPublisher(
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	publish contract.Publisher) contract.Publisher {
+
+	return func(message contract.Message) {
+		data, err := marshal(json.RawMessage(message.Data))
+		if err != nil {
+			loggingClient.Warn(
+				envelopeFailedLogMessage(message.CorrelationId, err.Error()),
+				LogFieldCorrelationId, message.CorrelationId,
+				LogFieldError, err.Error())
+			publish(message)
+			return
+		}
+		message.Data = data
+		publish(message)
+	}
+}
@@ -0,0 +1,130 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/helper"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const (
+	gatewayIdForTesting = "gateway"
+	bootIdForTesting    = "boot"
+)
+
+//
+//  SUT factory
+//
+
+func newEnvelopeSUT(marshal contract.Marshaller) *envelope {
+	return NewEnvelope(gatewayIdForTesting, bootIdForTesting, MessageTypeEvent, marshal)
+}
+
+//
+//  utility and helper functions
+//
+
+type envelopeContentForAssert struct {
+	GatewayId     string       `json:"gatewayId"`
+	BootId        string       `json:"bootId"`
+	Type          string       `json:"type"`
+	Sequence      uint64       `json:"sequence"`
+	Timestamp     int64        `json:"timestamp"`
+	SchemaVersion int          `json:"schemaVersion"`
+	Payload       models.Event `json:"payload"`
+}
+
+func unmarshalEnvelope(t *testing.T, data []byte) (result envelopeContentForAssert) {
+	assert.Nil(t, json.Unmarshal(data, &result))
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestEnvelopeMarshalWrapsPayloadWithGatewayIdentity(t *testing.T) {
+	sut := newEnvelopeSUT(json.Marshal)
+	event := stub.NewEvent()
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+
+	bytes, err := sut.Marshal(event)
+
+	assert.Nil(t, err)
+	result := unmarshalEnvelope(t, bytes)
+	assert.Equal(t, gatewayIdForTesting, result.GatewayId)
+	assert.Equal(t, bootIdForTesting, result.BootId)
+	assert.Equal(t, MessageTypeEvent, result.Type)
+	assert.Equal(t, EnvelopeSchemaVersion, result.SchemaVersion)
+	assert.True(t, result.Timestamp >= before)
+	assert.Equal(t, event.ID, result.Payload.ID)
+}
+
+func TestEnvelopeMarshalIncrementsSequence(t *testing.T) {
+	sut := newEnvelopeSUT(json.Marshal)
+
+	first, _ := sut.Marshal(stub.NewEvent())
+	second, _ := sut.Marshal(stub.NewEvent())
+
+	assert.Equal(t, uint64(1), unmarshalEnvelope(t, first).Sequence)
+	assert.Equal(t, uint64(2), unmarshalEnvelope(t, second).Sequence)
+}
+
+func TestEnvelopeMarshalFailureReturnsErrorAndDoesNotConsumeSequence(t *testing.T) {
+	sut := newEnvelopeSUT(helper.FactoryJsonMarshalFuncReturnsFailureOnFirstCall())
+
+	_, err := sut.Marshal(stub.NewEvent())
+	bytes, _ := sut.Marshal(stub.NewEvent())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), unmarshalEnvelope(t, bytes).Sequence)
+}
+
+func TestEnvelopedPublisherWrapsMarshalledDataInEnvelope(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	event := stub.NewEvent()
+	data, _ := json.Marshal(event)
+	sut := EnvelopedPublisher(stub.NewLoggerStub(), newEnvelopeSUT(json.Marshal).Marshal, publisher.Publish)
+
+	sut(contract.Message{Data: data})
+
+	assert.Equal(t, 1, len(publisher.Published()))
+	result := unmarshalEnvelope(t, publisher.Published()[0].Data)
+	assert.Equal(t, MessageTypeEvent, result.Type)
+	assert.Equal(t, event.ID, result.Payload.ID)
+}
+
+func TestEnvelopedPublisherPublishesDataAsIsAndLogsWarningWhenEnvelopeFails(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	publisher := stub.NewPublisherImpl()
+	data := []byte("{}")
+	sut := EnvelopedPublisher(
+		loggingClient,
+		newEnvelopeSUT(helper.FactoryJsonMarshalFuncReturnsFailureOnFirstCall()).Marshal,
+		publisher.Publish)
+
+	sut(contract.Message{Data: data, CorrelationId: "correlation"})
+
+	assert.Equal(t, 1, len(publisher.Published()))
+	assert.Equal(t, data, publisher.Published()[0].Data)
+	assert.True(t, loggingClient.SpecificWarningOccurred(
+		envelopeFailedLogMessage("correlation", helper.JsonMarshalFuncFailureMessage)))
+}
@@ -0,0 +1,327 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricMqttFailovers        = "cloudmqtt_mqtt_failovers_total"
+	MetricMqttActiveServerBase = "cloudmqtt_mqtt_active_server"
+)
+
+// MetricMqttActiveServer function returns the name of the gauge that is 1 while server is the active MQTT server.
+func MetricMqttActiveServer(server string) string {
+	return MetricName(MetricMqttActiveServerBase, "server", server)
+}
+
+// FailoverPolicy contains the rules for switching between an ordered list of MQTT servers.  The active server is
+// abandoned for the next once it has been unreachable for FailoverAfter; a server earlier in the list replaces the
+// active server once it has been reachable for FailbackAfter (never if zero).  Both are checked every CheckInterval.
+type FailoverPolicy struct {
+	FailoverAfter time.Duration
+	FailbackAfter time.Duration
+	CheckInterval time.Duration
+}
+
+// serverProbe is a receiver that checks whether an MQTT server accepts connections.
+type serverProbe struct {
+	timeout time.Duration
+}
+
+// NewServerProbe is a constructor that returns an instance of serverProbe that waits up to timeout for a connection.
+func NewServerProbe(timeout time.Duration) *serverProbe {
+	return &serverProbe{timeout: timeout}
+}
+
+// Probe method returns nil if a TCP connection to the MQTT server identified by server can be opened.
+func (p *serverProbe) Probe(server string) error {
+	serverUrl, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	address, _, err := serverAddress(serverUrl)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", address, p.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// failover is a receiver implementing the Client contract over a connection to one of an ordered list of MQTT servers,
+// switching between them according to its policy.
+type failover struct {
+	loggingClient    logger.LoggingClient
+	metrics          contract.Metrics
+	servers          []string
+	connect          func(server string) (contract.Client, error)
+	probe            func(server string) error
+	policy           FailoverPolicy
+	mutex            sync.Mutex
+	active           int
+	client           contract.Client
+	lastSent         time.Time
+	unreachableSince time.Time
+	candidate        int
+	reachableSince   time.Time
+	done             chan struct{}
+	wg               sync.WaitGroup
+}
+
+// NewFailover is a constructor that returns an instance of failover connected to the first of servers that accepts a
+// connection, or an error if none does.  connect opens a connection to a server and probe checks whether a server is
+// reachable without connecting to it.
+func NewFailover(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	servers []string,
+	connect func(server string) (contract.Client, error),
+	probe func(server string) error,
+	policy FailoverPolicy) (*failover, error) {
+
+	f := &failover{
+		loggingClient: loggingClient,
+		metrics:       metrics,
+		servers:       servers,
+		connect:       connect,
+		probe:         probe,
+		policy:        policy,
+		candidate:     -1,
+		done:          make(chan struct{}),
+	}
+	if !f.switchTo(0) {
+		return nil, errors.New("no server accepted a connection: " + strings.Join(servers, ", "))
+	}
+	f.wg.Add(1)
+	go f.monitor()
+	return f, nil
+}
+
+// failoverLogMessage function formats and returns the log message for when the active server is replaced.
+func failoverLogMessage(from string, to string, reason string) string {
+	return fmt.Sprintf("mqtt failover from %s to %s (%s)", from, to, reason)
+}
+
+// failoverFailedLogMessage function formats and returns the log message for when the active server cannot be
+// replaced because no server accepts a connection.
+func failoverFailedLogMessage(from string, reason string) string {
+	return fmt.Sprintf("mqtt failover from %s failed, no server accepts a connection (%s)", from, reason)
+}
+
+// failoverConnectFailedLogMessage function formats and returns the log message for when a connection to a server
+// cannot be established.
+func failoverConnectFailedLogMessage(server string, errorMessage string) string {
+	return fmt.Sprintf("mqtt connect to %s failed (%s)", server, errorMessage)
+}
+
+// switchTo method replaces the active connection with one to the server at index or, if it does not accept a
+// connection, to the first server after it (in list order, wrapping around) that does; it returns false if no server
+// accepts a connection, in which case the server at index remains active without a connection.
+func (f *failover) switchTo(index int) bool {
+	f.mutex.Lock()
+	retired := f.client
+	f.client = nil
+	f.mutex.Unlock()
+
+	if retired != nil {
+		retired.CleanUp()
+		f.mutex.Lock()
+		if sent := retired.LastSent(); sent.After(f.lastSent) {
+			f.lastSent = sent
+		}
+		f.mutex.Unlock()
+	}
+
+	connected := index
+	var client contract.Client
+	for i := 0; i < len(f.servers) && client == nil; i++ {
+		connected = (index + i) % len(f.servers)
+		var err error
+		if client, err = f.connect(f.servers[connected]); err != nil {
+			f.loggingClient.Warn(
+				failoverConnectFailedLogMessage(f.servers[connected], err.Error()),
+				LogFieldError, err.Error())
+		}
+	}
+	if client == nil {
+		connected = index
+	}
+
+	f.mutex.Lock()
+	previous := f.active
+	f.active, f.client = connected, client
+	f.mutex.Unlock()
+
+	f.metrics.Set(MetricMqttActiveServer(f.servers[previous]), 0)
+	f.metrics.Set(MetricMqttActiveServer(f.servers[connected]), 1)
+	f.unreachableSince, f.candidate, f.reachableSince = time.Time{}, -1, time.Time{}
+	return client != nil
+}
+
+// check method applies the failover policy as of now; it is only called by the constructor's goroutine, which owns
+// the fields recording how long servers have been (un)reachable.
+func (f *failover) check(now time.Time) {
+	f.mutex.Lock()
+	active, client := f.active, f.client
+	f.mutex.Unlock()
+
+	switch {
+	case client != nil && client.Connected():
+		f.unreachableSince = time.Time{}
+	case f.unreachableSince.IsZero():
+		f.unreachableSince = now
+	case now.Sub(f.unreachableSince) >= f.policy.FailoverAfter:
+		next := (active + 1) % len(f.servers)
+		reason := fmt.Sprintf("unreachable for %v", now.Sub(f.unreachableSince))
+		if !f.switchTo(next) {
+			f.loggingClient.Error(failoverFailedLogMessage(f.servers[active], reason))
+			return
+		}
+		f.metrics.Increment(MetricMqttFailovers, 1)
+		f.loggingClient.Warn(failoverLogMessage(f.servers[active], f.ActiveServer(), reason))
+		return
+	}
+
+	if f.policy.FailbackAfter <= 0 {
+		return
+	}
+	for preferred := 0; preferred < active; preferred++ {
+		if f.probe(f.servers[preferred]) != nil {
+			continue
+		}
+		if f.candidate != preferred {
+			f.candidate, f.reachableSince = preferred, now
+		}
+		if reachable := now.Sub(f.reachableSince); reachable >= f.policy.FailbackAfter {
+			reason := fmt.Sprintf("failback after reachable for %v", reachable)
+			if !f.switchTo(preferred) {
+				f.loggingClient.Error(failoverFailedLogMessage(f.servers[active], reason))
+				return
+			}
+			f.metrics.Increment(MetricMqttFailovers, 1)
+			f.loggingClient.Info(failoverLogMessage(f.servers[active], f.ActiveServer(), reason))
+		}
+		return
+	}
+	f.candidate, f.reachableSince = -1, time.Time{}
+}
+
+// monitor method is executed as goroutine by constructor and is responsible for applying the failover policy every
+// check interval.
+func (f *failover) monitor() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.policy.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			f.check(now)
+		}
+	}
+}
+
+// current method returns the active connection (nil if there is none).
+func (f *failover) current() contract.Client {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.client
+}
+
+// ActiveServer method returns the server currently in use.
+func (f *failover) ActiveServer() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.servers[f.active]
+}
+
+// EventSender method transmits content to northbound MQTT event topic via the active connection.
+func (f *failover) EventSender(ctx context.Context, content []byte) bool {
+	client := f.current()
+	return client != nil && client.EventSender(ctx, content)
+}
+
+// NewDeviceSender method transmits content to northbound MQTT new device topic via the active connection.
+func (f *failover) NewDeviceSender(ctx context.Context, content []byte) bool {
+	client := f.current()
+	return client != nil && client.NewDeviceSender(ctx, content)
+}
+
+// SenderForTopic method returns a Sender implementation that transmits content to the specified northbound MQTT topic
+// via the connection active at the time of sending.
+func (f *failover) SenderForTopic(topicName string) contract.Sender {
+	return f.SenderForTopicAndQos(topicName, qosAtLeastOnce)
+}
+
+// SenderForTopicAndQos method returns a Sender implementation that transmits content to the specified northbound MQTT
+// topic with the specified quality of service via the connection active at the time of sending.
+func (f *failover) SenderForTopicAndQos(topicName string, qos byte) contract.Sender {
+	return func(ctx context.Context, content []byte) bool {
+		client := f.current()
+		return client != nil && client.SenderForTopicAndQos(topicName, qos)(ctx, content)
+	}
+}
+
+// Connected method implements Connection contract; it returns true if the connection to the active server is open.
+func (f *failover) Connected() bool {
+	client := f.current()
+	return client != nil && client.Connected()
+}
+
+// Subscribed method implements Connection contract; it returns true if the command topic subscription is in place on
+// the active server.
+func (f *failover) Subscribed() bool {
+	client := f.current()
+	return client != nil && client.Subscribed()
+}
+
+// LastSent method implements Connection contract; it returns the time content was last sent successfully to any
+// server (zero if never).
+func (f *failover) LastSent() time.Time {
+	f.mutex.Lock()
+	lastSent, client := f.lastSent, f.client
+	f.mutex.Unlock()
+
+	if client != nil {
+		if sent := client.LastSent(); sent.After(lastSent) {
+			return sent
+		}
+	}
+	return lastSent
+}
+
+// CleanUp method stops applying the failover policy and cleans up the active connection.
+func (f *failover) CleanUp() {
+	close(f.done)
+	f.wg.Wait()
+	if client := f.current(); client != nil {
+		client.CleanUp()
+	}
+}
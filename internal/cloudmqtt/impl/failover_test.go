@@ -0,0 +1,295 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"errors"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+type failoverClientImpl struct {
+	mutex     sync.Mutex
+	server    string
+	connected bool
+	lastSent  time.Time
+	sent      []string
+	cleanedUp bool
+}
+
+func (c *failoverClientImpl) send(topicName string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = append(c.sent, topicName)
+	return c.connected
+}
+
+func (c *failoverClientImpl) setConnected(connected bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connected = connected
+}
+
+func (c *failoverClientImpl) EventSender(ctx context.Context, content []byte) bool {
+	return c.send("events")
+}
+
+func (c *failoverClientImpl) NewDeviceSender(ctx context.Context, content []byte) bool {
+	return c.send("newDevices")
+}
+
+func (c *failoverClientImpl) SenderForTopic(topicName string) contract.Sender {
+	return c.SenderForTopicAndQos(topicName, qosAtLeastOnce)
+}
+
+func (c *failoverClientImpl) SenderForTopicAndQos(topicName string, qos byte) contract.Sender {
+	return func(ctx context.Context, content []byte) bool { return c.send(topicName) }
+}
+
+func (c *failoverClientImpl) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *failoverClientImpl) Subscribed() bool {
+	return c.Connected()
+}
+
+func (c *failoverClientImpl) LastSent() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastSent
+}
+
+func (c *failoverClientImpl) CleanUp() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cleanedUp = true
+}
+
+// failoverNetworkImpl simulates the reachability of each server and records the clients connected to them.
+type failoverNetworkImpl struct {
+	mutex       sync.Mutex
+	unreachable map[string]bool
+	clients     []*failoverClientImpl
+}
+
+func newFailoverNetworkImpl(unreachable ...string) *failoverNetworkImpl {
+	n := &failoverNetworkImpl{unreachable: make(map[string]bool)}
+	for _, server := range unreachable {
+		n.unreachable[server] = true
+	}
+	return n
+}
+
+func (n *failoverNetworkImpl) setReachable(server string, reachable bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.unreachable[server] = !reachable
+}
+
+func (n *failoverNetworkImpl) probe(server string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.unreachable[server] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (n *failoverNetworkImpl) connect(server string) (contract.Client, error) {
+	if err := n.probe(server); err != nil {
+		return nil, err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	client := &failoverClientImpl{server: server, connected: true}
+	n.clients = append(n.clients, client)
+	return client, nil
+}
+
+func (n *failoverNetworkImpl) client(index int) *failoverClientImpl {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.clients[index]
+}
+
+//
+//  SUT factory
+//
+
+var failoverServersForTesting = []string{"tcp://primary:1883", "tcp://secondary:1883"}
+
+func newFailoverSUT(
+	loggingClient logger.LoggingClient,
+	network *failoverNetworkImpl,
+	failbackAfter time.Duration) (*failover, *metrics, error) {
+
+	registry := NewMetrics()
+	sut, err := NewFailover(
+		loggingClient,
+		registry,
+		failoverServersForTesting,
+		network.connect,
+		network.probe,
+		FailoverPolicy{FailoverAfter: 30 * time.Second, FailbackAfter: failbackAfter, CheckInterval: time.Hour})
+	return sut, registry, err
+}
+
+//
+//  unit tests
+//
+
+func TestFailoverConnectsToFirstServerAcceptingConnection(t *testing.T) {
+	network := newFailoverNetworkImpl(failoverServersForTesting[0])
+	loggingClient := stub.NewLoggerStub()
+
+	sut, registry, err := newFailoverSUT(loggingClient, network, 0)
+	defer sut.CleanUp()
+
+	assert.Nil(t, err)
+	assert.Equal(t, failoverServersForTesting[1], sut.ActiveServer())
+	assert.Equal(t, int64(1), registry.Counter(MetricMqttActiveServer(failoverServersForTesting[1])))
+	assert.True(t, sut.Connected())
+	assert.True(t, loggingClient.SpecificWarningOccurred(
+		failoverConnectFailedLogMessage(failoverServersForTesting[0], "connection refused")))
+}
+
+func TestFailoverFailsWhenNoServerAcceptsConnection(t *testing.T) {
+	_, _, err := newFailoverSUT(stub.NewLoggerStub(), newFailoverNetworkImpl(failoverServersForTesting...), 0)
+
+	assert.NotNil(t, err)
+}
+
+func TestFailoverSwitchesServerOnlyOnceActiveServerUnreachableForFailoverAfter(t *testing.T) {
+	network := newFailoverNetworkImpl()
+	loggingClient := stub.NewLoggerStub()
+	sut, registry, _ := newFailoverSUT(loggingClient, network, 0)
+	defer sut.CleanUp()
+	now := time.Now()
+
+	network.setReachable(failoverServersForTesting[0], false)
+	network.client(0).setConnected(false)
+	sut.check(now)
+	sut.check(now.Add(29 * time.Second))
+	assert.Equal(t, failoverServersForTesting[0], sut.ActiveServer())
+	assert.False(t, sut.EventSender(context.Background(), nil))
+
+	sut.check(now.Add(30 * time.Second))
+	assert.Equal(t, failoverServersForTesting[1], sut.ActiveServer())
+	assert.True(t, network.client(0).cleanedUp)
+	assert.True(t, sut.SenderForTopic("alarms")(context.Background(), nil))
+	assert.Equal(t, []string{"alarms"}, network.client(1).sent)
+	assert.Equal(t, int64(1), registry.Counter(MetricMqttFailovers))
+	assert.Equal(t, int64(0), registry.Counter(MetricMqttActiveServer(failoverServersForTesting[0])))
+	assert.Equal(t, int64(1), registry.Counter(MetricMqttActiveServer(failoverServersForTesting[1])))
+	assert.True(t, loggingClient.SpecificWarningOccurred(
+		failoverLogMessage(failoverServersForTesting[0], failoverServersForTesting[1], "unreachable for 30s")))
+}
+
+func TestFailoverIsNotCountedWhenNoServerAcceptsConnection(t *testing.T) {
+	network := newFailoverNetworkImpl()
+	loggingClient := stub.NewLoggerStub()
+	sut, registry, _ := newFailoverSUT(loggingClient, network, 0)
+	defer sut.CleanUp()
+	now := time.Now()
+
+	network.setReachable(failoverServersForTesting[0], false)
+	network.setReachable(failoverServersForTesting[1], false)
+	network.client(0).setConnected(false)
+	sut.check(now)
+	sut.check(now.Add(30 * time.Second))
+
+	assert.False(t, sut.Connected())
+	assert.Equal(t, int64(0), registry.Counter(MetricMqttFailovers))
+	assert.True(t, loggingClient.SpecificErrorOccurred(
+		failoverFailedLogMessage(failoverServersForTesting[0], "unreachable for 30s")))
+}
+
+func TestFailoverDoesNotSwitchWhenActiveServerRecovers(t *testing.T) {
+	network := newFailoverNetworkImpl()
+	sut, _, _ := newFailoverSUT(stub.NewLoggerStub(), network, 0)
+	defer sut.CleanUp()
+	now := time.Now()
+
+	network.client(0).setConnected(false)
+	sut.check(now)
+	network.client(0).setConnected(true)
+	sut.check(now.Add(20 * time.Second))
+	network.client(0).setConnected(false)
+	sut.check(now.Add(40 * time.Second))
+
+	assert.Equal(t, failoverServersForTesting[0], sut.ActiveServer())
+}
+
+func TestFailoverFailsBackOncePreferredServerReachableForFailbackAfter(t *testing.T) {
+	network := newFailoverNetworkImpl(failoverServersForTesting[0])
+	sut, _, _ := newFailoverSUT(stub.NewLoggerStub(), network, time.Minute)
+	defer sut.CleanUp()
+	now := time.Now()
+
+	network.setReachable(failoverServersForTesting[0], true)
+	sut.check(now)
+	network.setReachable(failoverServersForTesting[0], false)
+	sut.check(now.Add(30 * time.Second))
+	network.setReachable(failoverServersForTesting[0], true)
+	sut.check(now.Add(40 * time.Second))
+	sut.check(now.Add(90 * time.Second))
+	assert.Equal(t, failoverServersForTesting[1], sut.ActiveServer())
+
+	sut.check(now.Add(100 * time.Second))
+	assert.Equal(t, failoverServersForTesting[0], sut.ActiveServer())
+	assert.True(t, network.client(0).cleanedUp)
+}
+
+func TestFailoverDoesNotFailBackWhenFailbackAfterIsZero(t *testing.T) {
+	network := newFailoverNetworkImpl(failoverServersForTesting[0])
+	sut, _, _ := newFailoverSUT(stub.NewLoggerStub(), network, 0)
+	defer sut.CleanUp()
+	now := time.Now()
+
+	network.setReachable(failoverServersForTesting[0], true)
+	sut.check(now)
+	sut.check(now.Add(time.Hour))
+
+	assert.Equal(t, failoverServersForTesting[1], sut.ActiveServer())
+}
+
+func TestFailoverLastSentSurvivesSwitch(t *testing.T) {
+	network := newFailoverNetworkImpl()
+	sut, _, _ := newFailoverSUT(stub.NewLoggerStub(), network, 0)
+	defer sut.CleanUp()
+	now := time.Now()
+	sent := time.Unix(100, 0)
+
+	network.client(0).lastSent = sent
+	network.client(0).setConnected(false)
+	sut.check(now)
+	sut.check(now.Add(time.Minute))
+
+	assert.Equal(t, failoverServersForTesting[1], sut.ActiveServer())
+	assert.Equal(t, sent, sut.LastSent())
+}
@@ -0,0 +1,252 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricFilteredEventsByDevice   = `cloudmqtt_filtered_events_total{reason="device"}`
+	MetricFilteredEventsByProfile  = `cloudmqtt_filtered_events_total{reason="profile"}`
+	MetricFilteredEventsByReadings = `cloudmqtt_filtered_events_total{reason="readings"}`
+	MetricFilteredReadings         = `cloudmqtt_filtered_readings_total`
+
+	// regexPatternPrefix identifies a filter pattern as a regular expression rather than a glob.
+	regexPatternPrefix = "re:"
+)
+
+// FilterRules defines the include and exclude patterns applied to a name by a filter.  A pattern is a glob (supporting
+// * and ?) unless prefixed with "re:", in which case the remainder is a regular expression.  An empty include list
+// includes every name and an exclusion takes precedence over an inclusion.
+type FilterRules struct {
+	Include []string
+	Exclude []string
+}
+
+// matcher is the compiled form of FilterRules.
+type matcher struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// compilePattern function compiles a glob or regular expression pattern.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+	}
+
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.Replace(expression, `\*`, ".*", -1)
+	expression = strings.Replace(expression, `\?`, ".", -1)
+	return regexp.Compile("^" + expression + "$")
+}
+
+// compilePatterns function compiles a list of glob or regular expression patterns.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range patterns {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %s: %v", pattern, err)
+		}
+		result = append(result, compiled)
+	}
+	return result, nil
+}
+
+// newMatcher function returns the compiled form of rules.
+func newMatcher(rules FilterRules) (*matcher, error) {
+	include, err := compilePatterns(rules.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(rules.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &matcher{include: include, exclude: exclude}, nil
+}
+
+// empty method returns true if the matcher has no patterns and therefore includes every name.
+func (m *matcher) empty() bool {
+	return len(m.include) == 0 && len(m.exclude) == 0
+}
+
+// anyMatch function returns true if name matches any of the expressions.
+func anyMatch(expressions []*regexp.Regexp, name string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// included method returns true if name is included by the matcher's rules.
+func (m *matcher) included(name string) bool {
+	if anyMatch(m.exclude, name) {
+		return false
+	}
+	return len(m.include) == 0 || anyMatch(m.include, name)
+}
+
+// filter is a receiver wrapping include/exclude rules for device names, device profile names, and reading names.
+type filter struct {
+	loggingClient  logger.LoggingClient
+	metadataClient contract.MetadataClient
+	metrics        contract.Metrics
+	lookupTimeout  time.Duration
+	failureTtl     time.Duration
+	devices        *matcher
+	profiles       *matcher
+	readings       *matcher
+	mutex          sync.Mutex
+	failures       map[string]time.Time
+}
+
+// NewFilter is a constructor that returns an instance of filter configured with the specified rules; device profile
+// names are loaded through metadataClient (usually a metadata cache) only when profile rules are specified.  Each
+// lookup is abandoned after lookupTimeout and a device whose lookup failed is not looked up again for failureTtl.
+func NewFilter(
+	loggingClient logger.LoggingClient,
+	metadataClient contract.MetadataClient,
+	metrics contract.Metrics,
+	lookupTimeout time.Duration,
+	failureTtl time.Duration,
+	deviceRules FilterRules,
+	profileRules FilterRules,
+	readingRules FilterRules) (*filter, error) {
+
+	devices, err := newMatcher(deviceRules)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := newMatcher(profileRules)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := newMatcher(readingRules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filter{
+		loggingClient:  loggingClient,
+		metadataClient: metadataClient,
+		metrics:        metrics,
+		lookupTimeout:  lookupTimeout,
+		failureTtl:     failureTtl,
+		devices:        devices,
+		profiles:       profiles,
+		readings:       readings,
+		failures:       make(map[string]time.Time),
+	}, nil
+}
+
+// profileLookupFailedLogMessage function formats and returns the log message for when a device's profile cannot be
+// determined.
+func profileLookupFailedLogMessage(deviceName string, errorMessage string) string {
+	return fmt.Sprintf("profile lookup failed for %s (%s)", deviceName, errorMessage)
+}
+
+// profileForDevice method returns the name of the device's profile; ok is false if it could not be determined, either
+// now or by a recent lookup.
+func (f *filter) profileForDevice(deviceName string) (profileName string, ok bool) {
+	f.mutex.Lock()
+	retryAt, failed := f.failures[deviceName]
+	if failed && time.Now().Before(retryAt) {
+		f.mutex.Unlock()
+		return "", false
+	}
+	delete(f.failures, deviceName)
+	f.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.lookupTimeout)
+	defer cancel()
+
+	device, err := f.metadataClient.DeviceForName(deviceName, ctx)
+	if err != nil {
+		f.loggingClient.Warn(
+			profileLookupFailedLogMessage(deviceName, err.Error()),
+			LogFieldDevice, deviceName,
+			LogFieldError, err.Error())
+
+		f.mutex.Lock()
+		f.failures[deviceName] = time.Now().Add(f.failureTtl)
+		f.mutex.Unlock()
+		return "", false
+	}
+	return device.Profile.Name, true
+}
+
+// Filter method implements Filter contract; it rejects events from excluded devices or device profiles and removes
+// excluded readings.  Events whose device profile cannot be determined are not filtered by profile.
+func (f *filter) Filter(event *models.Event) bool {
+	if !f.devices.included(event.Device) {
+		f.metrics.Increment(MetricFilteredEventsByDevice, 1)
+		return false
+	}
+
+	if !f.profiles.empty() {
+		if profileName, ok := f.profileForDevice(event.Device); ok && !f.profiles.included(profileName) {
+			f.metrics.Increment(MetricFilteredEventsByProfile, 1)
+			return false
+		}
+	}
+
+	if f.readings.empty() || len(event.Readings) == 0 {
+		return true
+	}
+
+	readings := make([]models.Reading, 0, len(event.Readings))
+	for _, reading := range event.Readings {
+		if f.readings.included(reading.Name) {
+			readings = append(readings, reading)
+		}
+	}
+
+	if filtered := len(event.Readings) - len(readings); filtered > 0 {
+		f.metrics.Increment(MetricFilteredReadings, int64(filtered))
+	}
+	event.Readings = readings
+
+	if len(readings) == 0 {
+		f.metrics.Increment(MetricFilteredEventsByReadings, 1)
+		return false
+	}
+	return true
+}
+
+// FilterChain function returns a Filter implementation that applies each of filters in turn, stopping at the first
+// filter that rejects the event.
+func FilterChain(filters ...contract.Filter) contract.Filter {
+	return func(event *models.Event) bool {
+		for _, filter := range filters {
+			if !filter(event) {
+				return false
+			}
+		}
+		return true
+	}
+}
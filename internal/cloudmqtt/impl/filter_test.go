@@ -0,0 +1,322 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/google/uuid"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const (
+	filterLookupTimeoutForTesting = time.Second
+	filterFailureTtlForTesting    = time.Hour
+)
+
+//
+//  SUT factory
+//
+
+func newFilterSUT(
+	t *testing.T,
+	loggingClient logger.LoggingClient,
+	metadataClient contract.MetadataClient,
+	metrics contract.Metrics,
+	deviceRules FilterRules,
+	profileRules FilterRules,
+	readingRules FilterRules) *filter {
+
+	sut, err := NewFilter(
+		loggingClient,
+		metadataClient,
+		metrics,
+		filterLookupTimeoutForTesting,
+		filterFailureTtlForTesting,
+		deviceRules,
+		profileRules,
+		readingRules)
+	assert.Nil(t, err)
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func newMetadataClientImplForProfile(profileName string) *metadataClientImpl {
+	device := newDevice("device")
+	device.Profile.Name = profileName
+	return newMetadataClientImpl(device, nil)
+}
+
+func newEventWithReadings(deviceName string, readingNames ...string) models.Event {
+	event := stub.NewEventForDevice(deviceName)
+	for _, readingName := range readingNames {
+		event.Readings = append(event.Readings, models.Reading{Id: uuid.New().String(), Device: deviceName, Name: readingName})
+	}
+	return event
+}
+
+func readingNames(event models.Event) (result []string) {
+	for _, reading := range event.Readings {
+		result = append(result, reading.Name)
+	}
+	return
+}
+
+//
+//  unit tests
+//
+
+func TestNewFilterWithInvalidRegularExpressionReturnsError(t *testing.T) {
+	sut, err := NewFilter(
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		NewMetrics(),
+		filterLookupTimeoutForTesting,
+		filterFailureTtlForTesting,
+		FilterRules{Include: []string{"re:("}},
+		FilterRules{},
+		FilterRules{})
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestFilterWithoutRulesIncludesEventUnchanged(t *testing.T) {
+	metadataClient := newMetadataClientImplForProfile("profile")
+	sut := newFilterSUT(t, stub.NewLoggerStub(), metadataClient, NewMetrics(), FilterRules{}, FilterRules{}, FilterRules{})
+	event := newEventWithReadings("device", "reading1", "reading2")
+	expected := event
+
+	assert.True(t, sut.Filter(&event))
+	assert.Equal(t, expected, event)
+	assert.Equal(t, 0, metadataClient.DeviceForNameCalledCount)
+}
+
+func TestFilterExcludedDeviceGlobRejectsEventAndCountsIt(t *testing.T) {
+	metrics := NewMetrics()
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		metrics,
+		FilterRules{Exclude: []string{"diag-*"}},
+		FilterRules{},
+		FilterRules{})
+	excluded := stub.NewEventForDevice("diag-01")
+	included := stub.NewEventForDevice("sensor-01")
+
+	assert.False(t, sut.Filter(&excluded))
+	assert.True(t, sut.Filter(&included))
+	assert.Equal(t, int64(1), metrics.Counter(MetricFilteredEventsByDevice))
+}
+
+func TestFilterIncludedDeviceRegularExpressionRejectsOtherDevices(t *testing.T) {
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		NewMetrics(),
+		FilterRules{Include: []string{"re:^sensor-[0-9]+$"}},
+		FilterRules{},
+		FilterRules{})
+	included := stub.NewEventForDevice("sensor-01")
+	excluded := stub.NewEventForDevice("sensor-a")
+
+	assert.True(t, sut.Filter(&included))
+	assert.False(t, sut.Filter(&excluded))
+}
+
+func TestFilterExclusionTakesPrecedenceOverInclusion(t *testing.T) {
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		NewMetrics(),
+		FilterRules{Include: []string{"*"}, Exclude: []string{"device"}},
+		FilterRules{},
+		FilterRules{})
+	event := stub.NewEvent()
+
+	assert.False(t, sut.Filter(&event))
+}
+
+func TestFilterExcludedProfileRejectsEventAndCountsIt(t *testing.T) {
+	metrics := NewMetrics()
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplForProfile("diagnostics"),
+		metrics,
+		FilterRules{},
+		FilterRules{Exclude: []string{"diag*"}},
+		FilterRules{})
+	event := stub.NewEvent()
+
+	assert.False(t, sut.Filter(&event))
+	assert.Equal(t, int64(1), metrics.Counter(MetricFilteredEventsByProfile))
+}
+
+func TestFilterProfileIsLoadedThroughMetadataCache(t *testing.T) {
+	metadataClient := newMetadataClientImplForProfile("profile")
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		NewMetadataCache(NewMetrics(), metadataClient, time.Hour, time.Hour),
+		NewMetrics(),
+		FilterRules{},
+		FilterRules{Include: []string{"profile"}},
+		FilterRules{})
+	event1 := stub.NewEvent()
+	event2 := stub.NewEvent()
+
+	assert.True(t, sut.Filter(&event1))
+	assert.True(t, sut.Filter(&event2))
+	assert.Equal(t, 1, metadataClient.DeviceForNameCalledCount)
+}
+
+func TestFilterProfileLookupIsBoundedByTimeout(t *testing.T) {
+	metadataClient := newMetadataClientImplForProfile("profile")
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		metadataClient,
+		NewMetrics(),
+		FilterRules{},
+		FilterRules{Include: []string{"profile"}},
+		FilterRules{})
+	event := stub.NewEvent()
+	before := time.Now()
+
+	sut.Filter(&event)
+
+	assert.Equal(t, 1, metadataClient.DeviceForNameCalledCount)
+	deadline, ok := metadataClient.DeviceForNameCalledInstances[0].Context.Deadline()
+	assert.True(t, ok)
+	assert.False(t, deadline.After(time.Now().Add(filterLookupTimeoutForTesting)))
+	assert.True(t, deadline.After(before))
+}
+
+func TestFilterProfileLookupFailureIncludesEventAndLogsWarning(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	errorMessage := uuid.New().String()
+	sut := newFilterSUT(
+		t,
+		loggingClient,
+		newMetadataClientImpl(models.Device{}, errors.New(errorMessage)),
+		NewMetrics(),
+		FilterRules{},
+		FilterRules{Include: []string{"profile"}},
+		FilterRules{})
+	event := stub.NewEvent()
+
+	assert.True(t, sut.Filter(&event))
+	assert.True(t, loggingClient.SpecificWarningOccurred(profileLookupFailedLogMessage(event.Device, errorMessage)))
+}
+
+func TestFilterProfileLookupFailureIsNotRetriedUntilFailureTtlHasElapsed(t *testing.T) {
+	metadataClient := newMetadataClientImpl(models.Device{}, errors.New(uuid.New().String()))
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		metadataClient,
+		NewMetrics(),
+		FilterRules{},
+		FilterRules{Exclude: []string{"profile"}},
+		FilterRules{})
+	event1 := stub.NewEvent()
+	event2 := stub.NewEvent()
+
+	assert.True(t, sut.Filter(&event1))
+	assert.True(t, sut.Filter(&event2))
+	assert.Equal(t, 1, metadataClient.DeviceForNameCalledCount)
+}
+
+func TestFilterProfileLookupFailureIsRetriedOnceFailureTtlHasElapsed(t *testing.T) {
+	metadataClient := newMetadataClientImpl(models.Device{}, errors.New(uuid.New().String()))
+	sut, _ := NewFilter(
+		stub.NewLoggerStub(),
+		metadataClient,
+		NewMetrics(),
+		filterLookupTimeoutForTesting,
+		0,
+		FilterRules{},
+		FilterRules{Exclude: []string{"profile"}},
+		FilterRules{})
+	event1 := stub.NewEvent()
+	event2 := stub.NewEvent()
+
+	sut.Filter(&event1)
+	sut.Filter(&event2)
+
+	assert.Equal(t, 2, metadataClient.DeviceForNameCalledCount)
+}
+
+func TestFilterExcludedReadingsAreRemovedAndCounted(t *testing.T) {
+	metrics := NewMetrics()
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		metrics,
+		FilterRules{},
+		FilterRules{},
+		FilterRules{Exclude: []string{"diag?"}})
+	event := newEventWithReadings("device", "temperature", "diag1", "diag2")
+	original := readingNames(event)
+
+	assert.True(t, sut.Filter(&event))
+	assert.Equal(t, []string{"temperature"}, readingNames(event))
+	assert.Equal(t, []string{"temperature", "diag1", "diag2"}, original)
+	assert.Equal(t, int64(2), metrics.Counter(MetricFilteredReadings))
+}
+
+func TestFilterEventWithAllReadingsExcludedIsRejectedAndCounted(t *testing.T) {
+	metrics := NewMetrics()
+	sut := newFilterSUT(
+		t,
+		stub.NewLoggerStub(),
+		newMetadataClientImplReturnSuccess(),
+		metrics,
+		FilterRules{},
+		FilterRules{},
+		FilterRules{Include: []string{"temperature"}})
+	event := newEventWithReadings("device", "diag1")
+
+	assert.False(t, sut.Filter(&event))
+	assert.Equal(t, int64(1), metrics.Counter(MetricFilteredEventsByReadings))
+}
+
+func TestFilterChainAppliesFiltersInOrderUntilRejected(t *testing.T) {
+	var called []string
+	factoryFilter := func(name string, result bool) contract.Filter {
+		return func(event *models.Event) bool {
+			called = append(called, name)
+			return result
+		}
+	}
+	sut := FilterChain(factoryFilter("first", true), factoryFilter("second", false), factoryFilter("third", true))
+	event := stub.NewEvent()
+
+	assert.False(t, sut(&event))
+	assert.Equal(t, []string{"first", "second"}, called)
+}
@@ -0,0 +1,167 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"net/http"
+	"time"
+)
+
+// HealthStatus describes the service's connectivity; LastPublish is milliseconds since the epoch (zero if nothing has
+// been sent).
+type HealthStatus struct {
+	MqttConnected     bool  `json:"mqttConnected"`
+	CommandSubscribed bool  `json:"commandSubscribed"`
+	LastPublish       int64 `json:"lastPublish"`
+	OutboundBacklog   int64 `json:"outboundBacklog"`
+	MetadataReachable bool  `json:"metadataReachable"`
+	Healthy           bool  `json:"healthy"`
+	Ready             bool  `json:"ready"`
+}
+
+// pinger is a receiver wrapping an EdgeX service's ping endpoint.
+type pinger struct {
+	url *endpointUrl
+}
+
+// NewPinger is a constructor that returns an instance of pinger configured to ping the endpoint described by params;
+// as for the EdgeX clients, endpoint resolves the endpoint if params.UseRegistry is true.
+func NewPinger(params types.EndpointParams, endpoint clients.Endpointer) *pinger {
+	return &pinger{url: newEndpointUrl(params, endpoint)}
+}
+
+// Ping method implements Pinger contract.
+func (p *pinger) Ping(ctx context.Context) error {
+	_, err := clients.GetRequest(p.url.get(), ctx)
+	return err
+}
+
+// connections is a receiver reporting the combined state of several connections to Cloud.
+type connections []contract.Connection
+
+// NewConnections is a constructor that returns an instance of connections reporting the combined state of each of
+// the specified connections.
+func NewConnections(each ...contract.Connection) connections {
+	return connections(each)
+}
+
+// Connected method implements Connection contract; it returns true if every connection is open.
+func (c connections) Connected() bool {
+	for _, connection := range c {
+		if !connection.Connected() {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribed method implements Connection contract; it returns true if every connection's command topic subscription
+// is in place.
+func (c connections) Subscribed() bool {
+	for _, connection := range c {
+		if !connection.Subscribed() {
+			return false
+		}
+	}
+	return true
+}
+
+// LastSent method implements Connection contract; it returns the time content was last sent successfully over any
+// connection (zero if never).
+func (c connections) LastSent() time.Time {
+	var lastSent time.Time
+	for _, connection := range c {
+		if sent := connection.LastSent(); sent.After(lastSent) {
+			lastSent = sent
+		}
+	}
+	return lastSent
+}
+
+// health is a receiver wrapping the checks reported by the service's health and readiness endpoints.
+type health struct {
+	connection   contract.Connection
+	backlog      func() int64
+	pingMetadata contract.Pinger
+	timeout      time.Duration
+	maxBacklog   int64
+}
+
+// NewHealth is a constructor that returns an instance of health configured to report connection's state, the
+// outbound backlog returned by backlog, and whether pingMetadata succeeds within timeout.  The service is healthy
+// while connection is open and subscribed, and ready while it is also healthy, core-metadata is reachable, and the
+// backlog does not exceed maxBacklog.
+func NewHealth(
+	connection contract.Connection,
+	backlog func() int64,
+	pingMetadata contract.Pinger,
+	timeout time.Duration,
+	maxBacklog int64) *health {
+
+	return &health{
+		connection:   connection,
+		backlog:      backlog,
+		pingMetadata: pingMetadata,
+		timeout:      timeout,
+		maxBacklog:   maxBacklog,
+	}
+}
+
+// Status method returns the service's current health; core-metadata is pinged only if checkMetadata is true.
+func (h *health) Status(checkMetadata bool) HealthStatus {
+	status := HealthStatus{
+		MqttConnected:     h.connection.Connected(),
+		CommandSubscribed: h.connection.Subscribed(),
+		OutboundBacklog:   h.backlog(),
+	}
+	if lastSent := h.connection.LastSent(); !lastSent.IsZero() {
+		status.LastPublish = milliseconds(lastSent)
+	}
+	status.Healthy = status.MqttConnected && status.CommandSubscribed
+
+	if checkMetadata {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		status.MetadataReachable = abandonable(ctx, func() error { return h.pingMetadata(ctx) }) == nil
+		status.Ready = status.Healthy && status.MetadataReachable && status.OutboundBacklog <= h.maxBacklog
+	}
+	return status
+}
+
+// respond function writes status to writer, with 503 Service Unavailable if ok is false.
+func respond(writer http.ResponseWriter, status HealthStatus, ok bool) {
+	writer.Header().Set("Content-Type", "application/json")
+	if !ok {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(writer).Encode(status)
+}
+
+// Live method is an HTTP handler reporting whether the service is healthy.
+func (h *health) Live(writer http.ResponseWriter, _ *http.Request) {
+	status := h.Status(false)
+	respond(writer, status, status.Healthy)
+}
+
+// Ready method is an HTTP handler reporting whether the service is ready.
+func (h *health) Ready(writer http.ResponseWriter, _ *http.Request) {
+	status := h.Status(true)
+	respond(writer, status, status.Ready)
+}
@@ -0,0 +1,141 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+type connectionImpl struct {
+	connected  bool
+	subscribed bool
+	lastSent   time.Time
+}
+
+func (c *connectionImpl) Connected() bool     { return c.connected }
+func (c *connectionImpl) Subscribed() bool    { return c.subscribed }
+func (c *connectionImpl) LastSent() time.Time { return c.lastSent }
+
+func pingImpl(err error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return err
+	}
+}
+
+//
+//  SUT factory
+//
+
+func newHealthSUT(connection *connectionImpl, backlog int64, pingErr error) *health {
+	return NewHealth(connection, func() int64 { return backlog }, pingImpl(pingErr), time.Second, 10)
+}
+
+//
+//  utility and helper functions
+//
+
+func serve(t *testing.T, handler http.HandlerFunc) (int, HealthStatus) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var status HealthStatus
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	return recorder.Code, status
+}
+
+//
+//  unit tests
+//
+
+func TestHealthReadyWhenConnectedSubscribedReachableAndBacklogWithinLimit(t *testing.T) {
+	lastSent := time.Now()
+	sut := newHealthSUT(&connectionImpl{connected: true, subscribed: true, lastSent: lastSent}, 10, nil)
+
+	liveCode, _ := serve(t, sut.Live)
+	readyCode, status := serve(t, sut.Ready)
+
+	assert.Equal(t, http.StatusOK, liveCode)
+	assert.Equal(t, http.StatusOK, readyCode)
+	assert.Equal(
+		t,
+		HealthStatus{
+			MqttConnected:     true,
+			CommandSubscribed: true,
+			LastPublish:       milliseconds(lastSent),
+			OutboundBacklog:   10,
+			MetadataReachable: true,
+			Healthy:           true,
+			Ready:             true,
+		},
+		status)
+}
+
+func TestHealthUnhealthyWhenDisconnectedOrUnsubscribed(t *testing.T) {
+	for _, connection := range []*connectionImpl{{subscribed: true}, {connected: true}} {
+		sut := newHealthSUT(connection, 0, nil)
+
+		liveCode, status := serve(t, sut.Live)
+		readyCode, _ := serve(t, sut.Ready)
+
+		assert.Equal(t, http.StatusServiceUnavailable, liveCode)
+		assert.Equal(t, http.StatusServiceUnavailable, readyCode)
+		assert.False(t, status.Healthy)
+	}
+}
+
+func TestHealthNotReadyWhenMetadataUnreachable(t *testing.T) {
+	sut := newHealthSUT(&connectionImpl{connected: true, subscribed: true}, 0, errors.New("errorMessage"))
+
+	liveCode, _ := serve(t, sut.Live)
+	readyCode, status := serve(t, sut.Ready)
+
+	assert.Equal(t, http.StatusOK, liveCode)
+	assert.Equal(t, http.StatusServiceUnavailable, readyCode)
+	assert.False(t, status.MetadataReachable)
+	assert.Equal(t, int64(0), status.LastPublish)
+}
+
+func TestHealthNotReadyWhenBacklogExceedsLimit(t *testing.T) {
+	sut := newHealthSUT(&connectionImpl{connected: true, subscribed: true}, 11, nil)
+
+	readyCode, status := serve(t, sut.Ready)
+
+	assert.Equal(t, http.StatusServiceUnavailable, readyCode)
+	assert.True(t, status.Healthy)
+	assert.True(t, status.MetadataReachable)
+}
+
+func TestConnectionsRequireEveryConnectionAndReportLatestSend(t *testing.T) {
+	earlier, later := time.Unix(100, 0), time.Unix(200, 0)
+	up := &connectionImpl{connected: true, subscribed: true, lastSent: later}
+	down := &connectionImpl{lastSent: earlier}
+
+	assert.True(t, NewConnections(up, up).Connected())
+	assert.True(t, NewConnections(up, up).Subscribed())
+	assert.False(t, NewConnections(up, down).Connected())
+	assert.False(t, NewConnections(down, up).Subscribed())
+	assert.Equal(t, later, NewConnections(down, up).LastSent())
+}
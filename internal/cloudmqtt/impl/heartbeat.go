@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+	"time"
+)
+
+// errorRecorder is a receiver wrapping a LoggingClient implementation that remembers the last error logged.
+type errorRecorder struct {
+	logger.LoggingClient
+	mutex     sync.Mutex
+	lastError string
+	when      time.Time
+}
+
+// NewErrorRecorder is a constructor that returns an instance of errorRecorder logging via loggingClient.
+func NewErrorRecorder(loggingClient logger.LoggingClient) *errorRecorder {
+	return &errorRecorder{LoggingClient: loggingClient}
+}
+
+// Error method implements LoggingClient; it logs and remembers msg.
+func (r *errorRecorder) Error(msg string, args ...interface{}) {
+	r.mutex.Lock()
+	r.lastError, r.when = msg, time.Now()
+	r.mutex.Unlock()
+
+	r.LoggingClient.Error(msg, args...)
+}
+
+// LastError method returns the last error logged and when it was logged (empty and zero if none).
+func (r *errorRecorder) LastError() (string, time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastError, r.when
+}
+
+// heartbeat is a receiver wrapping a periodic status publisher.
+type heartbeat struct {
+	loggingClient logger.LoggingClient
+	marshal       contract.Marshaller
+	send          contract.Sender
+	interval      time.Duration
+	status        func() interface{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewHeartbeat is a constructor that returns an instance of heartbeat configured to send the result of status at
+// startup and every interval thereafter; a status that cannot be sent is superseded by the next.
+func NewHeartbeat(
+	loggingClient logger.LoggingClient,
+	marshal contract.Marshaller,
+	send contract.Sender,
+	interval time.Duration,
+	status func() interface{}) *heartbeat {
+
+	h := &heartbeat{
+		loggingClient: loggingClient,
+		marshal:       marshal,
+		send:          send,
+		interval:      interval,
+		status:        status,
+		done:          make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.beater()
+	return h
+}
+
+// heartbeatFailedLogMessage function formats and returns the log message for when a status cannot be sent.
+func heartbeatFailedLogMessage(errorMessage string) string {
+	return fmt.Sprintf("heartbeat failed (%s)", errorMessage)
+}
+
+// beat method sends the current status.
+func (h *heartbeat) beat() {
+	data, err := h.marshal(h.status())
+	if err != nil {
+		h.loggingClient.Warn(heartbeatFailedLogMessage(err.Error()), LogFieldError, err.Error())
+		return
+	}
+	if !h.send(context.Background(), data) {
+		h.loggingClient.Warn(heartbeatFailedLogMessage("send failed"))
+	}
+}
+
+// beater method is executed as goroutine by constructor and is responsible for sending the status every interval.
+func (h *heartbeat) beater() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.beat()
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CleanUp method ensures the beater() goroutine has completed.
+func (h *heartbeat) CleanUp() {
+	close(h.done)
+	h.wg.Wait()
+}
@@ -0,0 +1,83 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+//  unit tests
+//
+
+func TestErrorRecorderRemembersLastErrorAndLogsIt(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	sut := NewErrorRecorder(loggingClient)
+	before := time.Now()
+
+	sut.Error("first")
+	sut.Error("second")
+	sut.Warn("warning")
+
+	lastError, when := sut.LastError()
+	assert.Equal(t, "second", lastError)
+	assert.False(t, when.Before(before))
+	assert.True(t, loggingClient.SpecificErrorOccurred("first"))
+	assert.True(t, loggingClient.SpecificWarningOccurred("warning"))
+}
+
+func TestErrorRecorderWithoutErrorReturnsZeroValues(t *testing.T) {
+	sut := NewErrorRecorder(stub.NewLoggerStub())
+
+	lastError, when := sut.LastError()
+
+	assert.Empty(t, lastError)
+	assert.True(t, when.IsZero())
+}
+
+func TestHeartbeatSendsStatusAtStartup(t *testing.T) {
+	sender := &catalogueSenderImpl{}
+	sut := NewHeartbeat(
+		stub.NewLoggerStub(),
+		json.Marshal,
+		sender.Send,
+		time.Hour,
+		func() interface{} { return map[string]int{"uptime": 1} })
+
+	waitForSent(sender, 1)
+	sut.CleanUp()
+
+	assert.Equal(t, 1, len(sender.Sent()))
+	assert.Equal(t, `{"uptime":1}`, string(sender.Sent()[0]))
+}
+
+func TestHeartbeatSendsStatusEveryInterval(t *testing.T) {
+	sender := &catalogueSenderImpl{}
+	sut := NewHeartbeat(
+		stub.NewLoggerStub(),
+		json.Marshal,
+		sender.Send,
+		time.Millisecond,
+		func() interface{} { return "status" })
+
+	waitForSent(sender, 3)
+	sut.CleanUp()
+
+	assert.True(t, len(sender.Sent()) >= 3)
+}
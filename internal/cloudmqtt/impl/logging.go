@@ -0,0 +1,88 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+)
+
+// Keys of the structured fields passed as key/value args to LoggingClient.
+const (
+	LogFieldCorrelationId = "correlationId"
+	LogFieldEventId       = "eventId"
+	LogFieldDevice        = "device"
+	LogFieldTopic         = "topic"
+	LogFieldAttempt       = "attempt"
+	LogFieldLatency       = "latency"
+	LogFieldError         = "error"
+	LogFieldReasonCode    = "reasonCode"
+	LogFieldBroker        = "broker"
+)
+
+// WithCorrelationId function returns a copy of ctx carrying correlationId; the EdgeX clients send it to the service
+// they call as the correlation-id header.
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, clients.CorrelationHeader, correlationId)
+}
+
+// CorrelationId function returns the correlation ID carried by ctx (empty if none).
+func CorrelationId(ctx context.Context) string {
+	return clients.FromContext(clients.CorrelationHeader, ctx)
+}
+
+// fieldLogger is a receiver wrapping a LoggingClient implementation that adds a key/value field to each message.
+type fieldLogger struct {
+	logger.LoggingClient
+	key   string
+	value interface{}
+}
+
+// NewFieldLogger is a constructor that returns an instance of fieldLogger logging via loggingClient with the field
+// key=value added to each message.
+func NewFieldLogger(loggingClient logger.LoggingClient, key string, value interface{}) *fieldLogger {
+	return &fieldLogger{LoggingClient: loggingClient, key: key, value: value}
+}
+
+// withField method returns args with the logger's field appended.
+func (l *fieldLogger) withField(args []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(args)+2), args...), l.key, l.value)
+}
+
+// Trace method implements LoggingClient.
+func (l *fieldLogger) Trace(msg string, args ...interface{}) {
+	l.LoggingClient.Trace(msg, l.withField(args)...)
+}
+
+// Debug method implements LoggingClient.
+func (l *fieldLogger) Debug(msg string, args ...interface{}) {
+	l.LoggingClient.Debug(msg, l.withField(args)...)
+}
+
+// Info method implements LoggingClient.
+func (l *fieldLogger) Info(msg string, args ...interface{}) {
+	l.LoggingClient.Info(msg, l.withField(args)...)
+}
+
+// Warn method implements LoggingClient.
+func (l *fieldLogger) Warn(msg string, args ...interface{}) {
+	l.LoggingClient.Warn(msg, l.withField(args)...)
+}
+
+// Error method implements LoggingClient.
+func (l *fieldLogger) Error(msg string, args ...interface{}) {
+	l.LoggingClient.Error(msg, l.withField(args)...)
+}
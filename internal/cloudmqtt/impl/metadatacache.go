@@ -0,0 +1,148 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	MetricMetadataCacheHits   = "cloudmqtt_metadata_cache_hits_total"
+	MetricMetadataCacheMisses = "cloudmqtt_metadata_cache_misses_total"
+)
+
+// cachedDevice is the cached result of a device call.
+type cachedDevice struct {
+	device  models.Device
+	err     error
+	expires time.Time
+}
+
+// deviceCall is a device call in progress; done is closed once device and err are set.
+type deviceCall struct {
+	done   chan struct{}
+	device models.Device
+	err    error
+}
+
+// metadataCache is a receiver wrapping a MetadataClient implementation that caches devices for a fixed time, caches
+// unknown devices for a (usually shorter) fixed time, and shares a single call among concurrent requests for the same
+// device.
+type metadataCache struct {
+	metrics     contract.Metrics
+	client      contract.MetadataClient
+	ttl         time.Duration
+	negativeTtl time.Duration
+	now         func() time.Time
+	mutex       sync.Mutex
+	cached      map[string]*cachedDevice
+	calls       map[string]*deviceCall
+}
+
+// NewMetadataCache is a constructor that returns an instance of metadataCache configured to cache devices returned by
+// client for ttl and devices unknown to client for negativeTtl; other failures are not cached.
+func NewMetadataCache(
+	metrics contract.Metrics,
+	client contract.MetadataClient,
+	ttl time.Duration,
+	negativeTtl time.Duration) *metadataCache {
+
+	return newMetadataCache(metrics, client, ttl, negativeTtl, time.Now)
+}
+
+// newMetadataCache function implements NewMetadataCache with an injectable clock.
+func newMetadataCache(
+	metrics contract.Metrics,
+	client contract.MetadataClient,
+	ttl time.Duration,
+	negativeTtl time.Duration,
+	now func() time.Time) *metadataCache {
+
+	return &metadataCache{
+		metrics:     metrics,
+		client:      client,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		now:         now,
+		cached:      make(map[string]*cachedDevice),
+		calls:       make(map[string]*deviceCall),
+	}
+}
+
+// notFound function returns true if err reports that core-metadata does not know the device.
+func notFound(err error) bool {
+	switch e := err.(type) {
+	case *types.ErrServiceClient:
+		return e.StatusCode == http.StatusNotFound
+	case types.ErrServiceClient:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// call method is executed as goroutine by DeviceForName() and is responsible for querying client for the device on
+// behalf of all requests for it (using the first request's ctx) and caching the result, as appropriate.
+func (c *metadataCache) call(name string, ctx context.Context, call *deviceCall) {
+	call.device, call.err = c.client.DeviceForName(name, ctx)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.calls, name)
+	switch {
+	case call.err == nil:
+		c.cached[name] = &cachedDevice{device: call.device, expires: c.now().Add(c.ttl)}
+	case notFound(call.err):
+		c.cached[name] = &cachedDevice{err: call.err, expires: c.now().Add(c.negativeTtl)}
+	}
+	close(call.done)
+}
+
+// DeviceForName method implements MetadataClient contract; it returns the cached result for the device if it has not
+// expired, otherwise it queries client (or waits for a query already in progress) unless ctx is done first.
+func (c *metadataCache) DeviceForName(name string, ctx context.Context) (models.Device, error) {
+	c.mutex.Lock()
+	if cached, ok := c.cached[name]; ok && c.now().Before(cached.expires) {
+		c.mutex.Unlock()
+		c.metrics.Increment(MetricMetadataCacheHits, 1)
+		return cached.device, cached.err
+	}
+	delete(c.cached, name)
+
+	call, inProgress := c.calls[name]
+	if !inProgress {
+		call = &deviceCall{done: make(chan struct{})}
+		c.calls[name] = call
+	}
+	c.mutex.Unlock()
+
+	c.metrics.Increment(MetricMetadataCacheMisses, 1)
+	if !inProgress {
+		go c.call(name, ctx, call)
+	}
+
+	select {
+	case <-call.done:
+		return call.device, call.err
+	case <-ctx.Done():
+		return models.Device{}, ctx.Err()
+	}
+}
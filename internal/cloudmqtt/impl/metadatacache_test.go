@@ -0,0 +1,153 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"errors"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+// countingMetadataClientImpl counts calls and returns err if not nil; if release is not nil, each call blocks until
+// release is closed.
+type countingMetadataClientImpl struct {
+	calls   int32
+	err     error
+	release chan struct{}
+}
+
+func (c *countingMetadataClientImpl) DeviceForName(name string, ctx context.Context) (models.Device, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if c.release != nil {
+		<-c.release
+	}
+	if c.err != nil {
+		return models.Device{}, c.err
+	}
+	return newDevice(name), nil
+}
+
+func (c *countingMetadataClientImpl) Calls() int {
+	return int(atomic.LoadInt32(&c.calls))
+}
+
+//
+//  SUT factory
+//
+
+func newMetadataCacheSUT(client *countingMetadataClientImpl, clock *clockImpl) (*metadataCache, *metrics) {
+	metrics := NewMetrics()
+	return newMetadataCache(metrics, client, time.Minute, 10*time.Second, clock.Now), metrics
+}
+
+//
+//  unit tests
+//
+
+func TestMetadataCacheReturnsCachedDeviceUntilTtlExpires(t *testing.T) {
+	client := &countingMetadataClientImpl{}
+	clock := newClockImpl()
+	sut, metrics := newMetadataCacheSUT(client, clock)
+
+	first, _ := sut.DeviceForName("device", context.Background())
+	clock.Advance(59 * time.Second)
+	second, _ := sut.DeviceForName("device", context.Background())
+	clock.Advance(time.Second)
+	third, _ := sut.DeviceForName("device", context.Background())
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first.Id, third.Id)
+	assert.Equal(t, 2, client.Calls())
+	assert.Equal(t, int64(1), metrics.Counter(MetricMetadataCacheHits))
+	assert.Equal(t, int64(2), metrics.Counter(MetricMetadataCacheMisses))
+}
+
+func TestMetadataCacheCachesUnknownDeviceForNegativeTtl(t *testing.T) {
+	client := &countingMetadataClientImpl{err: types.NewErrServiceClient(http.StatusNotFound, []byte("not found"))}
+	clock := newClockImpl()
+	sut, _ := newMetadataCacheSUT(client, clock)
+
+	_, err := sut.DeviceForName("device", context.Background())
+	assert.NotNil(t, err)
+	clock.Advance(9 * time.Second)
+	_, err = sut.DeviceForName("device", context.Background())
+	assert.NotNil(t, err)
+	clock.Advance(time.Second)
+	sut.DeviceForName("device", context.Background())
+
+	assert.Equal(t, 2, client.Calls())
+}
+
+func TestMetadataCacheDoesNotCacheOtherFailures(t *testing.T) {
+	client := &countingMetadataClientImpl{err: errors.New("errorMessage")}
+	sut, _ := newMetadataCacheSUT(client, newClockImpl())
+
+	sut.DeviceForName("device", context.Background())
+	sut.DeviceForName("device", context.Background())
+
+	assert.Equal(t, 2, client.Calls())
+}
+
+func TestMetadataCacheSharesCallAmongConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	client := &countingMetadataClientImpl{release: release}
+	sut, metrics := newMetadataCacheSUT(client, newClockImpl())
+
+	var wg sync.WaitGroup
+	results := make([]models.Device, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = sut.DeviceForName("device", context.Background())
+		}(i)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if metrics.Counter(MetricMetadataCacheMisses) == int64(len(results)) {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, client.Calls())
+	for _, result := range results {
+		assert.Equal(t, results[0], result)
+	}
+}
+
+func TestMetadataCacheRequestAbandonedWhenContextDone(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client := &countingMetadataClientImpl{release: release}
+	sut, _ := newMetadataCacheSUT(client, newClockImpl())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := sut.DeviceForName("device", ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
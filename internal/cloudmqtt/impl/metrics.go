@@ -0,0 +1,284 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxSeriesPerFamily is the number of distinct label sets recorded for a counter or gauge; values for further label
+// sets (e.g. those of yet more devices or topics) are recorded together in the family's overflow series so that the
+// number of series stays bounded.
+const maxSeriesPerFamily = 100
+
+// labelValueEscaper escapes a label value as the Prometheus text exposition format requires.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricName function returns the name of the series of the base metric with the label name="value".
+func MetricName(base string, name string, value string) string {
+	return base + "{" + label(name, value) + "}"
+}
+
+// label function returns the label name="value" with value escaped.
+func label(name string, value string) string {
+	return name + `="` + labelValueEscaper.Replace(value) + `"`
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of every histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is the state of a histogram; counts[i] is the number of observations no greater than latencyBuckets[i].
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+// metrics is a receiver providing an in-memory registry of named counters, gauges, and histograms.  A counter's name
+// ends in _total; any other name set or incremented is a gauge.  A name may carry Prometheus labels (e.g.
+// name{label="value"}); families counts the series of each labelled counter and gauge.
+type metrics struct {
+	mutex      sync.Mutex
+	counters   map[string]int64
+	families   map[string]int
+	histograms map[string]*histogram
+}
+
+// NewMetrics is a constructor that returns an empty instance of metrics.
+func NewMetrics() *metrics {
+	return &metrics{
+		counters:   make(map[string]int64),
+		families:   make(map[string]int),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// series method returns the name under which the value of the named counter or gauge is recorded: the name itself
+// unless it is a new label set of a family that already has maxSeriesPerFamily series, in which case the family's
+// overflow series.
+func (m *metrics) series(name string) string {
+	if _, ok := m.counters[name]; ok {
+		return name
+	}
+	base := baseName(name)
+	if base == name {
+		return name
+	}
+	if m.families[base] >= maxSeriesPerFamily {
+		return MetricName(base, "overflow", "true")
+	}
+	m.families[base]++
+	return name
+}
+
+// Increment method implements Metrics contract; it adds delta to the named counter.
+func (m *metrics) Increment(name string, delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[m.series(name)] += delta
+}
+
+// Set method implements Metrics contract; it sets the named gauge to value.
+func (m *metrics) Set(name string, value int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[m.series(name)] = value
+}
+
+// Observe method implements Metrics contract; it adds value to the named histogram.
+func (m *metrics) Observe(name string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, ok := m.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.histograms[name] = h
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Counter method returns the current value of the named counter.
+func (m *metrics) Counter(name string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name]
+}
+
+// Counters method returns a snapshot of all counters.
+func (m *metrics) Counters() map[string]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make(map[string]int64, len(m.counters))
+	for name, value := range m.counters {
+		result[name] = value
+	}
+	return result
+}
+
+// Sum method returns the total of the counters with the specified name, whatever their labels.
+func (m *metrics) Sum(name string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var total int64
+	for counter, value := range m.counters {
+		if baseName(counter) == name {
+			total += value
+		}
+	}
+	return total
+}
+
+// Count method returns the number of observations added to the named histogram.
+func (m *metrics) Count(name string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if h, ok := m.histograms[name]; ok {
+		return h.count
+	}
+	return 0
+}
+
+// baseName function returns name without its labels.
+func baseName(name string) string {
+	if i := strings.Index(name, "{"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// metricType function returns the Prometheus type of the named counter or gauge.
+func metricType(name string) string {
+	if strings.HasSuffix(baseName(name), "_total") {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// Write method writes all counters, gauges, and histograms to w in the Prometheus text exposition format; the series
+// of each family are written together under a single TYPE line.
+func (m *metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if base, other := baseName(names[i]), baseName(names[j]); base != other {
+			return base < other
+		}
+		return names[i] < names[j]
+	})
+
+	var previous string
+	for _, name := range names {
+		if base := baseName(name); base != previous {
+			fmt.Fprintf(w, "# TYPE %s %s\n", base, metricType(name))
+			previous = base
+		}
+		fmt.Fprintf(w, "%s %d\n", name, m.counters[name])
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := m.histograms[name]
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+		fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	}
+}
+
+// ServeHTTP method implements http.Handler; it responds with the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(writer)
+}
+
+// labelledMetrics is a receiver wrapping metrics that adds a label to the name of each counter and gauge; histograms
+// are shared by every label.
+type labelledMetrics struct {
+	metrics *metrics
+	label   string
+}
+
+// WithLabel method returns a view of the registry that adds the label name="value" to each counter and gauge.
+func (m *metrics) WithLabel(name string, value string) *labelledMetrics {
+	return &labelledMetrics{metrics: m, label: label(name, value)}
+}
+
+// labelled method returns name with the view's label added.
+func (l *labelledMetrics) labelled(name string) string {
+	if i := strings.Index(name, "{"); i >= 0 {
+		return name[:i+1] + l.label + "," + name[i+1:]
+	}
+	return name + "{" + l.label + "}"
+}
+
+// Increment method implements Metrics contract; it adds delta to the named counter.
+func (l *labelledMetrics) Increment(name string, delta int64) {
+	l.metrics.Increment(l.labelled(name), delta)
+}
+
+// Set method implements Metrics contract; it sets the named gauge to value.
+func (l *labelledMetrics) Set(name string, value int64) {
+	l.metrics.Set(l.labelled(name), value)
+}
+
+// Observe method implements Metrics contract; it adds value to the named histogram.
+func (l *labelledMetrics) Observe(name string, value float64) {
+	l.metrics.Observe(name, value)
+}
+
+// Counter method returns the current value of the named counter.
+func (l *labelledMetrics) Counter(name string) int64 {
+	return l.metrics.Counter(l.labelled(name))
+}
+
+// Sum method returns the total of the counters with the specified name and the view's label, whatever their other
+// labels.
+func (l *labelledMetrics) Sum(name string) int64 {
+	var total int64
+	for counter, value := range l.metrics.Counters() {
+		if baseName(counter) == name && strings.Contains(counter[len(name):], l.label) {
+			total += value
+		}
+	}
+	return total
+}
@@ -0,0 +1,149 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+//
+//  unit tests
+//
+
+func TestMetricsIncrementAccumulatesCounter(t *testing.T) {
+	sut := NewMetrics()
+
+	sut.Increment("counter", 1)
+	sut.Increment("counter", 2)
+
+	assert.Equal(t, int64(3), sut.Counter("counter"))
+}
+
+func TestMetricsCountersReturnsSnapshot(t *testing.T) {
+	sut := NewMetrics()
+	sut.Increment("counter", 1)
+
+	snapshot := sut.Counters()
+	sut.Increment("counter", 1)
+
+	assert.Equal(t, map[string]int64{"counter": 1}, snapshot)
+}
+
+func TestMetricsSetReplacesGauge(t *testing.T) {
+	sut := NewMetrics()
+
+	sut.Set("gauge", 2)
+	sut.Set("gauge", 1)
+
+	assert.Equal(t, int64(1), sut.Counter("gauge"))
+}
+
+func TestMetricsWriteUsesPrometheusTextFormat(t *testing.T) {
+	sut := NewMetrics()
+	sut.Increment(`requests_total{code="200"}`, 2)
+	sut.Increment(`requests_total{code="500"}`, 1)
+	sut.Set("connected", 1)
+	sut.Observe("latency_seconds", 0.02)
+	sut.Observe("latency_seconds", 20)
+	var buffer bytes.Buffer
+
+	sut.Write(&buffer)
+
+	assert.Equal(
+		t,
+		`# TYPE connected gauge
+connected 1
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 1
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.005"} 0
+latency_seconds_bucket{le="0.01"} 0
+latency_seconds_bucket{le="0.025"} 1
+latency_seconds_bucket{le="0.05"} 1
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="0.25"} 1
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="2.5"} 1
+latency_seconds_bucket{le="5"} 1
+latency_seconds_bucket{le="10"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 20.02
+latency_seconds_count 2
+`,
+		buffer.String())
+}
+
+func TestWithLabelAddsLabelToCountersAndGauges(t *testing.T) {
+	registry := NewMetrics()
+	sut := registry.WithLabel("broker", "aws")
+
+	sut.Increment("sent_total", 2)
+	sut.Increment(`sent_total{topic="events"}`, 3)
+	sut.Set("connected", 1)
+	registry.WithLabel("broker", "aws2").Increment("sent_total", 5)
+
+	assert.Equal(t, int64(2), registry.Counter(`sent_total{broker="aws"}`))
+	assert.Equal(t, int64(3), registry.Counter(`sent_total{broker="aws",topic="events"}`))
+	assert.Equal(t, int64(1), sut.Counter("connected"))
+	assert.Equal(t, int64(5), sut.Sum("sent_total"))
+	assert.Equal(t, int64(10), registry.Sum("sent_total"))
+}
+
+func TestMetricsWriteEmitsOneTypeLinePerFamily(t *testing.T) {
+	sut := NewMetrics()
+	sut.Increment("sent_total", 1)
+	sut.Increment("sent_total_bytes", 2)
+	sut.Increment(`sent_total{topic="events"}`, 3)
+	var buffer bytes.Buffer
+
+	sut.Write(&buffer)
+
+	assert.Equal(
+		t,
+		`# TYPE sent_total counter
+sent_total 1
+sent_total{topic="events"} 3
+# TYPE sent_total_bytes gauge
+sent_total_bytes 2
+`,
+		buffer.String())
+}
+
+func TestMetricNameEscapesLabelValue(t *testing.T) {
+	assert.Equal(t, `sent_total{topic="a\"b\\c\nd"}`, MetricName("sent_total", "topic", "a\"b\\c\nd"))
+	assert.Equal(
+		t,
+		`sent_total{broker="a\"b"}`,
+		NewMetrics().WithLabel("broker", `a"b`).labelled("sent_total"))
+}
+
+func TestMetricsLabelSetsBeyondLimitAreRecordedInOverflowSeries(t *testing.T) {
+	sut := NewMetrics()
+
+	for i := 0; i < maxSeriesPerFamily+2; i++ {
+		sut.Increment(MetricName("dropped_total", "device", strconv.Itoa(i)), 1)
+	}
+	sut.Increment(MetricName("dropped_total", "device", "0"), 1)
+
+	assert.Equal(t, maxSeriesPerFamily+1, len(sut.Counters()))
+	assert.Equal(t, int64(2), sut.Counter(MetricName("dropped_total", "device", "0")))
+	assert.Equal(t, int64(2), sut.Counter(MetricName("dropped_total", "overflow", "true")))
+	assert.Equal(t, int64(maxSeriesPerFamily+3), sut.Sum("dropped_total"))
+}
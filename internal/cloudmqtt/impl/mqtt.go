@@ -15,30 +15,63 @@
 package impl
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	mqttlib "github.com/eclipse/paho.mqtt.golang"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
 	"os"
+	"sync"
 	"time"
 )
 
 const qosAtLeastOnce = 1
 
+const (
+	// mqttDisconnectQuiesce is the time, in milliseconds, allowed for outstanding work to complete when disconnecting.
+	mqttDisconnectQuiesce = 250
+	// mqttUnsubscribeTimeout is the time allowed for the MQTT server to acknowledge an unsubscribe.
+	mqttUnsubscribeTimeout = 10 * time.Second
+)
+
+const (
+	MetricMqttConnected    = "cloudmqtt_mqtt_connected"
+	MetricMqttSendLatency  = "cloudmqtt_mqtt_send_latency_seconds"
+	MetricMqttSentBase     = "cloudmqtt_mqtt_sent_total"
+	MetricMqttFailuresBase = "cloudmqtt_mqtt_send_failures_total"
+)
+
+// MetricMqttSent function returns the name of the counter of messages sent to topicName.
+func MetricMqttSent(topicName string) string {
+	return MetricName(MetricMqttSentBase, "topic", topicName)
+}
+
+// MetricMqttSendFailures function returns the name of the counter of failed attempts to send to topicName.
+func MetricMqttSendFailures(topicName string) string {
+	return MetricName(MetricMqttFailuresBase, "topic", topicName)
+}
+
 // mqtt is a receiver wrapping a one-way MQTTS implementation.
 type mqtt struct {
 	loggingClient  logger.LoggingClient
+	metrics        contract.Metrics
 	client         mqttlib.Client
 	eventTopic     string
 	newDeviceTopic string
 	commandTopic   string
 	receiver       contract.Receiver
+	mutex          sync.Mutex
+	subscribed     bool
+	firstSubscribe chan error
+	lastSent       time.Time
 }
 
-// NewMqttInstanceForCloud is a constructor that returns an mqtt receiver configured for cloud-based MQTTS.
+// NewMqttInstanceForCloud is a constructor that returns an mqtt receiver configured for cloud-based MQTTS, or an
+// error if the connection cannot be established.
 func NewMqttInstanceForCloud(
 	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
 	certFile string,
 	keyFile string,
 	clientId string,
@@ -48,29 +81,19 @@ func NewMqttInstanceForCloud(
 	eventTopic string,
 	newDeviceTopic string,
 	commandTopic string,
-	receiver contract.Receiver) (q *mqtt) {
+	receiver contract.Receiver) (*mqtt, error) {
 
-	q = &mqtt{
+	q := &mqtt{
 		loggingClient:  loggingClient,
+		metrics:        metrics,
 		eventTopic:     eventTopic,
 		newDeviceTopic: newDeviceTopic,
 		commandTopic:   commandTopic,
 		receiver:       receiver,
+		firstSubscribe: make(chan error, 1),
 	}
 
-	tlsConfig := &tls.Config{}
-	if len(certFile) > 0 && len(keyFile) > 0 {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			q.loggingClient.Error(fmt.Sprintf("mqtt mqttInstanceForCloud LoadX509KeyPair failed: %v", err))
-			os.Exit(-1)
-		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
-	} else {
-		tlsConfig.ClientAuth = tls.NoClientCert
-		tlsConfig.ClientCAs = nil
-	}
-
+	tlsConfig := tlsConfigForCloud(loggingClient, certFile, keyFile)
 	options := mqttlib.ClientOptions{
 		ClientID:             clientId,
 		Username:             userName,
@@ -80,48 +103,160 @@ func NewMqttInstanceForCloud(
 		MaxReconnectInterval: 1 * time.Second,
 		KeepAlive:            int64(30 * time.Second),
 		TLSConfig:            tlsConfig,
+		OnConnect: func(mqttlib.Client) {
+			metrics.Set(MetricMqttConnected, 1)
+			err := q.subscribe()
+			select {
+			case q.firstSubscribe <- err:
+			default:
+			}
+		},
+		OnConnectionLost: func(mqttlib.Client, error) {
+			metrics.Set(MetricMqttConnected, 0)
+			q.setSubscribed(false)
+		},
 	}
 	options.AddBroker(server)
 	q.client = mqttlib.NewClient(&options)
 
 	if token := q.client.Connect(); token.Wait() && token.Error() != nil {
-		q.loggingClient.Error(fmt.Sprintf("mqtt mqttInstanceForCloud Connect failed: %v", token.Error()))
-		os.Exit(-1)
+		return nil, fmt.Errorf("Connect failed: %v", token.Error())
 	}
 
-	if token := q.client.Subscribe(commandTopic, 1, q.receive); token.Wait() && token.Error() != nil {
-		q.loggingClient.Error(fmt.Sprintf("mqtt mqttInstanceForCloud Subscribe failed: %v", token.Error()))
-		os.Exit(-1)
+	if err := <-q.firstSubscribe; err != nil {
+		q.client.Disconnect(mqttDisconnectQuiesce)
+		return nil, fmt.Errorf("Subscribe failed: %v", err)
 	}
-	return
+	return q, nil
+}
+
+// tlsConfigForCloud function returns the TLS configuration for a cloud-based MQTTS connection authenticating with
+// the client certificate in certFile and keyFile, if provided (or logs and exits if the certificate cannot be loaded).
+func tlsConfigForCloud(loggingClient logger.LoggingClient, certFile string, keyFile string) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if len(certFile) > 0 && len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			loggingClient.Error(
+				fmt.Sprintf("mqtt mqttInstanceForCloud LoadX509KeyPair failed: %v", err),
+				LogFieldError, err.Error())
+			os.Exit(-1)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		tlsConfig.ClientAuth = tls.NoClientCert
+		tlsConfig.ClientCAs = nil
+	}
+	return tlsConfig
+}
+
+// setSubscribed method records whether the command topic subscription is in place.
+func (q *mqtt) setSubscribed(subscribed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.subscribed = subscribed
+}
+
+// subscribe method is executed as goroutine by the MQTT client on each (re)connection and is responsible for
+// establishing the command topic subscription, which does not survive a clean session; the result of the first
+// connection's subscription is reported to the constructor via firstSubscribe.
+func (q *mqtt) subscribe() error {
+	if token := q.client.Subscribe(q.commandTopic, 1, q.receive); token.Wait() && token.Error() != nil {
+		q.loggingClient.Error(
+			fmt.Sprintf("mqtt subscribe failed: %v", token.Error()),
+			LogFieldTopic, q.commandTopic,
+			LogFieldError, token.Error().Error())
+		return token.Error()
+	}
+	q.setSubscribed(true)
+	return nil
 }
 
 // receive delegates handling of southbound command to provided receiver contract implementation.
 func (q *mqtt) receive(client mqttlib.Client, message mqttlib.Message) {
-	q.receiver(string(message.Payload()))
+	q.receiver(contract.Command{Payload: message.Payload(), Reply: q.SenderForTopic})
 }
 
-// send function publishes content on designated northbound MQTT topic.
-func send(q *mqtt, topicName string, content []byte) bool {
-	if token := q.client.Publish(topicName, qosAtLeastOnce, false, content); token.Wait() && token.Error() != nil {
-		q.loggingClient.Warn("mqtt send to " + topicName + " failed (" + token.Error().Error() + ")")
+// send function publishes content on designated northbound MQTT topic with the designated quality of service.
+func send(q *mqtt, topicName string, qos byte, content []byte) bool {
+	started := time.Now()
+	if token := q.client.Publish(topicName, qos, false, content); token.Wait() && token.Error() != nil {
+		q.loggingClient.Warn(
+			"mqtt send to "+topicName+" failed ("+token.Error().Error()+")",
+			LogFieldTopic, topicName,
+			LogFieldError, token.Error().Error())
+		q.metrics.Increment(MetricMqttSendFailures(topicName), 1)
 		return false
 	}
+	q.metrics.Observe(MetricMqttSendLatency, time.Since(started).Seconds())
+	q.metrics.Increment(MetricMqttSent(topicName), 1)
+
+	q.mutex.Lock()
+	q.lastSent = time.Now()
+	q.mutex.Unlock()
 	return true
 }
 
 // EventSender method transmits content to northbound MQTT event topic.
-func (q *mqtt) EventSender(content []byte) bool {
-	return send(q, q.eventTopic, content)
+func (q *mqtt) EventSender(ctx context.Context, content []byte) bool {
+	return send(q, q.eventTopic, qosAtLeastOnce, content)
 }
 
 // NewDeviceSender method transmits content to northbound MQTT new device topic.
-func (q *mqtt) NewDeviceSender(content []byte) bool {
-	return send(q, q.newDeviceTopic, content)
+func (q *mqtt) NewDeviceSender(ctx context.Context, content []byte) bool {
+	return send(q, q.newDeviceTopic, qosAtLeastOnce, content)
 }
 
+// SenderForTopic method returns a Sender implementation that transmits content to the specified northbound MQTT topic.
+func (q *mqtt) SenderForTopic(topicName string) contract.Sender {
+	return q.SenderForTopicAndQos(topicName, qosAtLeastOnce)
+}
+
+// SenderForTopicAndQos method returns a Sender implementation that transmits content to the specified northbound MQTT
+// topic with the specified quality of service.
+func (q *mqtt) SenderForTopicAndQos(topicName string, qos byte) contract.Sender {
+	return func(ctx context.Context, content []byte) bool {
+		return send(q, topicName, qos, content)
+	}
+}
+
+// Connected method implements Connection contract; it returns true if the connection to the MQTT server is open.
+func (q *mqtt) Connected() bool {
+	return q.client.IsConnectionOpen()
+}
+
+// Subscribed method implements Connection contract; it returns true if the command topic subscription is in place.
+func (q *mqtt) Subscribed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.subscribed
+}
+
+// LastSent method implements Connection contract; it returns the time content was last sent successfully (zero if
+// never).
+func (q *mqtt) LastSent() time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lastSent
+}
+
+// CleanUp method unsubscribes from the command topic and disconnects from the MQTT server; the subscription is
+// abandoned if the connection is not open.
 func (q *mqtt) CleanUp() {
-	if token := q.client.Unsubscribe(q.commandTopic); token.Wait() && token.Error() != nil {
-		q.loggingClient.Error(fmt.Sprintf("mqtt mqttInstanceForCloud Unsubscribe failed: %v", token.Error()))
+	if q.client.IsConnectionOpen() {
+		token := q.client.Unsubscribe(q.commandTopic)
+		if !token.WaitTimeout(mqttUnsubscribeTimeout) {
+			q.loggingClient.Error(
+				"mqtt mqttInstanceForCloud Unsubscribe timed out",
+				LogFieldTopic, q.commandTopic)
+		} else if token.Error() != nil {
+			q.loggingClient.Error(
+				fmt.Sprintf("mqtt mqttInstanceForCloud Unsubscribe failed: %v", token.Error()),
+				LogFieldTopic, q.commandTopic,
+				LogFieldError, token.Error().Error())
+		}
 	}
+	q.client.Disconnect(mqttDisconnectQuiesce)
+	q.metrics.Set(MetricMqttConnected, 0)
+	q.setSubscribed(false)
 }
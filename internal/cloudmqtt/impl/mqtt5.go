@@ -0,0 +1,829 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MetricMqttCommandsDropped    = "cloudmqtt_mqtt_commands_dropped_total"
+	mqtt5ContentType             = "application/json"
+	mqtt5TraceparentProperty     = "traceparent"
+	mqtt5ContentEncodingProperty = "contentEncoding"
+	mqtt5DefaultKeepAlive        = 30 * time.Second
+	mqtt5DefaultAckTimeout       = 10 * time.Second
+	mqtt5DefaultReconnectWait    = 1 * time.Second
+	mqtt5InboundQueueSize        = 64
+)
+
+var (
+	errMqtt5NotConnected     = errors.New("not connected")
+	errMqtt5ConnectionLost   = errors.New("connection lost")
+	errMqtt5AckTimeout       = errors.New("acknowledgement timed out")
+	errMqtt5KeepAliveTimeout = errors.New("keep alive timed out")
+	errMqtt5NoPacketId       = errors.New("no packet identifier available")
+	errMqtt5ReceiveMaximum   = errors.New("server receive maximum reached")
+	errMqtt5PacketTooLarge   = errors.New("packet exceeds server maximum packet size")
+)
+
+// Mqtt5Options holds the settings specific to MQTT 5; zero durations select the defaults.
+type Mqtt5Options struct {
+	// MessageExpiry is the lifetime of each message published (zero if messages do not expire)
+	MessageExpiry time.Duration
+	// ResponseTopic is the response topic of each message published (empty if none)
+	ResponseTopic string
+	// TopicAliases names the topics published using a topic alias, up to the server's topic alias maximum
+	TopicAliases []string
+	// KeepAlive is the keep alive interval requested of the server (default 30s)
+	KeepAlive time.Duration
+	// AckTimeout bounds connecting and waiting for the acknowledgement of a packet (default 10s)
+	AckTimeout time.Duration
+	// ReconnectWait is the wait between attempts to reconnect (default 1s)
+	ReconnectWait time.Duration
+}
+
+// mqtt5Session is the state of a single network connection to the MQTT server.
+type mqtt5Session struct {
+	conn              net.Conn
+	writeTimeout      time.Duration
+	keepAlive         time.Duration
+	topicAliasMaximum uint16
+	maximumPacketSize uint32
+	inflight          chan struct{}
+	lastReceived      int64
+	closeOnce         sync.Once
+	done              chan struct{}
+	writeMutex        sync.Mutex
+	aliases           map[string]uint16
+}
+
+// write method writes the packet returned by encode; encode is called with writeMutex held so that packets are
+// written in the order in which their topic aliases are assigned.  A packet exceeding the server's maximum packet size
+// is not written.
+func (s *mqtt5Session) write(encode func() []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	packet := encode()
+	if !s.fits(packet) {
+		return errMqtt5PacketTooLarge
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// fits method returns true if packet does not exceed the server's maximum packet size.
+func (s *mqtt5Session) fits(packet []byte) bool {
+	return s.maximumPacketSize == 0 || len(packet) <= int(s.maximumPacketSize)
+}
+
+// acquire method waits, for up to timeout, until fewer QoS 1 messages than the server's receive maximum await
+// acknowledgement on the session.
+func (s *mqtt5Session) acquire(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.inflight <- struct{}{}:
+		return nil
+	case <-s.done:
+		return errMqtt5ConnectionLost
+	case <-timer.C:
+		return errMqtt5ReceiveMaximum
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release method records that a QoS 1 message no longer awaits acknowledgement on the session.
+func (s *mqtt5Session) release() {
+	<-s.inflight
+}
+
+// alias method returns the topic alias for topicName (zero if the server's topic alias maximum has been reached) and
+// whether the alias has already been established on this connection; must be called with writeMutex held.
+func (s *mqtt5Session) alias(topicName string) (uint16, bool) {
+	if alias, ok := s.aliases[topicName]; ok {
+		return alias, true
+	}
+	if len(s.aliases) >= int(s.topicAliasMaximum) {
+		return 0, false
+	}
+	alias := uint16(len(s.aliases) + 1)
+	s.aliases[topicName] = alias
+	return alias, false
+}
+
+// received method records that a packet has been received from the MQTT server.
+func (s *mqtt5Session) received() {
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+}
+
+// sinceReceived method returns the time since a packet was last received from the MQTT server.
+func (s *mqtt5Session) sinceReceived() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastReceived)))
+}
+
+// close method closes the network connection.
+func (s *mqtt5Session) close() {
+	s.closeOnce.Do(func() {
+		_ = s.conn.Close()
+		close(s.done)
+	})
+}
+
+// mqtt5 is a receiver wrapping an MQTT 5 implementation; it offers the same contract as mqtt and adds message
+// properties, topic aliases, and reason codes.
+type mqtt5 struct {
+	loggingClient  logger.LoggingClient
+	metrics        contract.Metrics
+	tlsConfig      *tls.Config
+	server         *url.URL
+	clientId       string
+	userName       string
+	password       string
+	eventTopic     string
+	newDeviceTopic string
+	commandTopic   string
+	receiver       contract.Receiver
+	options        Mqtt5Options
+	aliased        map[string]bool
+	mutex          sync.Mutex
+	session        *mqtt5Session
+	subscribed     bool
+	lastSent       time.Time
+	packetId       uint16
+	pending        map[uint16]chan mqtt5AckPacket
+	closed         bool
+	done           chan struct{}
+	inbound        chan mqtt5PublishPacket
+	wg             sync.WaitGroup
+	dispatchWg     sync.WaitGroup
+}
+
+// NewMqtt5InstanceForCloud is a constructor that returns an mqtt5 receiver configured for cloud-based MQTT 5 over TLS
+// (ssl://, tls://, or mqtts://) or TCP (tcp:// or mqtt://), or an error if the connection cannot be established.
+func NewMqtt5InstanceForCloud(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	certFile string,
+	keyFile string,
+	clientId string,
+	userName string,
+	password string,
+	server string,
+	eventTopic string,
+	newDeviceTopic string,
+	commandTopic string,
+	receiver contract.Receiver,
+	options Mqtt5Options) (*mqtt5, error) {
+
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = mqtt5DefaultKeepAlive
+	}
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = mqtt5DefaultAckTimeout
+	}
+	if options.ReconnectWait <= 0 {
+		options.ReconnectWait = mqtt5DefaultReconnectWait
+	}
+
+	serverUrl, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("Parse failed: %v", err)
+	}
+
+	q := &mqtt5{
+		loggingClient:  loggingClient,
+		metrics:        metrics,
+		tlsConfig:      tlsConfigForCloud(loggingClient, certFile, keyFile),
+		server:         serverUrl,
+		clientId:       clientId,
+		userName:       userName,
+		password:       password,
+		eventTopic:     eventTopic,
+		newDeviceTopic: newDeviceTopic,
+		commandTopic:   commandTopic,
+		receiver:       receiver,
+		options:        options,
+		aliased:        make(map[string]bool),
+		pending:        make(map[uint16]chan mqtt5AckPacket),
+		done:           make(chan struct{}),
+		inbound:        make(chan mqtt5PublishPacket, mqtt5InboundQueueSize),
+	}
+	for _, topicName := range options.TopicAliases {
+		q.aliased[topicName] = true
+	}
+
+	q.dispatchWg.Add(1)
+	go q.dispatch()
+
+	if err := q.connect(); err != nil {
+		q.disconnect()
+		return nil, fmt.Errorf("Connect failed: %v", err)
+	}
+
+	if err := q.subscribe(); err != nil {
+		q.disconnect()
+		return nil, fmt.Errorf("Subscribe failed: %v", err)
+	}
+	return q, nil
+}
+
+// connectionLostLogMessage function formats and returns the log message for when the connection to the MQTT server is
+// lost.
+func connectionLostLogMessage(errorMessage string) string {
+	return fmt.Sprintf("mqtt connection lost (%s)", errorMessage)
+}
+
+// reconnectFailedLogMessage function formats and returns the log message for when an attempt to reconnect to the MQTT
+// server fails.
+func reconnectFailedLogMessage(errorMessage string) string {
+	return fmt.Sprintf("mqtt reconnect failed (%s)", errorMessage)
+}
+
+// commandDroppedLogMessage function formats and returns the log message for when a command is dropped because the
+// commands awaiting dispatch have reached mqtt5InboundQueueSize.
+func commandDroppedLogMessage(topicName string) string {
+	return fmt.Sprintf("mqtt command received on %s dropped (queue full)", topicName)
+}
+
+// serverAddress function returns the host:port address of the MQTT server identified by serverUrl and whether the
+// connection to it is secured with TLS; the port defaults to the scheme's registered port.
+func serverAddress(serverUrl *url.URL) (string, bool, error) {
+	var port string
+	var secure bool
+	switch serverUrl.Scheme {
+	case "tcp", "mqtt":
+		port = "1883"
+	case "ssl", "tls", "mqtts":
+		port, secure = "8883", true
+	default:
+		return "", false, fmt.Errorf("unsupported scheme: %s", serverUrl.Scheme)
+	}
+	if len(serverUrl.Port()) > 0 {
+		port = serverUrl.Port()
+	}
+	return net.JoinHostPort(serverUrl.Hostname(), port), secure, nil
+}
+
+// dial method opens a network connection to the MQTT server.
+func (q *mqtt5) dial() (net.Conn, error) {
+	address, secure, err := serverAddress(q.server)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: q.options.AckTimeout}
+	if secure {
+		return tls.DialWithDialer(dialer, "tcp", address, q.tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// connect method opens a clean session with the MQTT server and starts the goroutines servicing it.
+func (q *mqtt5) connect() error {
+	conn, err := q.dial()
+	if err != nil {
+		return err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(q.options.AckTimeout))
+	connect := mqtt5ConnectPacket{
+		clientId:  q.clientId,
+		userName:  q.userName,
+		password:  q.password,
+		keepAlive: uint16(q.options.KeepAlive / time.Second),
+	}
+	if _, err := conn.Write(connect.encode()); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	packetType, _, body, err := readMqtt5Packet(reader)
+	if err == nil && packetType != mqtt5Connack {
+		err = errMqtt5Malformed
+	}
+	var connack mqtt5ConnackPacket
+	if err == nil {
+		connack, err = decodeMqtt5Connack(body)
+	}
+	if err == nil && connack.reasonCode >= 0x80 {
+		err = &Mqtt5ReasonError{ReasonCode: connack.reasonCode, ReasonString: connack.properties.reasonString}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	receiveMaximum := connack.properties.receiveMaximum
+	if receiveMaximum == 0 {
+		receiveMaximum = math.MaxUint16
+	}
+	session := &mqtt5Session{
+		conn:              conn,
+		writeTimeout:      q.options.AckTimeout,
+		keepAlive:         q.options.KeepAlive,
+		topicAliasMaximum: connack.properties.topicAliasMaximum,
+		maximumPacketSize: connack.properties.maximumPacketSize,
+		inflight:          make(chan struct{}, receiveMaximum),
+		done:              make(chan struct{}),
+		aliases:           make(map[string]uint16),
+	}
+	if connack.properties.serverKeepAlive > 0 {
+		session.keepAlive = time.Duration(connack.properties.serverKeepAlive) * time.Second
+	}
+	session.received()
+
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		session.close()
+		return errMqtt5ConnectionLost
+	}
+	q.session = session
+	q.wg.Add(2)
+	q.mutex.Unlock()
+
+	q.metrics.Set(MetricMqttConnected, 1)
+	go q.read(session, reader)
+	go q.keepAlive(session)
+	return nil
+}
+
+// lost method closes session and, unless the receiver has been cleaned up, starts reconnecting.
+func (q *mqtt5) lost(session *mqtt5Session, err error) {
+	session.close()
+
+	q.mutex.Lock()
+	if q.session != session {
+		q.mutex.Unlock()
+		return
+	}
+	q.session = nil
+	q.subscribed = false
+	for packetId, result := range q.pending {
+		close(result)
+		delete(q.pending, packetId)
+	}
+	closed := q.closed
+	if !closed {
+		q.wg.Add(1)
+	}
+	q.mutex.Unlock()
+
+	q.metrics.Set(MetricMqttConnected, 0)
+	if closed {
+		return
+	}
+	q.loggingClient.Warn(connectionLostLogMessage(err.Error()), LogFieldError, err.Error())
+	go q.reconnect()
+}
+
+// reconnect method is executed as goroutine when the connection is lost and is responsible for reconnecting and
+// restoring the command topic subscription, which does not survive a clean session; if the subscription cannot be
+// restored, the new connection is dropped and the cycle repeated.
+func (q *mqtt5) reconnect() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-time.After(q.options.ReconnectWait):
+		}
+
+		if err := q.connect(); err != nil {
+			q.loggingClient.Debug(reconnectFailedLogMessage(err.Error()), LogFieldError, err.Error())
+			continue
+		}
+		if err := q.subscribe(); err != nil {
+			q.loggingClient.Error(
+				fmt.Sprintf("mqtt subscribe failed: %v", err),
+				LogFieldTopic, q.commandTopic,
+				LogFieldError, err.Error())
+
+			// a session without the command subscription is dropped so the subscription is retried by reconnecting.
+			q.mutex.Lock()
+			session := q.session
+			q.mutex.Unlock()
+			if session != nil {
+				q.lost(session, err)
+			}
+		}
+		return
+	}
+}
+
+// read method is executed as goroutine for each session and is responsible for handling the packets received from
+// the MQTT server.
+func (q *mqtt5) read(session *mqtt5Session, reader *bufio.Reader) {
+	defer q.wg.Done()
+
+	for {
+		packetType, flags, body, err := readMqtt5Packet(reader)
+		if err == nil {
+			session.received()
+			err = q.handle(session, packetType, flags, body)
+		}
+		if err != nil {
+			q.lost(session, err)
+			return
+		}
+	}
+}
+
+// handle method handles a packet received from the MQTT server; an error closes the session.  A command received
+// while mqtt5InboundQueueSize commands await dispatch is dropped and counted.
+func (q *mqtt5) handle(session *mqtt5Session, packetType byte, flags byte, body []byte) error {
+	switch packetType {
+	case mqtt5Puback:
+		ack, err := decodeMqtt5Puback(body)
+		if err != nil {
+			return err
+		}
+		q.acknowledged(ack)
+	case mqtt5Suback, mqtt5Unsuback:
+		ack, err := decodeMqtt5Suback(body)
+		if err != nil {
+			return err
+		}
+		q.acknowledged(ack)
+	case mqtt5Publish:
+		publish, err := decodeMqtt5Publish(flags, body)
+		if err != nil {
+			return err
+		}
+		if publish.qos > 0 {
+			if err := session.write(func() []byte { return encodeMqtt5Puback(publish.packetId) }); err != nil {
+				return err
+			}
+		}
+		select {
+		case q.inbound <- publish:
+		default:
+			q.loggingClient.Warn(
+				commandDroppedLogMessage(publish.topic),
+				LogFieldTopic, publish.topic,
+				LogFieldCorrelationId, string(publish.properties.correlationData))
+			q.metrics.Increment(MetricMqttCommandsDropped, 1)
+		}
+	case mqtt5Disconnect:
+		disconnect, err := decodeMqtt5Disconnect(body)
+		if err != nil {
+			return err
+		}
+		return &Mqtt5ReasonError{ReasonCode: disconnect.reasonCode, ReasonString: disconnect.properties.reasonString}
+	}
+	return nil
+}
+
+// acknowledged method delivers an acknowledgement to the request awaiting it.
+func (q *mqtt5) acknowledged(ack mqtt5AckPacket) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if result, ok := q.pending[ack.packetId]; ok {
+		result <- ack
+		delete(q.pending, ack.packetId)
+	}
+}
+
+// forget method abandons the request awaiting the acknowledgement of packetId.
+func (q *mqtt5) forget(packetId uint16) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.pending, packetId)
+}
+
+// keepAlive method is executed as goroutine for each session and is responsible for pinging the MQTT server; the
+// session is closed if nothing has been received from the server for one and a half keep alive intervals.
+func (q *mqtt5) keepAlive(session *mqtt5Session) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(session.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-ticker.C:
+		}
+
+		if session.sinceReceived() > session.keepAlive*3/2 {
+			q.lost(session, errMqtt5KeepAliveTimeout)
+			return
+		}
+		if err := session.write(encodeMqtt5Pingreq); err != nil {
+			q.lost(session, err)
+			return
+		}
+	}
+}
+
+// dispatch method is executed as goroutine by constructor and delegates handling of southbound commands to the
+// provided receiver contract implementation along with their response topic and correlation data.
+func (q *mqtt5) dispatch() {
+	defer q.dispatchWg.Done()
+
+	for publish := range q.inbound {
+		q.receiver(
+			contract.Command{
+				Payload:         publish.payload,
+				ResponseTopic:   publish.properties.responseTopic,
+				CorrelationData: publish.properties.correlationData,
+				Traceparent:     publish.properties.UserProperty(mqtt5TraceparentProperty),
+				Reply:           q.SenderForTopic,
+			})
+	}
+}
+
+// nextPacketId method returns the next packet identifier not awaiting an acknowledgement, or an error if every
+// identifier is in use; must be called with mutex held.
+func (q *mqtt5) nextPacketId() (uint16, error) {
+	for i := 0; i < math.MaxUint16; i++ {
+		q.packetId++
+		if q.packetId == 0 {
+			q.packetId++
+		}
+		if _, inUse := q.pending[q.packetId]; !inUse {
+			return q.packetId, nil
+		}
+	}
+	return 0, errMqtt5NoPacketId
+}
+
+// request method writes the packet returned by encode for a new packet identifier and waits for the packet to be
+// acknowledged; an acknowledgement with a failure reason code is returned as a Mqtt5ReasonError.  A QoS 1 PUBLISH
+// (inflight) is not written while the server's receive maximum of such messages await acknowledgement.
+func (q *mqtt5) request(
+	ctx context.Context,
+	inflight bool,
+	encode func(session *mqtt5Session, packetId uint16) []byte) error {
+
+	q.mutex.Lock()
+	session := q.session
+	q.mutex.Unlock()
+	if session == nil {
+		return errMqtt5NotConnected
+	}
+	if inflight {
+		if err := session.acquire(ctx, q.options.AckTimeout); err != nil {
+			return err
+		}
+		defer session.release()
+	}
+
+	q.mutex.Lock()
+	if q.session != session {
+		q.mutex.Unlock()
+		return errMqtt5ConnectionLost
+	}
+	packetId, err := q.nextPacketId()
+	if err != nil {
+		q.mutex.Unlock()
+		return err
+	}
+	result := make(chan mqtt5AckPacket, 1)
+	q.pending[packetId] = result
+	q.mutex.Unlock()
+
+	if err := session.write(func() []byte { return encode(session, packetId) }); err != nil {
+		q.forget(packetId)
+		if err != errMqtt5PacketTooLarge {
+			q.lost(session, err)
+		}
+		return err
+	}
+
+	timer := time.NewTimer(q.options.AckTimeout)
+	defer timer.Stop()
+	select {
+	case ack, ok := <-result:
+		if !ok {
+			return errMqtt5ConnectionLost
+		}
+		if ack.reasonCode >= 0x80 {
+			return &Mqtt5ReasonError{ReasonCode: ack.reasonCode, ReasonString: ack.properties.reasonString}
+		}
+		return nil
+	case <-timer.C:
+		q.forget(packetId)
+		return errMqtt5AckTimeout
+	case <-ctx.Done():
+		q.forget(packetId)
+		return ctx.Err()
+	}
+}
+
+// subscribe method subscribes to the command topic.
+func (q *mqtt5) subscribe() error {
+	err := q.request(context.Background(), false, func(_ *mqtt5Session, packetId uint16) []byte {
+		return encodeMqtt5Subscribe(packetId, q.commandTopic, qosAtLeastOnce)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.subscribed = q.session != nil
+	return nil
+}
+
+// properties method returns the properties of a message published with ctx; its correlation ID is sent as correlation
+// data, its trace context as the traceparent user property, and the compression scheme of compressed content as the
+// contentEncoding user property (such content is not marked as UTF-8).
+func (q *mqtt5) properties(ctx context.Context) mqtt5Properties {
+	properties := mqtt5Properties{
+		payloadFormat:   mqtt5PayloadUtf8,
+		messageExpiry:   uint32(q.options.MessageExpiry / time.Second),
+		contentType:     mqtt5ContentType,
+		responseTopic:   q.options.ResponseTopic,
+		correlationData: []byte(CorrelationId(ctx)),
+	}
+	if traceparent := Traceparent(ctx); len(traceparent) > 0 {
+		properties.userProperties = append(properties.userProperties, [2]string{mqtt5TraceparentProperty, traceparent})
+	}
+	if scheme := ContentEncoding(ctx); len(scheme) > 0 {
+		properties.payloadFormat = 0
+		properties.userProperties = append(properties.userProperties, [2]string{mqtt5ContentEncodingProperty, scheme})
+	}
+	return properties
+}
+
+// encodePublish method returns the encoded PUBLISH packet for content; the topic is replaced by its alias once the
+// alias has been established on session.  An alias assigned to a packet that will not be written because it exceeds
+// the server's maximum packet size is withdrawn.
+func (q *mqtt5) encodePublish(
+	session *mqtt5Session,
+	packetId uint16,
+	topicName string,
+	qos byte,
+	properties mqtt5Properties,
+	content []byte) []byte {
+
+	publish := mqtt5PublishPacket{topic: topicName, qos: qos, packetId: packetId, properties: properties, payload: content}
+	assigned := false
+	if q.aliased[topicName] {
+		if alias, established := session.alias(topicName); alias > 0 {
+			publish.properties.topicAlias = alias
+			assigned = !established
+			if established {
+				publish.topic = ""
+			}
+		}
+	}
+	packet := publish.encode()
+	if assigned && !session.fits(packet) {
+		delete(session.aliases, topicName)
+	}
+	return packet
+}
+
+// publish method publishes content on topicName with the designated quality of service and, for QoS 1, waits for it
+// to be acknowledged.
+func (q *mqtt5) publish(ctx context.Context, topicName string, qos byte, content []byte) error {
+	properties := q.properties(ctx)
+	if qos == 0 {
+		q.mutex.Lock()
+		session := q.session
+		q.mutex.Unlock()
+		if session == nil {
+			return errMqtt5NotConnected
+		}
+		return session.write(func() []byte { return q.encodePublish(session, 0, topicName, 0, properties, content) })
+	}
+	return q.request(ctx, true, func(session *mqtt5Session, packetId uint16) []byte {
+		return q.encodePublish(session, packetId, topicName, qos, properties, content)
+	})
+}
+
+// send method publishes content on designated northbound MQTT topic with the designated quality of service; a failure
+// reason code returned by the MQTT server is logged.
+func (q *mqtt5) send(ctx context.Context, topicName string, qos byte, content []byte) bool {
+	started := time.Now()
+	if err := q.publish(ctx, topicName, qos, content); err != nil {
+		args := []interface{}{
+			LogFieldCorrelationId, CorrelationId(ctx),
+			LogFieldTopic, topicName,
+			LogFieldError, err.Error(),
+		}
+		if reasonError, ok := err.(*Mqtt5ReasonError); ok {
+			args = append(args, LogFieldReasonCode, fmt.Sprintf("0x%02X", reasonError.ReasonCode))
+		}
+		q.loggingClient.Warn("mqtt send to "+topicName+" failed ("+err.Error()+")", args...)
+		q.metrics.Increment(MetricMqttSendFailures(topicName), 1)
+		return false
+	}
+	q.metrics.Observe(MetricMqttSendLatency, time.Since(started).Seconds())
+	q.metrics.Increment(MetricMqttSent(topicName), 1)
+
+	q.mutex.Lock()
+	q.lastSent = time.Now()
+	q.mutex.Unlock()
+	return true
+}
+
+// EventSender method transmits content to northbound MQTT event topic.
+func (q *mqtt5) EventSender(ctx context.Context, content []byte) bool {
+	return q.send(ctx, q.eventTopic, qosAtLeastOnce, content)
+}
+
+// NewDeviceSender method transmits content to northbound MQTT new device topic.
+func (q *mqtt5) NewDeviceSender(ctx context.Context, content []byte) bool {
+	return q.send(ctx, q.newDeviceTopic, qosAtLeastOnce, content)
+}
+
+// SenderForTopic method returns a Sender implementation that transmits content to the specified northbound MQTT topic.
+func (q *mqtt5) SenderForTopic(topicName string) contract.Sender {
+	return q.SenderForTopicAndQos(topicName, qosAtLeastOnce)
+}
+
+// SenderForTopicAndQos method returns a Sender implementation that transmits content to the specified northbound MQTT
+// topic with the specified quality of service.
+func (q *mqtt5) SenderForTopicAndQos(topicName string, qos byte) contract.Sender {
+	return func(ctx context.Context, content []byte) bool {
+		return q.send(ctx, topicName, qos, content)
+	}
+}
+
+// Connected method implements Connection contract; it returns true if the connection to the MQTT server is open.
+func (q *mqtt5) Connected() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.session != nil
+}
+
+// Subscribed method implements Connection contract; it returns true if the command topic subscription is in place.
+func (q *mqtt5) Subscribed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.subscribed
+}
+
+// LastSent method implements Connection contract; it returns the time content was last sent successfully (zero if
+// never).
+func (q *mqtt5) LastSent() time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lastSent
+}
+
+// CleanUp method unsubscribes from the command topic and disconnects from the MQTT server.
+func (q *mqtt5) CleanUp() {
+	err := q.request(context.Background(), false, func(_ *mqtt5Session, packetId uint16) []byte {
+		return encodeMqtt5Unsubscribe(packetId, q.commandTopic)
+	})
+	if err != nil {
+		q.loggingClient.Error(
+			fmt.Sprintf("mqtt mqtt5InstanceForCloud Unsubscribe failed: %v", err),
+			LogFieldTopic, q.commandTopic,
+			LogFieldError, err.Error())
+	}
+
+	q.disconnect()
+}
+
+// disconnect method disconnects from the MQTT server and ensures the goroutines servicing the connection have
+// completed.
+func (q *mqtt5) disconnect() {
+	q.mutex.Lock()
+	q.closed = true
+	session := q.session
+	q.mutex.Unlock()
+	close(q.done)
+
+	if session != nil {
+		_ = session.write(encodeMqtt5Disconnect)
+		q.lost(session, nil)
+	}
+	q.wg.Wait()
+	close(q.inbound)
+	q.dispatchWg.Wait()
+}
@@ -0,0 +1,499 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bufio"
+	"context"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	mqtt5EventTopic     = "events"
+	mqtt5NewDeviceTopic = "newDevices"
+	mqtt5CommandTopic   = "commands"
+)
+
+//
+//  test stubs
+//
+
+// brokerImpl is a minimal MQTT 5 server; it records the PUBLISH packets it receives and acknowledges each with the
+// next of pubackReasonCodes (success once exhausted) unless pubacks are withheld, and acknowledges each SUBSCRIBE
+// packet with the next of subackReasonCodes (success once exhausted).
+type brokerImpl struct {
+	listener          net.Listener
+	topicAliasMaximum uint16
+	mutex             sync.Mutex
+	receiveMaximum    uint16
+	maximumPacketSize uint32
+	withholdPubacks   bool
+	conn              net.Conn
+	connects          int
+	subscribes        int
+	published         []mqtt5PublishPacket
+	pubackReasonCodes []byte
+	subackReasonCodes []byte
+}
+
+func newBrokerImpl(t *testing.T, topicAliasMaximum uint16, pubackReasonCodes ...byte) *brokerImpl {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	b := &brokerImpl{listener: listener, topicAliasMaximum: topicAliasMaximum, pubackReasonCodes: pubackReasonCodes}
+	go b.accept()
+	return b
+}
+
+func (b *brokerImpl) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.conn = conn
+		b.mutex.Unlock()
+		go b.serve(conn)
+	}
+}
+
+func (b *brokerImpl) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		packetType, flags, body, err := readMqtt5Packet(reader)
+		if err != nil {
+			return
+		}
+
+		var w mqtt5Writer
+		switch packetType {
+		case mqtt5Connect:
+			b.mutex.Lock()
+			b.connects++
+			properties := mqtt5Properties{
+				topicAliasMaximum: b.topicAliasMaximum,
+				receiveMaximum:    b.receiveMaximum,
+				maximumPacketSize: b.maximumPacketSize,
+			}
+			b.mutex.Unlock()
+			w.WriteByte(0)
+			w.WriteByte(0)
+			w.writeProperties(properties)
+			_, _ = conn.Write(w.packet(mqtt5Connack, 0))
+		case mqtt5Subscribe, mqtt5Unsubscribe:
+			var reasonCode byte
+			b.mutex.Lock()
+			if packetType == mqtt5Subscribe {
+				b.subscribes++
+				if len(b.subackReasonCodes) > 0 {
+					reasonCode, b.subackReasonCodes = b.subackReasonCodes[0], b.subackReasonCodes[1:]
+				}
+			}
+			b.mutex.Unlock()
+			w.Write(body[:2])
+			w.writeProperties(mqtt5Properties{})
+			w.WriteByte(reasonCode)
+			_, _ = conn.Write(w.packet(packetType+1, 0))
+		case mqtt5Publish:
+			publish, _ := decodeMqtt5Publish(flags, body)
+			b.mutex.Lock()
+			b.published = append(b.published, publish)
+			var reasonCode byte
+			if len(b.pubackReasonCodes) > 0 {
+				reasonCode, b.pubackReasonCodes = b.pubackReasonCodes[0], b.pubackReasonCodes[1:]
+			}
+			withholdPubacks := b.withholdPubacks
+			b.mutex.Unlock()
+			if publish.qos > 0 && !withholdPubacks {
+				w.writeUint16(publish.packetId)
+				w.WriteByte(reasonCode)
+				w.writeProperties(mqtt5Properties{reasonString: "rejected by test"})
+				_, _ = conn.Write(w.packet(mqtt5Puback, 0))
+			}
+		case mqtt5Pingreq:
+			_, _ = conn.Write(w.packet(mqtt5Pingresp, 0))
+		case mqtt5Disconnect:
+			return
+		}
+	}
+}
+
+// command sends payload to the client on the command topic with the specified response topic and correlation data.
+func (b *brokerImpl) command(payload string, responseTopic string, correlationData string, traceparent string) {
+	publish := mqtt5PublishPacket{
+		topic:    mqtt5CommandTopic,
+		qos:      1,
+		packetId: 1,
+		properties: mqtt5Properties{
+			responseTopic:   responseTopic,
+			correlationData: []byte(correlationData),
+			userProperties:  [][2]string{{mqtt5TraceparentProperty, traceparent}},
+		},
+		payload: []byte(payload),
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, _ = b.conn.Write(publish.encode())
+}
+
+// limit sets the receive maximum and maximum packet size sent to clients that connect.
+func (b *brokerImpl) limit(receiveMaximum uint16, maximumPacketSize uint32) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.receiveMaximum, b.maximumPacketSize = receiveMaximum, maximumPacketSize
+}
+
+// withholdAcks stops the acknowledgement of PUBLISH packets.
+func (b *brokerImpl) withholdAcks() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.withholdPubacks = true
+}
+
+// failSubscribes acknowledges the next SUBSCRIBE packets with reasonCodes.
+func (b *brokerImpl) failSubscribes(reasonCodes ...byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subackReasonCodes = append(b.subackReasonCodes, reasonCodes...)
+}
+
+// drop closes the client's connection.
+func (b *brokerImpl) drop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_ = b.conn.Close()
+}
+
+func (b *brokerImpl) Published() []mqtt5PublishPacket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]mqtt5PublishPacket(nil), b.published...)
+}
+
+func (b *brokerImpl) Counts() (int, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.connects, b.subscribes
+}
+
+func (b *brokerImpl) CleanUp() {
+	_ = b.listener.Close()
+}
+
+//
+//  SUT factory
+//
+
+func newMqtt5SUT(
+	broker *brokerImpl,
+	loggingClient logger.LoggingClient,
+	metrics *metrics,
+	receiver contract.Receiver,
+	options Mqtt5Options) (*mqtt5, error) {
+
+	options.ReconnectWait = 10 * time.Millisecond
+	return NewMqtt5InstanceForCloud(
+		loggingClient,
+		metrics,
+		"",
+		"",
+		"clientId",
+		"",
+		"",
+		"tcp://"+broker.listener.Addr().String(),
+		mqtt5EventTopic,
+		mqtt5NewDeviceTopic,
+		mqtt5CommandTopic,
+		receiver,
+		options)
+}
+
+//
+//  unit tests
+//
+
+func TestMqtt5PublishCarriesMessageProperties(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		func(contract.Command) {},
+		Mqtt5Options{MessageExpiry: time.Hour, ResponseTopic: mqtt5CommandTopic})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx := WithTraceparent(WithCorrelationId(context.Background(), "correlation"), traceparent)
+
+	result := sut.EventSender(ctx, []byte(`{}`))
+
+	assert.True(t, result)
+	published := broker.Published()
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, mqtt5EventTopic, published[0].topic)
+	assert.Equal(t, "application/json", published[0].properties.contentType)
+	assert.Equal(t, uint32(3600), published[0].properties.messageExpiry)
+	assert.Equal(t, mqtt5CommandTopic, published[0].properties.responseTopic)
+	assert.Equal(t, []byte("correlation"), published[0].properties.correlationData)
+	assert.Equal(t, traceparent, published[0].properties.UserProperty("traceparent"))
+}
+
+func TestMqtt5CompressedPublishCarriesContentEncoding(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	sut, err := newMqtt5SUT(broker, stub.NewLoggerStub(), NewMetrics(), func(contract.Command) {}, Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	result := sut.EventSender(WithContentEncoding(context.Background(), CompressionGzip), []byte{0x1f, 0x8b})
+
+	assert.True(t, result)
+	published := broker.Published()
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, byte(0), published[0].properties.payloadFormat)
+	assert.Equal(t, CompressionGzip, published[0].properties.UserProperty("contentEncoding"))
+}
+
+func TestMqtt5AliasedTopicIsReplacedByAliasOnceEstablished(t *testing.T) {
+	broker := newBrokerImpl(t, 1)
+	defer broker.CleanUp()
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		func(contract.Command) {},
+		Mqtt5Options{TopicAliases: []string{mqtt5EventTopic, mqtt5NewDeviceTopic}})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	sut.EventSender(context.Background(), []byte(`{}`))
+	sut.EventSender(context.Background(), []byte(`{}`))
+	sut.NewDeviceSender(context.Background(), []byte(`{}`))
+
+	published := broker.Published()
+	assert.Equal(t, 3, len(published))
+	assert.Equal(t, mqtt5EventTopic, published[0].topic)
+	assert.Equal(t, uint16(1), published[0].properties.topicAlias)
+	assert.Equal(t, "", published[1].topic)
+	assert.Equal(t, uint16(1), published[1].properties.topicAlias)
+	assert.Equal(t, mqtt5NewDeviceTopic, published[2].topic)
+	assert.Equal(t, uint16(0), published[2].properties.topicAlias)
+}
+
+func TestMqtt5PublishIsWithheldWhileReceiveMaximumAwaitsAcknowledgement(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	broker.limit(1, 0)
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		func(contract.Command) {},
+		Mqtt5Options{AckTimeout: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+	broker.withholdAcks()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.False(t, sut.EventSender(context.Background(), []byte(`{}`)))
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	published := len(broker.Published())
+	wg.Wait()
+
+	assert.Equal(t, 1, published)
+}
+
+func TestMqtt5PublishExceedingMaximumPacketSizeIsNotWritten(t *testing.T) {
+	broker := newBrokerImpl(t, 1)
+	defer broker.CleanUp()
+	broker.limit(0, 64)
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		func(contract.Command) {},
+		Mqtt5Options{TopicAliases: []string{mqtt5EventTopic}})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	assert.False(t, sut.EventSender(context.Background(), make([]byte, 64)))
+	assert.True(t, sut.EventSender(context.Background(), []byte(`{}`)))
+
+	published := broker.Published()
+	assert.True(t, sut.Connected())
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, mqtt5EventTopic, published[0].topic)
+	assert.Equal(t, uint16(1), published[0].properties.topicAlias)
+}
+
+func TestMqtt5PublishFailureSurfacesReasonCode(t *testing.T) {
+	broker := newBrokerImpl(t, 0, 0x97)
+	defer broker.CleanUp()
+	loggingClient := stub.NewLoggerStub()
+	metrics := NewMetrics()
+	sut, err := newMqtt5SUT(broker, loggingClient, metrics, func(contract.Command) {}, Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	result := sut.EventSender(context.Background(), []byte(`{}`))
+
+	assert.False(t, result)
+	message := "mqtt send to events failed (reason code 0x97 quota exceeded: rejected by test)"
+	assert.True(t, loggingClient.SpecificFieldOccurred(message, LogFieldReasonCode, "0x97"))
+	assert.Equal(t, int64(1), metrics.Counter(MetricMqttSendFailures(mqtt5EventTopic)))
+	assert.True(t, sut.LastSent().IsZero())
+}
+
+func TestMqtt5CommandIsDeliveredWithResponseTopicCorrelationDataAndTraceparent(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	received := make(chan contract.Command, 1)
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		func(command contract.Command) { received <- command },
+		Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	broker.command("command", "responses", "correlation", traceparent)
+
+	select {
+	case command := <-received:
+		assert.Equal(t, "command", string(command.Payload))
+		assert.Equal(t, "responses", command.ResponseTopic)
+		assert.Equal(t, []byte("correlation"), command.CorrelationData)
+		assert.Equal(t, traceparent, command.Traceparent)
+		assert.True(t, command.Reply("responses")(WithCorrelationId(context.Background(), "correlation"), []byte(`{}`)))
+		published := broker.Published()
+		assert.Equal(t, 1, len(published))
+		assert.Equal(t, "responses", published[0].topic)
+		assert.Equal(t, []byte("correlation"), published[0].properties.correlationData)
+	case <-time.After(time.Second):
+		assert.Fail(t, "command not received")
+	}
+}
+
+func TestMqtt5CommandIsDroppedAndCountedWhenDispatchQueueIsFull(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	metrics := NewMetrics()
+	release := make(chan struct{})
+	sut, err := newMqtt5SUT(
+		broker,
+		stub.NewLoggerStub(),
+		metrics,
+		func(contract.Command) { <-release },
+		Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+	defer close(release)
+
+	for i := 0; i < mqtt5InboundQueueSize+2; i++ {
+		broker.command("command", "responses", "correlation", "")
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if metrics.Counter(MetricMqttCommandsDropped) > 0 {
+			break
+		}
+	}
+	assert.True(t, metrics.Counter(MetricMqttCommandsDropped) > 0)
+	assert.True(t, sut.Connected())
+}
+
+func TestMqtt5ReconnectsAndResubscribesWhenConnectionLost(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	metrics := NewMetrics()
+	sut, err := newMqtt5SUT(broker, stub.NewLoggerStub(), metrics, func(contract.Command) {}, Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+	assert.True(t, sut.Subscribed())
+
+	broker.drop()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if connects, subscribes := broker.Counts(); connects == 2 && subscribes == 2 && sut.Subscribed() {
+			break
+		}
+	}
+
+	connects, subscribes := broker.Counts()
+	assert.Equal(t, 2, connects)
+	assert.Equal(t, 2, subscribes)
+	assert.True(t, sut.Connected())
+	assert.True(t, sut.Subscribed())
+	assert.True(t, sut.EventSender(context.Background(), []byte(`{}`)))
+}
+
+func TestMqtt5DropsConnectionAndReconnectsWhenResubscribeFails(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	defer broker.CleanUp()
+	sut, err := newMqtt5SUT(broker, stub.NewLoggerStub(), NewMetrics(), func(contract.Command) {}, Mqtt5Options{})
+	assert.Nil(t, err)
+	defer sut.CleanUp()
+
+	broker.failSubscribes(0x80)
+	broker.drop()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if connects, subscribes := broker.Counts(); connects == 3 && subscribes == 3 && sut.Subscribed() {
+			break
+		}
+	}
+
+	connects, subscribes := broker.Counts()
+	assert.Equal(t, 3, connects)
+	assert.Equal(t, 3, subscribes)
+	assert.True(t, sut.Connected())
+	assert.True(t, sut.Subscribed())
+}
+
+func TestMqtt5ConnectFailureReturnsError(t *testing.T) {
+	broker := newBrokerImpl(t, 0)
+	broker.CleanUp()
+
+	sut, err := newMqtt5SUT(broker, stub.NewLoggerStub(), NewMetrics(), func(contract.Command) {}, Mqtt5Options{})
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestMqtt5RequestFailsWhenEveryPacketIdIsPending(t *testing.T) {
+	sut := &mqtt5{session: &mqtt5Session{}, pending: make(map[uint16]chan mqtt5AckPacket)}
+	for packetId := 1; packetId <= 65535; packetId++ {
+		sut.pending[uint16(packetId)] = make(chan mqtt5AckPacket, 1)
+	}
+
+	err := sut.request(context.Background(), false, func(*mqtt5Session, uint16) []byte { return nil })
+
+	assert.Equal(t, errMqtt5NoPacketId, err)
+}
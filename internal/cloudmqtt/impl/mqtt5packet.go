@@ -0,0 +1,612 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 control packet types.
+const (
+	mqtt5Connect     byte = 1
+	mqtt5Connack     byte = 2
+	mqtt5Publish     byte = 3
+	mqtt5Puback      byte = 4
+	mqtt5Subscribe   byte = 8
+	mqtt5Suback      byte = 9
+	mqtt5Unsubscribe byte = 10
+	mqtt5Unsuback    byte = 11
+	mqtt5Pingreq     byte = 12
+	mqtt5Pingresp    byte = 13
+	mqtt5Disconnect  byte = 14
+)
+
+// MQTT 5 property identifiers used by this client.
+const (
+	mqtt5PropertyPayloadFormat     byte = 0x01
+	mqtt5PropertyMessageExpiry     byte = 0x02
+	mqtt5PropertyContentType       byte = 0x03
+	mqtt5PropertyResponseTopic     byte = 0x08
+	mqtt5PropertyCorrelationData   byte = 0x09
+	mqtt5PropertyAssignedClientId  byte = 0x12
+	mqtt5PropertyServerKeepAlive   byte = 0x13
+	mqtt5PropertyReasonString      byte = 0x1F
+	mqtt5PropertyReceiveMaximum    byte = 0x21
+	mqtt5PropertyTopicAliasMaximum byte = 0x22
+	mqtt5PropertyTopicAlias        byte = 0x23
+	mqtt5PropertyUserProperty      byte = 0x26
+	mqtt5PropertyMaximumPacketSize byte = 0x27
+)
+
+const (
+	mqtt5ProtocolName    = "MQTT"
+	mqtt5ProtocolVersion = 5
+	mqtt5MaxPacketSize   = 268435455
+	mqtt5PayloadUtf8     = 1
+)
+
+// mqtt5PropertyKind is the encoding of a property's value.
+type mqtt5PropertyKind int
+
+const (
+	mqtt5KindByte mqtt5PropertyKind = iota
+	mqtt5KindUint16
+	mqtt5KindUint32
+	mqtt5KindVarint
+	mqtt5KindString
+	mqtt5KindBinary
+	mqtt5KindStringPair
+)
+
+// mqtt5PropertyKinds maps each property identifier defined by MQTT 5 to the encoding of its value; used to skip
+// properties this client does not use.
+var mqtt5PropertyKinds = map[byte]mqtt5PropertyKind{
+	0x01: mqtt5KindByte, 0x02: mqtt5KindUint32, 0x03: mqtt5KindString, 0x08: mqtt5KindString,
+	0x09: mqtt5KindBinary, 0x0B: mqtt5KindVarint, 0x11: mqtt5KindUint32, 0x12: mqtt5KindString,
+	0x13: mqtt5KindUint16, 0x15: mqtt5KindString, 0x16: mqtt5KindBinary, 0x17: mqtt5KindByte,
+	0x18: mqtt5KindUint32, 0x19: mqtt5KindByte, 0x1A: mqtt5KindString, 0x1C: mqtt5KindString,
+	0x1F: mqtt5KindString, 0x21: mqtt5KindUint16, 0x22: mqtt5KindUint16, 0x23: mqtt5KindUint16,
+	0x24: mqtt5KindByte, 0x25: mqtt5KindByte, 0x26: mqtt5KindStringPair, 0x27: mqtt5KindUint32,
+	0x28: mqtt5KindByte, 0x29: mqtt5KindByte, 0x2A: mqtt5KindByte,
+}
+
+// mqtt5ReasonCodeNames maps MQTT 5 reason codes to their names.
+var mqtt5ReasonCodeNames = map[byte]string{
+	0x00: "success",
+	0x01: "granted QoS 1",
+	0x02: "granted QoS 2",
+	0x04: "disconnect with will message",
+	0x10: "no matching subscribers",
+	0x11: "no subscription existed",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8B: "server shutting down",
+	0x8C: "bad authentication method",
+	0x8D: "keep alive timeout",
+	0x8E: "session taken over",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x92: "packet identifier not found",
+	0x93: "receive maximum exceeded",
+	0x94: "topic alias invalid",
+	0x95: "packet too large",
+	0x96: "message rate too high",
+	0x97: "quota exceeded",
+	0x98: "administrative action",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0x9F: "connection rate exceeded",
+	0xA0: "maximum connect time",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// errMqtt5Malformed is returned when a packet received from the MQTT server cannot be decoded.
+var errMqtt5Malformed = errors.New("malformed packet")
+
+// Mqtt5ReasonError describes a failure reported by the MQTT server with an MQTT 5 reason code.
+type Mqtt5ReasonError struct {
+	ReasonCode   byte
+	ReasonString string
+}
+
+// Error method implements error.
+func (e *Mqtt5ReasonError) Error() string {
+	name, ok := mqtt5ReasonCodeNames[e.ReasonCode]
+	if !ok {
+		name = "unknown reason code"
+	}
+	if len(e.ReasonString) > 0 {
+		return fmt.Sprintf("reason code 0x%02X %s: %s", e.ReasonCode, name, e.ReasonString)
+	}
+	return fmt.Sprintf("reason code 0x%02X %s", e.ReasonCode, name)
+}
+
+// mqtt5Properties holds the MQTT 5 properties used by this client; zero values are not encoded.
+type mqtt5Properties struct {
+	payloadFormat     byte
+	messageExpiry     uint32
+	contentType       string
+	responseTopic     string
+	correlationData   []byte
+	assignedClientId  string
+	serverKeepAlive   uint16
+	reasonString      string
+	receiveMaximum    uint16
+	topicAliasMaximum uint16
+	topicAlias        uint16
+	userProperties    [][2]string
+	maximumPacketSize uint32
+}
+
+// UserProperty method returns the value of the named user property (empty if not present).
+func (p *mqtt5Properties) UserProperty(name string) string {
+	for _, pair := range p.userProperties {
+		if pair[0] == name {
+			return pair[1]
+		}
+	}
+	return ""
+}
+
+// mqtt5Writer accumulates the encoding of a packet's variable header and payload.
+type mqtt5Writer struct {
+	bytes.Buffer
+}
+
+func (w *mqtt5Writer) writeUint16(value uint16) {
+	_ = binary.Write(w, binary.BigEndian, value)
+}
+
+func (w *mqtt5Writer) writeUint32(value uint32) {
+	_ = binary.Write(w, binary.BigEndian, value)
+}
+
+func (w *mqtt5Writer) writeVarint(value int) {
+	for {
+		encoded := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			encoded |= 0x80
+		}
+		w.WriteByte(encoded)
+		if value == 0 {
+			return
+		}
+	}
+}
+
+func (w *mqtt5Writer) writeBinary(value []byte) {
+	w.writeUint16(uint16(len(value)))
+	w.Write(value)
+}
+
+func (w *mqtt5Writer) writeString(value string) {
+	w.writeBinary([]byte(value))
+}
+
+// writeProperties method writes the length-prefixed encoding of properties.
+func (w *mqtt5Writer) writeProperties(p mqtt5Properties) {
+	var encoded mqtt5Writer
+	if p.payloadFormat != 0 {
+		encoded.WriteByte(mqtt5PropertyPayloadFormat)
+		encoded.WriteByte(p.payloadFormat)
+	}
+	if p.messageExpiry != 0 {
+		encoded.WriteByte(mqtt5PropertyMessageExpiry)
+		encoded.writeUint32(p.messageExpiry)
+	}
+	if len(p.contentType) > 0 {
+		encoded.WriteByte(mqtt5PropertyContentType)
+		encoded.writeString(p.contentType)
+	}
+	if len(p.responseTopic) > 0 {
+		encoded.WriteByte(mqtt5PropertyResponseTopic)
+		encoded.writeString(p.responseTopic)
+	}
+	if len(p.correlationData) > 0 {
+		encoded.WriteByte(mqtt5PropertyCorrelationData)
+		encoded.writeBinary(p.correlationData)
+	}
+	if len(p.reasonString) > 0 {
+		encoded.WriteByte(mqtt5PropertyReasonString)
+		encoded.writeString(p.reasonString)
+	}
+	if p.receiveMaximum != 0 {
+		encoded.WriteByte(mqtt5PropertyReceiveMaximum)
+		encoded.writeUint16(p.receiveMaximum)
+	}
+	if p.topicAliasMaximum != 0 {
+		encoded.WriteByte(mqtt5PropertyTopicAliasMaximum)
+		encoded.writeUint16(p.topicAliasMaximum)
+	}
+	if p.topicAlias != 0 {
+		encoded.WriteByte(mqtt5PropertyTopicAlias)
+		encoded.writeUint16(p.topicAlias)
+	}
+	for _, pair := range p.userProperties {
+		encoded.WriteByte(mqtt5PropertyUserProperty)
+		encoded.writeString(pair[0])
+		encoded.writeString(pair[1])
+	}
+	if p.maximumPacketSize != 0 {
+		encoded.WriteByte(mqtt5PropertyMaximumPacketSize)
+		encoded.writeUint32(p.maximumPacketSize)
+	}
+	w.writeVarint(encoded.Len())
+	w.Write(encoded.Bytes())
+}
+
+// packet method returns the complete packet with the specified type and flags whose variable header and payload
+// have been written to w.
+func (w *mqtt5Writer) packet(packetType byte, flags byte) []byte {
+	var packet mqtt5Writer
+	packet.WriteByte(packetType<<4 | flags)
+	packet.writeVarint(w.Len())
+	packet.Write(w.Bytes())
+	return packet.Bytes()
+}
+
+// mqtt5Reader decodes a packet's variable header and payload.
+type mqtt5Reader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqtt5Reader) take(size int) []byte {
+	if r.err != nil || size > len(r.data) {
+		r.err = errMqtt5Malformed
+		return nil
+	}
+	taken := r.data[:size]
+	r.data = r.data[size:]
+	return taken
+}
+
+func (r *mqtt5Reader) readByte() byte {
+	if taken := r.take(1); taken != nil {
+		return taken[0]
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) readUint16() uint16 {
+	if taken := r.take(2); taken != nil {
+		return binary.BigEndian.Uint16(taken)
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) readUint32() uint32 {
+	if taken := r.take(4); taken != nil {
+		return binary.BigEndian.Uint32(taken)
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) readVarint() int {
+	value, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		encoded := r.readByte()
+		value += int(encoded&0x7F) * multiplier
+		if encoded&0x80 == 0 {
+			return value
+		}
+		multiplier *= 128
+	}
+	r.err = errMqtt5Malformed
+	return 0
+}
+
+func (r *mqtt5Reader) readBinary() []byte {
+	return append([]byte(nil), r.take(int(r.readUint16()))...)
+}
+
+func (r *mqtt5Reader) readString() string {
+	return string(r.take(int(r.readUint16())))
+}
+
+// readProperties method decodes length-prefixed properties; properties this client does not use are skipped.
+func (r *mqtt5Reader) readProperties() mqtt5Properties {
+	var p mqtt5Properties
+	length := r.readVarint()
+	properties := &mqtt5Reader{data: r.take(length)}
+	for r.err == nil && properties.err == nil && len(properties.data) > 0 {
+		id := properties.readByte()
+		switch id {
+		case mqtt5PropertyPayloadFormat:
+			p.payloadFormat = properties.readByte()
+		case mqtt5PropertyMessageExpiry:
+			p.messageExpiry = properties.readUint32()
+		case mqtt5PropertyContentType:
+			p.contentType = properties.readString()
+		case mqtt5PropertyResponseTopic:
+			p.responseTopic = properties.readString()
+		case mqtt5PropertyCorrelationData:
+			p.correlationData = properties.readBinary()
+		case mqtt5PropertyAssignedClientId:
+			p.assignedClientId = properties.readString()
+		case mqtt5PropertyServerKeepAlive:
+			p.serverKeepAlive = properties.readUint16()
+		case mqtt5PropertyReasonString:
+			p.reasonString = properties.readString()
+		case mqtt5PropertyReceiveMaximum:
+			p.receiveMaximum = properties.readUint16()
+		case mqtt5PropertyTopicAliasMaximum:
+			p.topicAliasMaximum = properties.readUint16()
+		case mqtt5PropertyTopicAlias:
+			p.topicAlias = properties.readUint16()
+		case mqtt5PropertyUserProperty:
+			p.userProperties = append(p.userProperties, [2]string{properties.readString(), properties.readString()})
+		case mqtt5PropertyMaximumPacketSize:
+			p.maximumPacketSize = properties.readUint32()
+		default:
+			kind, ok := mqtt5PropertyKinds[id]
+			if !ok {
+				properties.err = errMqtt5Malformed
+				break
+			}
+			properties.skip(kind)
+		}
+	}
+	if r.err == nil {
+		r.err = properties.err
+	}
+	return p
+}
+
+// skip method skips a property value of the specified kind.
+func (r *mqtt5Reader) skip(kind mqtt5PropertyKind) {
+	switch kind {
+	case mqtt5KindByte:
+		r.readByte()
+	case mqtt5KindUint16:
+		r.readUint16()
+	case mqtt5KindUint32:
+		r.readUint32()
+	case mqtt5KindVarint:
+		r.readVarint()
+	case mqtt5KindString, mqtt5KindBinary:
+		r.readBinary()
+	case mqtt5KindStringPair:
+		r.readBinary()
+		r.readBinary()
+	}
+}
+
+// mqtt5ConnectPacket is a CONNECT packet.
+type mqtt5ConnectPacket struct {
+	clientId   string
+	userName   string
+	password   string
+	keepAlive  uint16
+	properties mqtt5Properties
+}
+
+// encode method returns the encoded packet.
+func (p *mqtt5ConnectPacket) encode() []byte {
+	var w mqtt5Writer
+	w.writeString(mqtt5ProtocolName)
+	w.WriteByte(mqtt5ProtocolVersion)
+	flags := byte(0x02) // clean start
+	if len(p.userName) > 0 {
+		flags |= 0x80
+	}
+	if len(p.password) > 0 {
+		flags |= 0x40
+	}
+	w.WriteByte(flags)
+	w.writeUint16(p.keepAlive)
+	w.writeProperties(p.properties)
+	w.writeString(p.clientId)
+	if len(p.userName) > 0 {
+		w.writeString(p.userName)
+	}
+	if len(p.password) > 0 {
+		w.writeString(p.password)
+	}
+	return w.packet(mqtt5Connect, 0)
+}
+
+// mqtt5ConnackPacket is a CONNACK packet.
+type mqtt5ConnackPacket struct {
+	sessionPresent bool
+	reasonCode     byte
+	properties     mqtt5Properties
+}
+
+// decodeMqtt5Connack function decodes a CONNACK packet's variable header.
+func decodeMqtt5Connack(body []byte) (mqtt5ConnackPacket, error) {
+	r := &mqtt5Reader{data: body}
+	p := mqtt5ConnackPacket{sessionPresent: r.readByte()&0x01 != 0, reasonCode: r.readByte()}
+	if len(r.data) > 0 {
+		p.properties = r.readProperties()
+	}
+	return p, r.err
+}
+
+// mqtt5PublishPacket is a PUBLISH packet.
+type mqtt5PublishPacket struct {
+	topic      string
+	qos        byte
+	retain     bool
+	packetId   uint16
+	properties mqtt5Properties
+	payload    []byte
+}
+
+// encode method returns the encoded packet.
+func (p *mqtt5PublishPacket) encode() []byte {
+	var w mqtt5Writer
+	w.writeString(p.topic)
+	if p.qos > 0 {
+		w.writeUint16(p.packetId)
+	}
+	w.writeProperties(p.properties)
+	w.Write(p.payload)
+
+	flags := p.qos << 1
+	if p.retain {
+		flags |= 0x01
+	}
+	return w.packet(mqtt5Publish, flags)
+}
+
+// decodeMqtt5Publish function decodes a PUBLISH packet with the specified fixed header flags.
+func decodeMqtt5Publish(flags byte, body []byte) (mqtt5PublishPacket, error) {
+	r := &mqtt5Reader{data: body}
+	p := mqtt5PublishPacket{topic: r.readString(), qos: (flags >> 1) & 0x03, retain: flags&0x01 != 0}
+	if p.qos > 0 {
+		p.packetId = r.readUint16()
+	}
+	p.properties = r.readProperties()
+	p.payload = append([]byte(nil), r.data...)
+	return p, r.err
+}
+
+// mqtt5AckPacket is a PUBACK, SUBACK, or UNSUBACK packet; SUBACK and UNSUBACK carry a reason code per topic filter,
+// of which only the first is retained.
+type mqtt5AckPacket struct {
+	packetId   uint16
+	reasonCode byte
+	properties mqtt5Properties
+}
+
+// encodeMqtt5Puback function returns an encoded PUBACK packet acknowledging packetId successfully.
+func encodeMqtt5Puback(packetId uint16) []byte {
+	var w mqtt5Writer
+	w.writeUint16(packetId)
+	return w.packet(mqtt5Puback, 0)
+}
+
+// decodeMqtt5Puback function decodes a PUBACK packet; the reason code and properties are omitted for success.
+func decodeMqtt5Puback(body []byte) (mqtt5AckPacket, error) {
+	r := &mqtt5Reader{data: body}
+	p := mqtt5AckPacket{packetId: r.readUint16()}
+	if len(r.data) > 0 {
+		p.reasonCode = r.readByte()
+	}
+	if len(r.data) > 0 {
+		p.properties = r.readProperties()
+	}
+	return p, r.err
+}
+
+// decodeMqtt5Suback function decodes a SUBACK or UNSUBACK packet.
+func decodeMqtt5Suback(body []byte) (mqtt5AckPacket, error) {
+	r := &mqtt5Reader{data: body}
+	p := mqtt5AckPacket{packetId: r.readUint16()}
+	p.properties = r.readProperties()
+	p.reasonCode = r.readByte()
+	return p, r.err
+}
+
+// encodeMqtt5Subscribe function returns an encoded SUBSCRIBE packet for topicFilter with the specified maximum
+// quality of service.
+func encodeMqtt5Subscribe(packetId uint16, topicFilter string, qos byte) []byte {
+	var w mqtt5Writer
+	w.writeUint16(packetId)
+	w.writeProperties(mqtt5Properties{})
+	w.writeString(topicFilter)
+	w.WriteByte(qos)
+	return w.packet(mqtt5Subscribe, 0x02)
+}
+
+// encodeMqtt5Unsubscribe function returns an encoded UNSUBSCRIBE packet for topicFilter.
+func encodeMqtt5Unsubscribe(packetId uint16, topicFilter string) []byte {
+	var w mqtt5Writer
+	w.writeUint16(packetId)
+	w.writeProperties(mqtt5Properties{})
+	w.writeString(topicFilter)
+	return w.packet(mqtt5Unsubscribe, 0x02)
+}
+
+// encodeMqtt5Pingreq function returns an encoded PINGREQ packet.
+func encodeMqtt5Pingreq() []byte {
+	var w mqtt5Writer
+	return w.packet(mqtt5Pingreq, 0)
+}
+
+// encodeMqtt5Disconnect function returns an encoded DISCONNECT packet for a normal disconnection.
+func encodeMqtt5Disconnect() []byte {
+	var w mqtt5Writer
+	return w.packet(mqtt5Disconnect, 0)
+}
+
+// decodeMqtt5Disconnect function decodes a DISCONNECT packet; the reason code and properties are omitted for a
+// normal disconnection.
+func decodeMqtt5Disconnect(body []byte) (mqtt5AckPacket, error) {
+	r := &mqtt5Reader{data: body}
+	var p mqtt5AckPacket
+	if len(r.data) > 0 {
+		p.reasonCode = r.readByte()
+	}
+	if len(r.data) > 0 {
+		p.properties = r.readProperties()
+	}
+	return p, r.err
+}
+
+// readMqtt5Packet function reads a packet and returns its type, fixed header flags, and variable header and payload.
+func readMqtt5Packet(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errMqtt5Malformed
+		}
+		encoded, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(encoded&0x7F) * multiplier
+		if encoded&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > mqtt5MaxPacketSize {
+		return 0, 0, nil, errMqtt5Malformed
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0F, body, nil
+}
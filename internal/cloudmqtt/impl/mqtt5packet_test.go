@@ -0,0 +1,124 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//
+//  utility and helper functions
+//
+
+// readPacket decodes the fixed header of packet and returns its type, flags, and variable header and payload.
+func readPacket(t *testing.T, packet []byte) (byte, byte, []byte) {
+	packetType, flags, body, err := readMqtt5Packet(bufio.NewReader(bytes.NewReader(packet)))
+	assert.Nil(t, err)
+	return packetType, flags, body
+}
+
+//
+//  unit tests
+//
+
+func TestMqtt5PublishRoundTrip(t *testing.T) {
+	expected := mqtt5PublishPacket{
+		topic:    "events",
+		qos:      1,
+		retain:   true,
+		packetId: 258,
+		properties: mqtt5Properties{
+			payloadFormat:   mqtt5PayloadUtf8,
+			messageExpiry:   3600,
+			contentType:     "application/json",
+			responseTopic:   "commands",
+			correlationData: []byte("correlation"),
+			topicAlias:      3,
+			userProperties:  [][2]string{{"traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+		},
+		payload: []byte(`{"device":"device"}`),
+	}
+	packet := expected.encode()
+
+	packetType, flags, body := readPacket(t, packet)
+	actual, err := decodeMqtt5Publish(flags, body)
+
+	assert.Nil(t, err)
+	assert.Equal(t, mqtt5Publish, packetType)
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected.properties.userProperties[0][1], actual.properties.UserProperty("traceparent"))
+}
+
+func TestMqtt5RemainingLengthUsesVariableByteInteger(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		var w mqtt5Writer
+		w.Write(make([]byte, size))
+
+		_, _, body := readPacket(t, w.packet(mqtt5Publish, 0))
+
+		assert.Equal(t, size, len(body))
+	}
+}
+
+func TestMqtt5ReadPropertiesSkipsUnusedProperties(t *testing.T) {
+	var w mqtt5Writer
+	w.writeVarint(14)
+	w.WriteByte(0x11) // session expiry interval
+	w.writeUint32(60)
+	w.WriteByte(0x24) // maximum QoS
+	w.WriteByte(1)
+	w.WriteByte(mqtt5PropertyTopicAliasMaximum)
+	w.writeUint16(10)
+	w.WriteByte(0x28) // wildcard subscription available
+	w.WriteByte(1)
+	w.WriteByte(0x2A) // shared subscription available
+	w.WriteByte(0)
+
+	r := &mqtt5Reader{data: w.Bytes()}
+	properties := r.readProperties()
+
+	assert.Nil(t, r.err)
+	assert.Equal(t, uint16(10), properties.topicAliasMaximum)
+}
+
+func TestMqtt5ReadPropertiesRejectsUnknownProperty(t *testing.T) {
+	r := &mqtt5Reader{data: []byte{2, 0x7F, 0}}
+	r.readProperties()
+
+	assert.Equal(t, errMqtt5Malformed, r.err)
+}
+
+func TestMqtt5DecodePubackWithoutReasonCodeIsSuccess(t *testing.T) {
+	_, _, body := readPacket(t, encodeMqtt5Puback(7))
+	ack, err := decodeMqtt5Puback(body)
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(7), ack.packetId)
+	assert.Equal(t, byte(0), ack.reasonCode)
+}
+
+func TestMqtt5DecodeTruncatedPacketFails(t *testing.T) {
+	_, err := decodeMqtt5Connack([]byte{0})
+
+	assert.Equal(t, errMqtt5Malformed, err)
+}
+
+func TestMqtt5ReasonErrorNamesReasonCode(t *testing.T) {
+	assert.Equal(t, "reason code 0x97 quota exceeded: limit 10/s", (&Mqtt5ReasonError{0x97, "limit 10/s"}).Error())
+	assert.Equal(t, "reason code 0x87 not authorized", (&Mqtt5ReasonError{ReasonCode: 0x87}).Error())
+}
@@ -22,27 +22,49 @@ import (
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
 )
 
+const (
+	MetricNotificationsSucceeded = `cloudmqtt_notifications_total{result="success"}`
+	MetricNotificationsFailed    = `cloudmqtt_notifications_total{result="failure"}`
+	MetricDeviceMarshalFailures  = `cloudmqtt_marshal_failures_total{type="device"}`
+)
+
 // notify is a receiver wrapping a metadata query-and-forward implementation.
 type notify struct {
-	loggingClient  logger.LoggingClient
-	send           contract.Sender
-	marshal        contract.Marshaller
-	metadataClient contract.MetadataClient
+	loggingClient     logger.LoggingClient
+	metrics           contract.Metrics
+	tracer            contract.Tracer
+	send              contract.Sender
+	marshal           contract.Marshaller
+	metadataClient    contract.MetadataClient
+	profileClient     contract.DeviceProfileClient
+	serviceClient     contract.DeviceServiceClient
+	addressableClient contract.AddressableClient
 }
 
 // NewNotifier is a constructor that returns an instance of notify configured to communicate with a
-// EdgeX core-metadata instance.
+// EdgeX core-metadata instance.  The device's profile, device service, and device service's addressable are embedded
+// in the forwarded metadata when profileClient, serviceClient, and addressableClient (respectively) are not nil.
 func NewNotifier(
 	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
 	send contract.Sender,
 	marshal contract.Marshaller,
-	metadataClient contract.MetadataClient) *notify {
+	metadataClient contract.MetadataClient,
+	profileClient contract.DeviceProfileClient,
+	serviceClient contract.DeviceServiceClient,
+	addressableClient contract.AddressableClient) *notify {
 
 	return &notify{
-		loggingClient:  loggingClient,
-		send:           send,
-		marshal:        marshal,
-		metadataClient: metadataClient,
+		loggingClient:     loggingClient,
+		metrics:           metrics,
+		tracer:            tracer,
+		send:              send,
+		marshal:           marshal,
+		metadataClient:    metadataClient,
+		profileClient:     profileClient,
+		serviceClient:     serviceClient,
+		addressableClient: addressableClient,
 	}
 }
 
@@ -51,25 +73,151 @@ func deviceCallFailedLogMessage(eventId string, errorMessage string) string {
 	return fmt.Sprintf("device call failed for %s (%s)", eventId, errorMessage)
 }
 
+// embedCallFailedLogMessage function formats and returns the log message for when a call to load metadata to embed in
+// the device's metadata fails.
+func embedCallFailedLogMessage(kind string, name string, eventId string, errorMessage string) string {
+	return fmt.Sprintf("%s call failed for %s for %s (%s)", kind, name, eventId, errorMessage)
+}
+
 // marshalFailedLogMessage function formats and returns the log message for when an attempt to marshal a type fails.
 func marshalFailedLogMessage(eventId string, errorMessage string) string {
 	return fmt.Sprintf("marshal failed for %s (%s)", eventId, errorMessage)
 }
 
+// abandonable function calls f in a goroutine and returns its result, or returns ctx's error if ctx is done first; the
+// EdgeX clients do not honor ctx themselves.
+func abandonable(ctx context.Context, f func() error) error {
+	results := make(chan error, 1)
+	go func() {
+		results <- f()
+	}()
+
+	select {
+	case err := <-results:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logFailure method logs a failed notification with the correlation ID carried by ctx.
+func (n *notify) logFailure(ctx context.Context, msg string, eventId string, deviceName string, err error) {
+	n.loggingClient.Error(
+		msg,
+		LogFieldCorrelationId, CorrelationId(ctx),
+		LogFieldEventId, eventId,
+		LogFieldDevice, deviceName,
+		LogFieldError, err.Error())
+}
+
+// lookup method calls f as a span named name, a child of the span carried by ctx, abandoning the call if ctx is done
+// first.
+func (n *notify) lookup(
+	ctx context.Context,
+	name string,
+	resourceName string,
+	f func(ctx context.Context) error) error {
+
+	ctx, end := n.tracer.Start(ctx, name, "name", resourceName)
+	err := abandonable(ctx, func() error { return f(ctx) })
+	end(err)
+	return err
+}
+
+// embed method replaces the device's profile, device service, and addressable with their full definitions loaded from
+// the EdgeX core-metadata instance, as configured.
+func (n *notify) embed(ctx context.Context, eventId string, device *models.Device) error {
+	if n.profileClient != nil && len(device.Profile.Name) > 0 {
+		var profile models.DeviceProfile
+		err := n.lookup(ctx, "metadata.DeviceProfileForName", device.Profile.Name, func(ctx context.Context) (err error) {
+			profile, err = n.profileClient.DeviceProfileForName(device.Profile.Name, ctx)
+			return
+		})
+		if err != nil {
+			msg := embedCallFailedLogMessage("profile", device.Profile.Name, eventId, err.Error())
+			n.logFailure(ctx, msg, eventId, device.Name, err)
+			return err
+		}
+		device.Profile = profile
+	}
+
+	if n.serviceClient != nil && len(device.Service.Name) > 0 {
+		var service models.DeviceService
+		err := n.lookup(ctx, "metadata.DeviceServiceForName", device.Service.Name, func(ctx context.Context) (err error) {
+			service, err = n.serviceClient.DeviceServiceForName(device.Service.Name, ctx)
+			return
+		})
+		if err != nil {
+			msg := embedCallFailedLogMessage("service", device.Service.Name, eventId, err.Error())
+			n.logFailure(ctx, msg, eventId, device.Name, err)
+			return err
+		}
+		device.Service = service
+	}
+
+	if n.addressableClient != nil && len(device.Service.Addressable.Name) > 0 {
+		name := device.Service.Addressable.Name
+		var addressable models.Addressable
+		err := n.lookup(ctx, "metadata.AddressableForName", name, func(ctx context.Context) (err error) {
+			addressable, err = n.addressableClient.AddressableForName(name, ctx)
+			return
+		})
+		if err != nil {
+			msg := embedCallFailedLogMessage("addressable", name, eventId, err.Error())
+			n.logFailure(ctx, msg, eventId, device.Name, err)
+			return err
+		}
+		device.Service.Addressable = addressable
+	}
+	return nil
+}
+
 // Notify method implements Notifier contract; it queries an EdgeX core-metadata instance for a specific device's
-// metadata and forwards the result northbound.
-func (n *notify) Notify(event *models.Event) bool {
-	result, err := n.metadataClient.DeviceForName(event.Device, context.Background())
+// metadata and forwards the result northbound.  The queries are abandoned if ctx is done first; the notification is
+// traced as a span, a child of the span carried by ctx.
+func (n *notify) Notify(ctx context.Context, event *models.Event) bool {
+	ctx, end := n.tracer.Start(
+		ctx,
+		"notify.Notify",
+		LogFieldCorrelationId, CorrelationId(ctx),
+		LogFieldEventId, event.ID,
+		LogFieldDevice, event.Device)
+	err := n.forward(ctx, event)
+	end(err)
+
+	if err == nil {
+		n.metrics.Increment(MetricNotificationsSucceeded, 1)
+		return true
+	}
+	n.metrics.Increment(MetricNotificationsFailed, 1)
+	return false
+}
+
+// forward method implements Notify().
+func (n *notify) forward(ctx context.Context, event *models.Event) error {
+	var result models.Device
+	err := n.lookup(ctx, "metadata.DeviceForName", event.Device, func(ctx context.Context) (err error) {
+		result, err = n.metadataClient.DeviceForName(event.Device, ctx)
+		return
+	})
 	if err != nil {
-		n.loggingClient.Error(deviceCallFailedLogMessage(event.ID, err.Error()))
-		return false
+		n.logFailure(ctx, deviceCallFailedLogMessage(event.ID, err.Error()), event.ID, event.Device, err)
+		return err
+	}
+
+	if err := n.embed(ctx, event.ID, &result); err != nil {
+		return err
 	}
 
 	bytes, err := n.marshal(result)
 	if err != nil {
-		n.loggingClient.Error(marshalFailedLogMessage(event.ID, err.Error()))
-		return false
+		n.logFailure(ctx, marshalFailedLogMessage(event.ID, err.Error()), event.ID, event.Device, err)
+		n.metrics.Increment(MetricDeviceMarshalFailures, 1)
+		return err
 	}
 
-	return n.send(bytes)
+	if !n.send(ctx, bytes) {
+		return fmt.Errorf("send failed")
+	}
+	return nil
 }
@@ -85,6 +85,49 @@ func newMetadataClientImplReturnSuccess() contract.MetadataClient {
 	return newMetadataClientImpl(newDevice("device"), nil)
 }
 
+// blockingMetadataClientImpl blocks each call until release is closed.
+type blockingMetadataClientImpl struct {
+	release chan struct{}
+}
+
+func newBlockingMetadataClientImpl(release chan struct{}) *blockingMetadataClientImpl {
+	return &blockingMetadataClientImpl{release: release}
+}
+
+func (c *blockingMetadataClientImpl) DeviceForName(name string, ctx context.Context) (models.Device, error) {
+	<-c.release
+	return newDevice(name), nil
+}
+
+// embedClientImpl implements DeviceProfileClient, DeviceServiceClient, and AddressableClient; each returns a
+// definition named as requested with a description identifying it as loaded, or err if not nil.
+type embedClientImpl struct {
+	err error
+}
+
+func (c *embedClientImpl) DeviceProfileForName(name string, ctx context.Context) (models.DeviceProfile, error) {
+	profile := models.DeviceProfile{Name: name, DeviceResources: []models.DeviceResource{{Name: "resource"}}}
+	profile.Description = "loaded"
+	return profile, c.err
+}
+
+func (c *embedClientImpl) DeviceServiceForName(name string, ctx context.Context) (models.DeviceService, error) {
+	service := models.DeviceService{Name: name, Addressable: models.Addressable{Name: name + "Addressable"}}
+	service.Description = "loaded"
+	return service, c.err
+}
+
+func (c *embedClientImpl) AddressableForName(name string, ctx context.Context) (models.Addressable, error) {
+	return models.Addressable{Name: name, Address: "loaded"}, c.err
+}
+
+func newDeviceWithReferences(deviceName string) models.Device {
+	device := newDevice(deviceName)
+	device.Profile = models.DeviceProfile{Name: "profile"}
+	device.Service = models.DeviceService{Name: "service"}
+	return device
+}
+
 //
 //  SUT factory
 //
@@ -95,7 +138,25 @@ func newNotifierSUT(
 	marshal contract.Marshaller,
 	metadataClient contract.MetadataClient) *notify {
 
-	return NewNotifier(loggingClient, sender, marshal, metadataClient)
+	return NewNotifier(loggingClient, NewMetrics(), NewNopTracer(), sender, marshal, metadataClient, nil, nil, nil)
+}
+
+func newEmbeddingNotifierSUT(
+	loggingClient logger.LoggingClient,
+	sender contract.Sender,
+	metadataClient contract.MetadataClient,
+	embedClient *embedClientImpl) *notify {
+
+	return NewNotifier(
+		loggingClient,
+		NewMetrics(),
+		NewNopTracer(),
+		sender,
+		json.Marshal,
+		metadataClient,
+		embedClient,
+		embedClient,
+		embedClient)
 }
 
 //
@@ -110,7 +171,7 @@ func TestNotifyCallToMetadataClientFailureReturnsFalse(t *testing.T) {
 		newMetadataClientImplReturnFailure(uuid.New().String()))
 	event := stub.NewEvent()
 
-	result := sut.Notify(&event)
+	result := sut.Notify(context.Background(), &event)
 
 	assert.False(t, result)
 }
@@ -125,7 +186,7 @@ func TestNotifyCallToMetadataClientFailureLogsError(t *testing.T) {
 		newMetadataClientImplReturnFailure(errorMessage))
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.True(t, loggingClient.SpecificErrorOccurred(deviceCallFailedLogMessage(event.ID, errorMessage)))
 }
@@ -139,7 +200,7 @@ func TestSendNotCalledWhenCallToMetadataClientFails(t *testing.T) {
 		newMetadataClientImplReturnFailure(uuid.New().String()))
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.Equal(t, 0, sender.SendCalledCount)
 }
@@ -149,7 +210,7 @@ func TestNotifyCallToMetadataClientSuccessDoesNotLogError(t *testing.T) {
 	sut := newNotifierSUT(loggingClient, stub.NewSenderImpl().Send, json.Marshal, newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.False(t, loggingClient.ErrorsOccurred())
 }
@@ -159,7 +220,7 @@ func TestNotifyCallToMetadataClientSuccessReturnsTrue(t *testing.T) {
 	sut := newNotifierSUT(loggingClient, stub.NewSenderImpl().Send, json.Marshal, newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	result := sut.Notify(&event)
+	result := sut.Notify(context.Background(), &event)
 
 	assert.True(t, result)
 }
@@ -172,7 +233,7 @@ func TestNotifyCallToMarshalFailureReturnsFalse(t *testing.T) {
 		newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	result := sut.Notify(&event)
+	result := sut.Notify(context.Background(), &event)
 
 	assert.False(t, result)
 }
@@ -186,7 +247,7 @@ func TestNotifyCallToMarshalFailureLogsError(t *testing.T) {
 		newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.True(t, loggingClient.SpecificErrorOccurred(marshalFailedLogMessage(event.ID, helper.JsonMarshalFuncFailureMessage)))
 }
@@ -200,7 +261,7 @@ func TestSendNotCalledWhenCallToMarshalFails(t *testing.T) {
 		newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.Equal(t, 0, sender.SendCalledCount)
 }
@@ -210,7 +271,7 @@ func TestNotifyCallToMarshalSuccessDoesNotLogError(t *testing.T) {
 	sut := newNotifierSUT(loggingClient, stub.NewSenderImpl().Send, json.Marshal, newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.False(t, loggingClient.ErrorsOccurred())
 }
@@ -220,7 +281,7 @@ func TestNotifyCallToMarshalSuccessReturnsTrue(t *testing.T) {
 	sut := newNotifierSUT(loggingClient, stub.NewSenderImpl().Send, json.Marshal, newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	result := sut.Notify(&event)
+	result := sut.Notify(context.Background(), &event)
 
 	assert.True(t, result)
 }
@@ -230,7 +291,152 @@ func TestNotifyCallsSenderOnce(t *testing.T) {
 	sut := newNotifierSUT(stub.NewLoggerStub(), sender.Send, json.Marshal, newMetadataClientImplReturnSuccess())
 	event := stub.NewEvent()
 
-	sut.Notify(&event)
+	sut.Notify(context.Background(), &event)
 
 	assert.Equal(t, 1, sender.SendCalledCount)
 }
+
+func TestNotifyCallToMetadataClientAbandonedWhenContextDone(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	sender := stub.NewSenderImpl()
+	release := make(chan struct{})
+	defer close(release)
+	sut := newNotifierSUT(loggingClient, sender.Send, json.Marshal, newBlockingMetadataClientImpl(release))
+	event := stub.NewEvent()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := sut.Notify(ctx, &event)
+
+	assert.False(t, result)
+	assert.Equal(t, 0, sender.SendCalledCount)
+	assert.True(t, loggingClient.SpecificErrorOccurred(deviceCallFailedLogMessage(event.ID, context.Canceled.Error())))
+}
+
+func TestNotifyEmbedsProfileServiceAndAddressable(t *testing.T) {
+	sender := stub.NewSenderImpl()
+	sut := newEmbeddingNotifierSUT(
+		stub.NewLoggerStub(),
+		sender.Send,
+		newMetadataClientImpl(newDeviceWithReferences("device"), nil),
+		&embedClientImpl{})
+	event := stub.NewEventForDevice("device")
+
+	result := sut.Notify(context.Background(), &event)
+
+	assert.True(t, result)
+	var device struct {
+		Profile struct {
+			Description     string
+			DeviceResources []struct{ Name string }
+		}
+		Service struct {
+			Description string
+			Addressable struct{ Name, Address string }
+		}
+	}
+	assert.Nil(t, json.Unmarshal(sender.Sent[0].Data, &device))
+	assert.Equal(t, "loaded", device.Profile.Description)
+	assert.Equal(t, "resource", device.Profile.DeviceResources[0].Name)
+	assert.Equal(t, "loaded", device.Service.Description)
+	assert.Equal(t, "serviceAddressable", device.Service.Addressable.Name)
+	assert.Equal(t, "loaded", device.Service.Addressable.Address)
+}
+
+func TestNotifyEmbedCallFailureLogsErrorAndReturnsFalse(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	sender := stub.NewSenderImpl()
+	sut := newEmbeddingNotifierSUT(
+		loggingClient,
+		sender.Send,
+		newMetadataClientImpl(newDeviceWithReferences("device"), nil),
+		&embedClientImpl{err: errors.New("errorMessage")})
+	event := stub.NewEventForDevice("device")
+
+	result := sut.Notify(context.Background(), &event)
+
+	assert.False(t, result)
+	assert.Equal(t, 0, sender.SendCalledCount)
+	assert.True(t, loggingClient.SpecificErrorOccurred(
+		embedCallFailedLogMessage("profile", "profile", event.ID, "errorMessage")))
+}
+
+func TestNotifyCountsSuccessesAndFailures(t *testing.T) {
+	metrics := NewMetrics()
+	succeeding := NewNotifier(
+		stub.NewLoggerStub(),
+		metrics,
+		NewNopTracer(),
+		stub.NewSenderImpl().Send,
+		json.Marshal,
+		newMetadataClientImplReturnSuccess(),
+		nil,
+		nil,
+		nil)
+	failing := NewNotifier(
+		stub.NewLoggerStub(),
+		metrics,
+		NewNopTracer(),
+		stub.NewSenderImpl().Send,
+		json.Marshal,
+		newMetadataClientImplReturnFailure("errorMessage"),
+		nil,
+		nil,
+		nil)
+	event := stub.NewEvent()
+
+	succeeding.Notify(context.Background(), &event)
+	failing.Notify(context.Background(), &event)
+	failing.Notify(context.Background(), &event)
+
+	assert.Equal(t, int64(1), metrics.Counter(MetricNotificationsSucceeded))
+	assert.Equal(t, int64(2), metrics.Counter(MetricNotificationsFailed))
+}
+
+func TestNotifyFailureLogsCorrelationIdCarriedByContext(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	errorMessage := uuid.New().String()
+	sut := newNotifierSUT(
+		loggingClient,
+		stub.NewSenderImpl().Send,
+		json.Marshal,
+		newMetadataClientImplReturnFailure(errorMessage))
+	event := stub.NewEvent()
+
+	sut.Notify(WithCorrelationId(context.Background(), "correlation"), &event)
+
+	expected := deviceCallFailedLogMessage(event.ID, errorMessage)
+	assert.True(t, loggingClient.SpecificFieldOccurred(expected, LogFieldCorrelationId, "correlation"))
+	assert.True(t, loggingClient.SpecificFieldOccurred(expected, LogFieldDevice, event.Device))
+	assert.True(t, loggingClient.SpecificFieldOccurred(expected, LogFieldError, errorMessage))
+}
+
+func TestNotifyIsTracedWithMetadataLookup(t *testing.T) {
+	exporter := &spanExporterImpl{}
+	tracer := newTracerSUT(NewMetrics(), exporter, 16)
+	sut := NewNotifier(
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		tracer,
+		stub.NewSenderImpl().Send,
+		json.Marshal,
+		newMetadataClientImplReturnSuccess(),
+		nil,
+		nil,
+		nil)
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	event := stub.NewEvent()
+
+	sut.Notify(WithTraceparent(context.Background(), parent), &event)
+	tracer.CleanUp()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	lookup, notify := spans[0], spans[1]
+	assert.Equal(t, "metadata.DeviceForName", lookup.Name)
+	assert.Equal(t, "notify.Notify", notify.Name)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", notify.TraceId)
+	assert.Equal(t, "b7ad6b7169203331", notify.ParentSpanId)
+	assert.Equal(t, notify.SpanId, lookup.ParentSpanId)
+	assert.Empty(t, notify.Error)
+}
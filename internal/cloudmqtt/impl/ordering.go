@@ -0,0 +1,132 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+)
+
+const MetricOrderingDroppedMessages = "cloudmqtt_ordering_dropped_messages_total"
+
+// ordering is a receiver wrapping a Publisher implementation that holds each device's messages until the device's
+// metadata has been notified.
+type ordering struct {
+	loggingClient logger.LoggingClient
+	metrics       contract.Metrics
+	maxHeld       int
+	publish       contract.Publisher
+	sendMutex     sync.Mutex
+	mutex         sync.Mutex
+	released      map[string]bool
+	held          map[string][]contract.Message
+}
+
+// NewOrdering is a constructor that returns an instance of ordering configured to hold up to maxHeld messages for
+// each device whose metadata has not been notified; when the limit is reached the device's oldest held message is
+// dropped.
+func NewOrdering(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	maxHeld int,
+	publish contract.Publisher) *ordering {
+
+	return &ordering{
+		loggingClient: loggingClient,
+		metrics:       metrics,
+		maxHeld:       maxHeld,
+		publish:       publish,
+		released:      make(map[string]bool),
+		held:          make(map[string][]contract.Message),
+	}
+}
+
+// orderingDroppedLogMessage function formats and returns the log message for when a held message is dropped.
+func orderingDroppedLogMessage(deviceName string) string {
+	return fmt.Sprintf("held message dropped for %s (metadata not yet sent)", deviceName)
+}
+
+// Publish method implements Publisher contract; it publishes the message if its device's metadata has been notified
+// (or it is not specific to a device), otherwise it holds the message.
+func (o *ordering) Publish(message contract.Message) {
+	o.sendMutex.Lock()
+	defer o.sendMutex.Unlock()
+
+	o.mutex.Lock()
+	if len(message.Device) == 0 || o.released[message.Device] {
+		o.mutex.Unlock()
+		o.publish(message)
+		return
+	}
+
+	held := append(o.held[message.Device], message)
+	var dropped []contract.Message
+	if len(held) > o.maxHeld {
+		dropped = []contract.Message{held[0]}
+		held = held[1:]
+	}
+	o.held[message.Device] = held
+	o.mutex.Unlock()
+
+	o.drop(dropped)
+}
+
+// drop method counts, logs, and calls Dropped() for held messages that will not be published.
+func (o *ordering) drop(messages []contract.Message) {
+	for _, message := range messages {
+		o.metrics.Increment(MetricOrderingDroppedMessages, 1)
+		o.loggingClient.Warn(
+			orderingDroppedLogMessage(message.Device),
+			LogFieldCorrelationId, message.CorrelationId,
+			LogFieldDevice, message.Device)
+		discard(message)
+	}
+}
+
+// Release method publishes the device's held messages in order; the device's subsequent messages are published
+// without being held.
+func (o *ordering) Release(deviceName string) {
+	o.sendMutex.Lock()
+	defer o.sendMutex.Unlock()
+
+	o.mutex.Lock()
+	o.released[deviceName] = true
+	held := o.held[deviceName]
+	delete(o.held, deviceName)
+	o.mutex.Unlock()
+
+	for _, message := range held {
+		o.publish(message)
+	}
+}
+
+// CleanUp method drops the messages still held when the service stops; they are counted and logged rather than
+// published ahead of their device's metadata.
+func (o *ordering) CleanUp() {
+	o.sendMutex.Lock()
+	defer o.sendMutex.Unlock()
+
+	o.mutex.Lock()
+	var dropped []contract.Message
+	for deviceName, held := range o.held {
+		dropped = append(dropped, held...)
+		delete(o.held, deviceName)
+	}
+	o.mutex.Unlock()
+
+	o.drop(dropped)
+}
@@ -0,0 +1,102 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//
+//  SUT factory
+//
+
+func newOrderingSUT(loggingClient logger.LoggingClient, metrics contract.Metrics, maxHeld int) (*ordering, *stub.Publisher) {
+	publisher := stub.NewPublisherImpl()
+	return NewOrdering(loggingClient, metrics, maxHeld, publisher.Publish), publisher
+}
+
+//
+//  unit tests
+//
+
+func TestOrderingHoldsMessagesUntilDeviceIsReleased(t *testing.T) {
+	sut, publisher := newOrderingSUT(stub.NewLoggerStub(), NewMetrics(), 10)
+
+	sut.Publish(newDeviceMessage("device", "1", nil))
+	sut.Publish(newDeviceMessage("device", "2", nil))
+	assert.Empty(t, publisher.Published())
+
+	sut.Release("device")
+	sut.Publish(newDeviceMessage("device", "3", nil))
+
+	assert.Equal(t, []string{"1", "2", "3"}, publishedData(publisher))
+}
+
+func TestOrderingReleaseDoesNotAffectOtherDevices(t *testing.T) {
+	sut, publisher := newOrderingSUT(stub.NewLoggerStub(), NewMetrics(), 10)
+
+	sut.Publish(newDeviceMessage("device1", "1", nil))
+	sut.Publish(newDeviceMessage("device2", "2", nil))
+	sut.Release("device2")
+
+	assert.Equal(t, []string{"2"}, publishedData(publisher))
+}
+
+func TestOrderingPublishesMessagesWithoutDeviceImmediately(t *testing.T) {
+	sut, publisher := newOrderingSUT(stub.NewLoggerStub(), NewMetrics(), 10)
+
+	sut.Publish(newMessage("aggregate", nil))
+
+	assert.Equal(t, []string{"aggregate"}, publishedData(publisher))
+}
+
+func TestOrderingDropsOldestHeldMessageBeyondLimitAndCountsIt(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	metrics := NewMetrics()
+	sut, publisher := newOrderingSUT(loggingClient, metrics, 2)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newDeviceMessage("device", "1", pushed))
+	sut.Publish(newDeviceMessage("device", "2", nil))
+	sut.Publish(newDeviceMessage("device", "3", nil))
+	sut.Release("device")
+
+	assert.Equal(t, []string{"2", "3"}, publishedData(publisher))
+	assert.Equal(t, int64(1), metrics.Counter(MetricOrderingDroppedMessages))
+	assert.Equal(t, 1, pushed.DroppedCalledCount)
+	assert.True(t, loggingClient.SpecificWarningOccurred(orderingDroppedLogMessage("device")))
+}
+
+func TestOrderingCleanUpDropsHeldMessagesAndCountsThem(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	metrics := NewMetrics()
+	sut, publisher := newOrderingSUT(loggingClient, metrics, 10)
+	pushed := &pushedImpl{}
+	sut.Publish(newDeviceMessage("device1", "1", pushed))
+	sut.Publish(newDeviceMessage("device1", "2", pushed))
+	sut.Publish(newDeviceMessage("device2", "3", pushed))
+
+	sut.CleanUp()
+	sut.Release("device1")
+
+	assert.Empty(t, publisher.Published())
+	assert.Equal(t, int64(3), metrics.Counter(MetricOrderingDroppedMessages))
+	assert.Equal(t, 3, pushed.DroppedCalledCount)
+	assert.True(t, loggingClient.SpecificWarningOccurred(orderingDroppedLogMessage("device2")))
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// PriorityRules defines when an event is high priority: when its device name matches one of Devices, when one of its
+// reading names matches one of Readings, or when one of its readings has a numeric value above the value in Above or
+// below the value in Below for the reading's name.  Patterns are as for FilterRules.
+type PriorityRules struct {
+	Devices  []string
+	Readings []string
+	Above    map[string]float64
+	Below    map[string]float64
+}
+
+// Empty method returns true if the rules never class an event as high priority.
+func (r PriorityRules) Empty() bool {
+	return len(r.Devices) == 0 && len(r.Readings) == 0 && len(r.Above) == 0 && len(r.Below) == 0
+}
+
+// prioritizer is a receiver wrapping compiled PriorityRules.
+type prioritizer struct {
+	devices  []*regexp.Regexp
+	readings []*regexp.Regexp
+	above    map[string]float64
+	below    map[string]float64
+}
+
+// NewPrioritizer is a constructor that returns an instance of prioritizer configured with rules.
+func NewPrioritizer(rules PriorityRules) (*prioritizer, error) {
+	devices, err := compilePatterns(rules.Devices)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := compilePatterns(rules.Readings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &prioritizer{
+		devices:  devices,
+		readings: readings,
+		above:    rules.Above,
+		below:    rules.Below,
+	}, nil
+}
+
+// high method returns true if reading matches a reading name or value threshold rule.
+func (p *prioritizer) high(reading models.Reading) bool {
+	if anyMatch(p.readings, reading.Name) {
+		return true
+	}
+
+	above, hasAbove := p.above[reading.Name]
+	below, hasBelow := p.below[reading.Name]
+	if !hasAbove && !hasBelow {
+		return false
+	}
+
+	value, err := strconv.ParseFloat(reading.Value, 64)
+	return err == nil && ((hasAbove && value > above) || (hasBelow && value < below))
+}
+
+// Prioritize method implements Prioritizer contract; it returns PriorityHigh for events matching the rules and
+// PriorityNormal for all other events.
+func (p *prioritizer) Prioritize(event *models.Event) int {
+	if anyMatch(p.devices, event.Device) {
+		return PriorityHigh
+	}
+	for _, reading := range event.Readings {
+		if p.high(reading) {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
+
+// lanes is a receiver wrapping separate queues for high and normal priority messages; each queue is published by its
+// own goroutine so a normal priority message whose transmission is stalled never delays a high priority message.
+type lanes struct {
+	high          chan contract.Message
+	normal        chan contract.Message
+	publishHigh   contract.Publisher
+	publishNormal contract.Publisher
+	wg            sync.WaitGroup
+}
+
+// NewLanes is a constructor that returns an instance of lanes configured to hold up to queueSize messages of each
+// priority; high priority messages are published via publishHigh and all other messages via publishNormal.
+func NewLanes(queueSize int, publishHigh contract.Publisher, publishNormal contract.Publisher) *lanes {
+	l := &lanes{
+		high:          make(chan contract.Message, queueSize),
+		normal:        make(chan contract.Message, queueSize),
+		publishHigh:   publishHigh,
+		publishNormal: publishNormal,
+	}
+	l.wg.Add(2)
+	go l.sender(l.high, l.publishHigh)
+	go l.sender(l.normal, l.publishNormal)
+	return l
+}
+
+// sender method is executed as goroutine by constructor (once per lane) and is responsible for publishing the lane's
+// queued messages in order.
+func (l *lanes) sender(lane chan contract.Message, publish contract.Publisher) {
+	defer l.wg.Done()
+
+	for message := range lane {
+		publish(message)
+	}
+}
+
+// Publish method implements Publisher contract; it queues the message in the lane for its priority, blocking if the
+// lane is full.
+func (l *lanes) Publish(message contract.Message) {
+	if message.Priority > PriorityNormal {
+		l.high <- message
+		return
+	}
+	l.normal <- message
+}
+
+// CleanUp method publishes queued messages and ensures the sender() goroutines have completed.
+func (l *lanes) CleanUp() {
+	close(l.high)
+	close(l.normal)
+	l.wg.Wait()
+}
@@ -0,0 +1,168 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+// blockingPublisherImpl records published messages, blocking each call until released.
+type blockingPublisherImpl struct {
+	mutex     sync.Mutex
+	published []string
+	entered   chan struct{}
+	release   chan struct{}
+}
+
+func newBlockingPublisherImpl() *blockingPublisherImpl {
+	return &blockingPublisherImpl{entered: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (p *blockingPublisherImpl) Publish(message contract.Message) {
+	p.entered <- struct{}{}
+	<-p.release
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.published = append(p.published, string(message.Data))
+}
+
+func (p *blockingPublisherImpl) Published() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+//
+//  SUT factory
+//
+
+func newPrioritizerSUT(t *testing.T, rules PriorityRules) *prioritizer {
+	sut, err := NewPrioritizer(rules)
+	assert.Nil(t, err)
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func newPriorityMessage(data string, priority int) contract.Message {
+	message := newMessage(data, &pushedImpl{})
+	message.Priority = priority
+	return message
+}
+
+//
+//  unit tests
+//
+
+func TestNewPrioritizerWithInvalidRegularExpressionReturnsError(t *testing.T) {
+	sut, err := NewPrioritizer(PriorityRules{Readings: []string{"re:("}})
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestPrioritizeWithoutRulesReturnsNormal(t *testing.T) {
+	sut := newPrioritizerSUT(t, PriorityRules{})
+	event := newEventWithReadingValues("device", "temperature", "1000")
+
+	assert.True(t, PriorityRules{}.Empty())
+	assert.Equal(t, PriorityNormal, sut.Prioritize(&event))
+}
+
+func TestPrioritizeMatchingDeviceReturnsHigh(t *testing.T) {
+	sut := newPrioritizerSUT(t, PriorityRules{Devices: []string{"alarm-*"}})
+	alarm := newEventWithReadingValues("alarm-panel", "state", "ok")
+	other := newEventWithReadingValues("sensor", "state", "ok")
+
+	assert.Equal(t, PriorityHigh, sut.Prioritize(&alarm))
+	assert.Equal(t, PriorityNormal, sut.Prioritize(&other))
+}
+
+func TestPrioritizeMatchingReadingNameReturnsHigh(t *testing.T) {
+	sut := newPrioritizerSUT(t, PriorityRules{Readings: []string{"re:^fault"}})
+	fault := newEventWithReadingValues("device", "temperature", "20", "faultCode", "7")
+	other := newEventWithReadingValues("device", "temperature", "20")
+
+	assert.Equal(t, PriorityHigh, sut.Prioritize(&fault))
+	assert.Equal(t, PriorityNormal, sut.Prioritize(&other))
+}
+
+func TestPrioritizeValueThresholds(t *testing.T) {
+	sut := newPrioritizerSUT(
+		t,
+		PriorityRules{Above: map[string]float64{"temperature": 80}, Below: map[string]float64{"temperature": -10}})
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"81", PriorityHigh},
+		{"80", PriorityNormal},
+		{"-10", PriorityNormal},
+		{"-11", PriorityHigh},
+		{"hot", PriorityNormal},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			event := newEventWithReadingValues("device", "temperature", test.value)
+
+			assert.Equal(t, test.expected, sut.Prioritize(&event))
+		})
+	}
+}
+
+func TestLanesRouteMessagesByPriority(t *testing.T) {
+	high := stub.NewPublisherImpl()
+	normal := stub.NewPublisherImpl()
+	sut := NewLanes(4, high.Publish, normal.Publish)
+
+	sut.Publish(newPriorityMessage("alarm", PriorityHigh))
+	sut.Publish(newPriorityMessage("telemetry", PriorityNormal))
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"alarm"}, publishedData(high))
+	assert.Equal(t, []string{"telemetry"}, publishedData(normal))
+}
+
+func TestLanesHighPriorityMessagesAreNotDelayedByStalledNormalPriorityMessage(t *testing.T) {
+	normal := newBlockingPublisherImpl()
+	high := stub.NewPublisherImpl()
+	sut := NewLanes(4, high.Publish, normal.Publish)
+
+	sut.Publish(newPriorityMessage("normal1", PriorityNormal))
+	<-normal.entered
+	sut.Publish(newPriorityMessage("normal2", PriorityNormal))
+	sut.Publish(newPriorityMessage("high1", PriorityHigh))
+	sut.Publish(newPriorityMessage("high2", PriorityHigh))
+	for i := 0; i < 1000 && len(publishedData(high)) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, []string{"high1", "high2"}, publishedData(high))
+	assert.Empty(t, normal.Published())
+	close(normal.release)
+	sut.CleanUp()
+	assert.Equal(t, []string{"normal1", "normal2"}, normal.Published())
+}
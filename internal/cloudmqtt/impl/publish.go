@@ -0,0 +1,167 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MetricPublishRetries   = "cloudmqtt_publish_retries_total"
+	MetricPublishAbandoned = "cloudmqtt_publish_abandoned_total"
+)
+
+// shutdown is a receiver recording when the service began shutting down; failed transmissions are no longer retried
+// once the grace period that follows has elapsed.
+type shutdown struct {
+	mutex    sync.Mutex
+	grace    time.Duration
+	deadline time.Time
+}
+
+// NewShutdown is a constructor that returns an instance of shutdown allowing failed transmissions to be retried for
+// grace once shutdown has begun.
+func NewShutdown(grace time.Duration) *shutdown {
+	return &shutdown{grace: grace}
+}
+
+// Begin method starts the grace period; it is called before the publishers are cleaned up.
+func (s *shutdown) Begin() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.deadline.IsZero() {
+		s.deadline = time.Now().Add(s.grace)
+	}
+}
+
+// Expired method returns true once the grace period has elapsed.
+func (s *shutdown) Expired() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.deadline.IsZero() && !time.Now().Before(s.deadline)
+}
+
+// retry is a receiver wrapping a Sender implementation that retries transmission until it succeeds.
+type retry struct {
+	loggingClient                logger.LoggingClient
+	metrics                      contract.Metrics
+	tracer                       contract.Tracer
+	sendFailureWaitInNanoseconds time.Duration
+	shutdown                     *shutdown
+	send                         contract.Sender
+}
+
+// NewRetryPublisher is a constructor that returns an instance of retry configured to wait
+// sendFailureWaitInNanoseconds between failed transmission attempts until shutdown's grace period has elapsed.
+func NewRetryPublisher(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
+	sendFailureWaitInNanoseconds time.Duration,
+	shutdown *shutdown,
+	send contract.Sender) *retry {
+
+	return &retry{
+		loggingClient:                loggingClient,
+		metrics:                      metrics,
+		tracer:                       tracer,
+		sendFailureWaitInNanoseconds: sendFailureWaitInNanoseconds,
+		shutdown:                     shutdown,
+		send:                         send,
+	}
+}
+
+// publishRetryLogMessage function formats and returns the log message for when a failed transmission is to be
+// retried.
+func publishRetryLogMessage(attempt int) string {
+	return fmt.Sprintf("publish failed (attempt %d); retrying", attempt)
+}
+
+// logRetry function logs a failed transmission of message that is to be retried.
+func logRetry(loggingClient logger.LoggingClient, message contract.Message, attempt int) {
+	loggingClient.Debug(
+		publishRetryLogMessage(attempt),
+		LogFieldCorrelationId, message.CorrelationId,
+		LogFieldDevice, message.Device,
+		LogFieldAttempt, attempt)
+}
+
+// publishAbandonedLogMessage function formats and returns the log message for when a failed transmission is not
+// retried because the service is shutting down.
+func publishAbandonedLogMessage(attempt int) string {
+	return fmt.Sprintf("publish abandoned after attempt %d (shutting down)", attempt)
+}
+
+// transmit function sends message's data, waiting sendFailureWaitInNanoseconds between failed attempts, until it
+// succeeds or shutdown's grace period has elapsed; it returns true if the data was sent.  The attempts are traced as a
+// span, a child of message's, that ends once the data has been acknowledged.  The span and message's correlation ID
+// are carried by the context passed to send.
+func transmit(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
+	sendFailureWaitInNanoseconds time.Duration,
+	shutdown *shutdown,
+	send contract.Sender,
+	message contract.Message) bool {
+
+	ctx, end := tracer.Start(
+		WithTraceparent(WithCorrelationId(context.Background(), message.CorrelationId), message.Traceparent),
+		"publish",
+		LogFieldCorrelationId, message.CorrelationId,
+		LogFieldDevice, message.Device)
+	attempt := 1
+	for ; !send(ctx, message.Data); attempt++ {
+		if shutdown.Expired() {
+			loggingClient.Warn(
+				publishAbandonedLogMessage(attempt),
+				LogFieldCorrelationId, message.CorrelationId,
+				LogFieldDevice, message.Device,
+				LogFieldAttempt, attempt)
+			metrics.Increment(MetricPublishAbandoned, 1)
+			end(errors.New("abandoned"), LogFieldAttempt, strconv.Itoa(attempt))
+			return false
+		}
+		logRetry(loggingClient, message, attempt)
+		metrics.Increment(MetricPublishRetries, 1)
+		time.Sleep(sendFailureWaitInNanoseconds)
+	}
+	end(nil, LogFieldAttempt, strconv.Itoa(attempt))
+	return true
+}
+
+// discard function calls message's Dropped(), if any, for a message that will not be transmitted.
+func discard(message contract.Message) {
+	if message.Dropped != nil {
+		message.Dropped()
+	}
+}
+
+// Publish method implements Publisher contract; it blocks until the message has been transmitted (or abandoned
+// because the service is shutting down, in which case the message is dropped rather than marked as pushed).
+func (r *retry) Publish(message contract.Message) {
+	if transmit(r.loggingClient, r.metrics, r.tracer, r.sendFailureWaitInNanoseconds, r.shutdown, r.send, message) {
+		message.Pushed()
+		return
+	}
+	discard(message)
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const sendFailureWaitInNanosecondsForTesting = 10 * time.Millisecond
+
+//
+//  SUT factory
+//
+
+func newRetryPublisherSUT(sender contract.Sender) *retry {
+	return newRetryPublisherSUTWithMetrics(NewMetrics(), sender)
+}
+
+func newRetryPublisherSUTWithMetrics(metrics contract.Metrics, sender contract.Sender) *retry {
+	return NewRetryPublisher(
+		stub.NewLoggerStub(),
+		metrics,
+		NewNopTracer(),
+		sendFailureWaitInNanosecondsForTesting,
+		NewShutdown(0),
+		sender)
+}
+
+//
+//  unit tests
+//
+
+func TestRetryPublishSendsDataAndCallsPushed(t *testing.T) {
+	sender := stub.NewSenderImpl()
+	sut := newRetryPublisherSUT(sender.Send)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newMessage("data", pushed))
+
+	assert.Len(t, sender.Sent, 1)
+	assert.Equal(t, []byte("data"), sender.Sent[0].Data)
+	assert.Equal(t, 1, pushed.PushedCalledCount)
+}
+
+func TestRetryPublishRetriesUntilSendSucceeds(t *testing.T) {
+	callCount := 0
+	sender := stub.NewSenderImplWithResultFunc(func() bool {
+		callCount++
+		return callCount > 2
+	})
+	metrics := NewMetrics()
+	sut := newRetryPublisherSUTWithMetrics(metrics, sender.Send)
+	pushed := &pushedImpl{}
+
+	sut.Publish(newMessage("data", pushed))
+
+	assert.Equal(t, 3, sender.SendCalledCount)
+	assert.Equal(t, 1, pushed.PushedCalledCount)
+	assert.Equal(t, int64(2), metrics.Counter(MetricPublishRetries))
+}
+
+func TestRetryPublishLogsEachAttempt(t *testing.T) {
+	callCount := 0
+	sender := stub.NewSenderImplWithResultFunc(func() bool {
+		callCount++
+		return callCount > 2
+	})
+	loggingClient := stub.NewLoggerStub()
+	sut := NewRetryPublisher(
+		loggingClient,
+		NewMetrics(),
+		NewNopTracer(),
+		sendFailureWaitInNanosecondsForTesting,
+		NewShutdown(0),
+		sender.Send)
+	message := newMessage("data", &pushedImpl{})
+	message.CorrelationId = "correlation"
+
+	sut.Publish(message)
+
+	assert.True(t, loggingClient.SpecificFieldOccurred(publishRetryLogMessage(1), LogFieldAttempt, 1))
+	assert.True(t, loggingClient.SpecificFieldOccurred(publishRetryLogMessage(2), LogFieldAttempt, 2))
+	assert.True(t, loggingClient.SpecificFieldOccurred(publishRetryLogMessage(2), LogFieldCorrelationId, "correlation"))
+	assert.False(t, loggingClient.SpecificDebugOccurred(publishRetryLogMessage(3)))
+}
+
+func TestRetryPublishAbandonsMessageOnceShutdownGracePeriodHasElapsed(t *testing.T) {
+	sender := stub.NewSenderImplWithResultFunc(func() bool { return false })
+	loggingClient := stub.NewLoggerStub()
+	metrics := NewMetrics()
+	shutdown := NewShutdown(3 * sendFailureWaitInNanosecondsForTesting)
+	sut := NewRetryPublisher(
+		loggingClient,
+		metrics,
+		NewNopTracer(),
+		sendFailureWaitInNanosecondsForTesting,
+		shutdown,
+		sender.Send)
+	pushed := &pushedImpl{}
+
+	shutdown.Begin()
+	sut.Publish(newMessage("data", pushed))
+
+	assert.True(t, sender.SendCalledCount > 1)
+	assert.Equal(t, 0, pushed.PushedCalledCount)
+	assert.Equal(t, 1, pushed.DroppedCalledCount)
+	assert.Equal(t, int64(1), metrics.Counter(MetricPublishAbandoned))
+	assert.True(t, loggingClient.SpecificWarningOccurred(publishAbandonedLogMessage(sender.SendCalledCount)))
+}
+
+func TestShutdownExpiresOnlyAfterGracePeriodFollowingBegin(t *testing.T) {
+	sut := NewShutdown(0)
+
+	assert.False(t, sut.Expired())
+	sut.Begin()
+	assert.True(t, sut.Expired())
+}
@@ -0,0 +1,551 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitDropNewest  = "dropNewest"
+	RateLimitDropOldest  = "dropOldest"
+	RateLimitSample      = "sample"
+	RateLimitQueueToDisk = "queueToDisk"
+
+	MetricRateLimitQueuedMessages = "cloudmqtt_rate_limit_queued_messages_total"
+
+	// spoolFileExtension identifies the files in the spool directory containing queued messages.
+	spoolFileExtension = ".json"
+)
+
+// MetricRateLimitDroppedMessages function returns the name of the counter of the device's messages dropped because a
+// rate limit was exceeded.
+func MetricRateLimitDroppedMessages(deviceName string) string {
+	return MetricName("cloudmqtt_rate_limit_dropped_messages_total", "device", deviceName)
+}
+
+// RateLimit defines a token bucket that refills at PerSecond tokens per second up to Burst tokens; each message
+// consumes one token.  A PerSecond value of zero disables the limit.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// bucket is a receiver wrapping the state of a RateLimit; a nil bucket is unlimited.
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// newBucket function returns a full bucket for limit (or nil if limit is disabled).
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// wait method returns how long until the bucket contains a token (zero if it contains one now).
+func (b *bucket) wait(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.limit.PerSecond
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.PerSecond * float64(time.Second))
+}
+
+// take method consumes a token from the bucket.
+func (b *bucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
+
+// spooled is the structure written to the spool directory for each message queued to disk.
+type spooled struct {
+	Device        string `json:"device"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	Data          []byte `json:"data"`
+}
+
+// queued is a message held until its device's rate limit and the global rate limit allow it to be sent; file is the
+// message's spool file (if it has been queued to disk) in which case message.Data is not held in memory.
+type queued struct {
+	message contract.Message
+	file    string
+}
+
+// limiter is a receiver wrapping a Publisher implementation that limits the rate at which messages are published,
+// globally and per device.
+type limiter struct {
+	loggingClient  logger.LoggingClient
+	metrics        contract.Metrics
+	global         *bucket
+	deviceLimit    RateLimit
+	policy         string
+	queueSize      int
+	sampleInterval int
+	spoolDirectory string
+	publish        contract.Publisher
+	now            func() time.Time
+	sendMutex      sync.Mutex
+	mutex          sync.Mutex
+	devices        map[string]*bucket
+	exceeded       map[string]int
+	queue          []queued
+	queuedCount    map[string]int
+	sequence       uint64
+	signal         chan struct{}
+	done           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// NewRateLimiter is a constructor that returns an instance of limiter configured with global and per-device limits.
+// Messages exceeding a limit are handled according to policy: RateLimitDropNewest drops them; RateLimitSample drops
+// all but one in every sampleInterval of them; RateLimitDropOldest queues up to queueSize of them in memory, dropping
+// the oldest queued message (preferably from the same device) when the queue is full; RateLimitQueueToDisk queues up
+// to queueSize of them in spoolDirectory, dropping them when the queue is full.  Queued messages are published in
+// order for each device as the limits allow.
+func NewRateLimiter(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	global RateLimit,
+	perDevice RateLimit,
+	policy string,
+	queueSize int,
+	sampleInterval int,
+	spoolDirectory string,
+	publish contract.Publisher) (*limiter, error) {
+
+	return newRateLimiter(
+		loggingClient,
+		metrics,
+		global,
+		perDevice,
+		policy,
+		queueSize,
+		sampleInterval,
+		spoolDirectory,
+		publish,
+		time.Now)
+}
+
+// newRateLimiter function implements NewRateLimiter with an injectable clock.
+func newRateLimiter(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	global RateLimit,
+	perDevice RateLimit,
+	policy string,
+	queueSize int,
+	sampleInterval int,
+	spoolDirectory string,
+	publish contract.Publisher,
+	now func() time.Time) (*limiter, error) {
+
+	switch policy {
+	case RateLimitDropNewest, RateLimitDropOldest, RateLimitSample:
+	case RateLimitQueueToDisk:
+		if err := os.MkdirAll(spoolDirectory, 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rate limit policy %s", policy)
+	}
+	if sampleInterval < 1 {
+		sampleInterval = 1
+	}
+
+	l := &limiter{
+		loggingClient:  loggingClient,
+		metrics:        metrics,
+		global:         newBucket(global, now()),
+		deviceLimit:    perDevice,
+		policy:         policy,
+		queueSize:      queueSize,
+		sampleInterval: sampleInterval,
+		spoolDirectory: spoolDirectory,
+		publish:        publish,
+		now:            now,
+		devices:        make(map[string]*bucket),
+		exceeded:       make(map[string]int),
+		queuedCount:    make(map[string]int),
+		signal:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if policy == RateLimitQueueToDisk {
+		l.load()
+	}
+	l.wg.Add(1)
+	go l.drainer()
+	return l, nil
+}
+
+// rateLimitSpoolFailedLogMessage function formats and returns the log message for when a spool file cannot be read,
+// written, or removed.
+func rateLimitSpoolFailedLogMessage(operation string, file string, errorMessage string) string {
+	return fmt.Sprintf("rate limit spool %s failed for %s (%s)", operation, file, errorMessage)
+}
+
+// load method queues the messages left in the spool directory by a previous execution.
+func (l *limiter) load() {
+	files, err := ioutil.ReadDir(l.spoolDirectory)
+	if err != nil {
+		l.loggingClient.Warn(
+			rateLimitSpoolFailedLogMessage("read", l.spoolDirectory, err.Error()),
+			LogFieldError, err.Error())
+		return
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), spoolFileExtension) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := filepath.Join(l.spoolDirectory, name)
+		bytes, err := ioutil.ReadFile(file)
+		var content spooled
+		if err == nil {
+			err = json.Unmarshal(bytes, &content)
+		}
+		if err != nil {
+			l.loggingClient.Warn(rateLimitSpoolFailedLogMessage("read", file, err.Error()), LogFieldError, err.Error())
+			continue
+		}
+
+		if sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExtension), 10, 64); err == nil &&
+			sequence > l.sequence {
+			l.sequence = sequence
+		}
+		l.enqueue(queued{message: contract.Message{Device: content.Device, CorrelationId: content.CorrelationId}, file: file})
+	}
+}
+
+// spool method writes message to a new file in the spool directory and returns the file's name.
+func (l *limiter) spool(message contract.Message) (string, error) {
+	bytes, err := json.Marshal(spooled{Device: message.Device, CorrelationId: message.CorrelationId, Data: message.Data})
+	if err != nil {
+		return "", err
+	}
+
+	l.sequence++
+	file := filepath.Join(l.spoolDirectory, fmt.Sprintf("%020d%s", l.sequence, spoolFileExtension))
+	if err := ioutil.WriteFile(file, bytes, 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// unspool method returns message with the content of its spool file; the file is removed once the message has been
+// pushed.
+func (l *limiter) unspool(entry queued) (contract.Message, bool) {
+	bytes, err := ioutil.ReadFile(entry.file)
+	var content spooled
+	if err == nil {
+		err = json.Unmarshal(bytes, &content)
+	}
+	if err != nil {
+		l.loggingClient.Warn(
+			rateLimitSpoolFailedLogMessage("read", entry.file, err.Error()),
+			LogFieldCorrelationId, entry.message.CorrelationId,
+			LogFieldDevice, entry.message.Device,
+			LogFieldError, err.Error())
+		return contract.Message{}, false
+	}
+
+	pushed := entry.message.Pushed
+	return contract.Message{
+		Data:          content.Data,
+		Device:        content.Device,
+		CorrelationId: content.CorrelationId,
+		Dropped:       entry.message.Dropped,
+		Pushed: func() {
+			if err := os.Remove(entry.file); err != nil {
+				l.loggingClient.Warn(
+					rateLimitSpoolFailedLogMessage("remove", entry.file, err.Error()),
+					LogFieldCorrelationId, content.CorrelationId,
+					LogFieldDevice, content.Device,
+					LogFieldError, err.Error())
+			}
+			if pushed != nil {
+				pushed()
+			}
+		},
+	}, true
+}
+
+// deviceBucket method returns the device's bucket, creating it if necessary.
+func (l *limiter) deviceBucket(deviceName string, now time.Time) *bucket {
+	b, ok := l.devices[deviceName]
+	if !ok {
+		b = newBucket(l.deviceLimit, now)
+		l.devices[deviceName] = b
+	}
+	return b
+}
+
+// wait method returns how long until a message from the device can be sent (zero if it can be sent now).
+func (l *limiter) wait(deviceName string, now time.Time) time.Duration {
+	wait := l.global.wait(now)
+	if deviceWait := l.deviceBucket(deviceName, now).wait(now); deviceWait > wait {
+		wait = deviceWait
+	}
+	return wait
+}
+
+// take method consumes a token for a message from the device.
+func (l *limiter) take(deviceName string) {
+	l.global.take()
+	l.devices[deviceName].take()
+}
+
+// drop method records a dropped message from the device.
+func (l *limiter) drop(message contract.Message) {
+	l.metrics.Increment(MetricRateLimitDroppedMessages(message.Device), 1)
+}
+
+// enqueue method appends entry to the queue and wakes the drainer() goroutine.
+func (l *limiter) enqueue(entry queued) {
+	l.queue = append(l.queue, entry)
+	l.queuedCount[entry.message.Device]++
+	l.metrics.Increment(MetricRateLimitQueuedMessages, 1)
+
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+}
+
+// remove method removes the entry at index from the queue.
+func (l *limiter) remove(index int) queued {
+	entry := l.queue[index]
+	l.queue = append(l.queue[:index], l.queue[index+1:]...)
+	if l.queuedCount[entry.message.Device]--; l.queuedCount[entry.message.Device] == 0 {
+		delete(l.queuedCount, entry.message.Device)
+	}
+	return entry
+}
+
+// exceed method applies the configured policy to a message that exceeds a limit; returns true if the message should
+// be published regardless, and the message dropped (if any) whose Dropped() the caller calls once the mutex is
+// released.
+func (l *limiter) exceed(message contract.Message) (bool, []contract.Message) {
+	switch l.policy {
+	case RateLimitSample:
+		l.exceeded[message.Device]++
+		if l.exceeded[message.Device]%l.sampleInterval == 0 {
+			return true, nil
+		}
+
+	case RateLimitDropOldest:
+		if l.queueSize < 1 {
+			break
+		}
+		var dropped []contract.Message
+		if len(l.queue) >= l.queueSize {
+			index := 0
+			for i, entry := range l.queue {
+				if entry.message.Device == message.Device {
+					index = i
+					break
+				}
+			}
+			oldest := l.remove(index).message
+			l.drop(oldest)
+			dropped = []contract.Message{oldest}
+		}
+		l.enqueue(queued{message: message})
+		return false, dropped
+
+	case RateLimitQueueToDisk:
+		if len(l.queue) >= l.queueSize {
+			break
+		}
+		file, err := l.spool(message)
+		if err != nil {
+			l.loggingClient.Warn(
+				rateLimitSpoolFailedLogMessage("write", l.spoolDirectory, err.Error()),
+				LogFieldCorrelationId, message.CorrelationId,
+				LogFieldDevice, message.Device,
+				LogFieldError, err.Error())
+			break
+		}
+		l.enqueue(
+			queued{
+				message: contract.Message{
+					Device:        message.Device,
+					CorrelationId: message.CorrelationId,
+					Pushed:        message.Pushed,
+					Dropped:       message.Dropped,
+				},
+				file: file,
+			})
+		return false, nil
+	}
+
+	l.drop(message)
+	return false, []contract.Message{message}
+}
+
+// Publish method implements Publisher contract; it publishes the message if neither the global limit nor the
+// message's device limit is exceeded (and no earlier message from the device is queued), otherwise it applies the
+// configured policy.
+func (l *limiter) Publish(message contract.Message) {
+	l.sendMutex.Lock()
+	defer l.sendMutex.Unlock()
+
+	now := l.now()
+	l.mutex.Lock()
+	send := l.queuedCount[message.Device] == 0 && l.wait(message.Device, now) == 0
+	var dropped []contract.Message
+	if send {
+		l.take(message.Device)
+	} else {
+		send, dropped = l.exceed(message)
+	}
+	l.mutex.Unlock()
+
+	for _, message := range dropped {
+		discard(message)
+	}
+	if send {
+		l.publish(message)
+	}
+}
+
+// release method publishes the first queued message the limits allow; returns true if a message was released,
+// otherwise returns how long until one can be (zero if the queue is empty).
+func (l *limiter) release() (time.Duration, bool) {
+	l.sendMutex.Lock()
+	defer l.sendMutex.Unlock()
+
+	now := l.now()
+	l.mutex.Lock()
+	var minimum time.Duration
+	blocked := make(map[string]bool)
+	for i, entry := range l.queue {
+		if blocked[entry.message.Device] {
+			continue
+		}
+		wait := l.wait(entry.message.Device, now)
+		if wait == 0 {
+			l.take(entry.message.Device)
+			l.remove(i)
+			l.mutex.Unlock()
+
+			message := entry.message
+			if len(entry.file) > 0 {
+				var ok bool
+				if message, ok = l.unspool(entry); !ok {
+					l.drop(entry.message)
+					discard(entry.message)
+					return 0, true
+				}
+			}
+			l.publish(message)
+			return 0, true
+		}
+		if minimum == 0 || wait < minimum {
+			minimum = wait
+		}
+		blocked[entry.message.Device] = true
+	}
+	l.mutex.Unlock()
+	return minimum, false
+}
+
+// drainer method is executed as goroutine by constructor and is responsible for publishing queued messages as the
+// limits allow.
+func (l *limiter) drainer() {
+	defer l.wg.Done()
+
+	for {
+		wait, released := l.release()
+		if released {
+			continue
+		}
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case <-l.done:
+			if timer != nil {
+				stopTimer(timer)
+			}
+			return
+		case <-l.signal:
+		case <-expired:
+		}
+		if timer != nil {
+			stopTimer(timer)
+		}
+	}
+}
+
+// CleanUp method ensures the drainer() goroutine has completed; messages queued in memory are dropped while messages
+// queued to disk are published by the next execution.
+func (l *limiter) CleanUp() {
+	close(l.done)
+	l.wg.Wait()
+
+	l.mutex.Lock()
+	var dropped []contract.Message
+	for _, entry := range l.queue {
+		if len(entry.file) == 0 {
+			l.drop(entry.message)
+			dropped = append(dropped, entry.message)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, message := range dropped {
+		discard(message)
+	}
+}
@@ -0,0 +1,299 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+type clockImpl struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newClockImpl() *clockImpl {
+	return &clockImpl{now: time.Now()}
+}
+
+func (c *clockImpl) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *clockImpl) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+//
+//  SUT factory
+//
+
+func newRateLimiterSUT(
+	t *testing.T,
+	metrics contract.Metrics,
+	global RateLimit,
+	perDevice RateLimit,
+	policy string,
+	spoolDirectory string,
+	publisher *stub.Publisher,
+	clock *clockImpl) *limiter {
+
+	sut, err := newRateLimiter(
+		stub.NewLoggerStub(),
+		metrics,
+		global,
+		perDevice,
+		policy,
+		2,
+		3,
+		spoolDirectory,
+		publisher.Publish,
+		clock.Now)
+	assert.Nil(t, err)
+	return sut
+}
+
+//
+//  utility and helper functions
+//
+
+func newDeviceMessage(deviceName string, data string, pushed *pushedImpl) contract.Message {
+	message := newMessage(data, pushed)
+	message.Device = deviceName
+	return message
+}
+
+func publishedData(publisher *stub.Publisher) (result []string) {
+	for _, message := range publisher.Published() {
+		result = append(result, string(message.Data))
+	}
+	return
+}
+
+// advanceAndWaitForPublished advances clock and waits for the drainer() goroutine to publish count messages.
+func advanceAndWaitForPublished(sut *limiter, clock *clockImpl, d time.Duration, publisher *stub.Publisher, count int) {
+	clock.Advance(d)
+	select {
+	case sut.signal <- struct{}{}:
+	default:
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(publisher.Published()) >= count {
+			return
+		}
+	}
+}
+
+//
+//  unit tests
+//
+
+func TestNewRateLimiterWithUnsupportedPolicyReturnsError(t *testing.T) {
+	sut, err := NewRateLimiter(
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		RateLimit{},
+		RateLimit{},
+		"unsupported",
+		0,
+		0,
+		"",
+		stub.NewPublisherImpl().Publish)
+
+	assert.Nil(t, sut)
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitDropNewestDropsMessagesBeyondBurstAndCountsThem(t *testing.T) {
+	metrics := NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, metrics, RateLimit{PerSecond: 1, Burst: 2}, RateLimit{}, RateLimitDropNewest, "", publisher, newClockImpl())
+	defer sut.CleanUp()
+	pushed := &pushedImpl{}
+
+	for _, data := range []string{"1", "2", "3"} {
+		sut.Publish(newDeviceMessage("device", data, pushed))
+	}
+
+	assert.Equal(t, []string{"1", "2"}, publishedData(publisher))
+	assert.Equal(t, int64(1), metrics.Counter(MetricRateLimitDroppedMessages("device")))
+	assert.Equal(t, 1, pushed.DroppedCalledCount)
+}
+
+func TestRateLimitTokensRefillOverTime(t *testing.T) {
+	clock := newClockImpl()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, NewMetrics(), RateLimit{PerSecond: 2, Burst: 1}, RateLimit{}, RateLimitDropNewest, "", publisher, clock)
+	defer sut.CleanUp()
+
+	sut.Publish(newDeviceMessage("device", "1", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("device", "2", &pushedImpl{}))
+	clock.Advance(500 * time.Millisecond)
+	sut.Publish(newDeviceMessage("device", "3", &pushedImpl{}))
+
+	assert.Equal(t, []string{"1", "3"}, publishedData(publisher))
+}
+
+func TestRateLimitPerDeviceDoesNotThrottleOtherDevices(t *testing.T) {
+	metrics := NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, metrics, RateLimit{}, RateLimit{PerSecond: 1, Burst: 1}, RateLimitDropNewest, "", publisher, newClockImpl())
+	defer sut.CleanUp()
+
+	sut.Publish(newDeviceMessage("noisy", "1", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("noisy", "2", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("quiet", "3", &pushedImpl{}))
+
+	assert.Equal(t, []string{"1", "3"}, publishedData(publisher))
+	assert.Equal(t, int64(1), metrics.Counter(MetricRateLimitDroppedMessages("noisy")))
+	assert.Equal(t, int64(0), metrics.Counter(MetricRateLimitDroppedMessages("quiet")))
+}
+
+func TestRateLimitSamplePublishesOneInEveryIntervalOfExceedingMessages(t *testing.T) {
+	metrics := NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, metrics, RateLimit{}, RateLimit{PerSecond: 1, Burst: 1}, RateLimitSample, "", publisher, newClockImpl())
+	defer sut.CleanUp()
+	pushed := &pushedImpl{}
+
+	for _, data := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		sut.Publish(newDeviceMessage("device", data, pushed))
+	}
+
+	assert.Equal(t, []string{"1", "4", "7"}, publishedData(publisher))
+	assert.Equal(t, int64(4), metrics.Counter(MetricRateLimitDroppedMessages("device")))
+	assert.Equal(t, 4, pushed.DroppedCalledCount)
+}
+
+func TestRateLimitDropOldestQueuesMessagesAndPublishesThemInOrder(t *testing.T) {
+	clock := newClockImpl()
+	metrics := NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, metrics, RateLimit{PerSecond: 1, Burst: 1}, RateLimit{}, RateLimitDropOldest, "", publisher, clock)
+	defer sut.CleanUp()
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		sut.Publish(newDeviceMessage("device", data, &pushedImpl{}))
+	}
+	assert.Equal(t, []string{"1"}, publishedData(publisher))
+
+	advanceAndWaitForPublished(sut, clock, time.Second, publisher, 2)
+	advanceAndWaitForPublished(sut, clock, time.Second, publisher, 3)
+
+	assert.Equal(t, []string{"1", "3", "4"}, publishedData(publisher))
+	assert.Equal(t, int64(1), metrics.Counter(MetricRateLimitDroppedMessages("device")))
+	assert.Equal(t, int64(3), metrics.Counter(MetricRateLimitQueuedMessages))
+}
+
+func TestRateLimitDropOldestCallsDroppedForOldestAndQueuedMessagesOnCleanUp(t *testing.T) {
+	metrics := NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, metrics, RateLimit{PerSecond: 1, Burst: 1}, RateLimit{}, RateLimitDropOldest, "", publisher, newClockImpl())
+	oldest, queued := &pushedImpl{}, &pushedImpl{}
+
+	sut.Publish(newDeviceMessage("device", "1", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("device", "2", oldest))
+	sut.Publish(newDeviceMessage("device", "3", queued))
+	sut.Publish(newDeviceMessage("device", "4", queued))
+	assert.Equal(t, 1, oldest.DroppedCalledCount)
+	sut.CleanUp()
+
+	assert.Equal(t, 2, queued.DroppedCalledCount)
+	assert.Equal(t, int64(3), metrics.Counter(MetricRateLimitDroppedMessages("device")))
+}
+
+func TestRateLimitQueuedMessagePublishedBeforeLaterMessageFromSameDevice(t *testing.T) {
+	clock := newClockImpl()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, NewMetrics(), RateLimit{}, RateLimit{PerSecond: 1, Burst: 1}, RateLimitDropOldest, "", publisher, clock)
+	defer sut.CleanUp()
+
+	sut.Publish(newDeviceMessage("device", "1", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("device", "2", &pushedImpl{}))
+	clock.Advance(time.Second)
+	sut.Publish(newDeviceMessage("device", "3", &pushedImpl{}))
+	advanceAndWaitForPublished(sut, clock, 0, publisher, 2)
+	advanceAndWaitForPublished(sut, clock, time.Second, publisher, 3)
+
+	assert.Equal(t, []string{"1", "2", "3"}, publishedData(publisher))
+}
+
+func TestRateLimitQueueToDiskPersistsMessagesAcrossInstances(t *testing.T) {
+	directory, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	clock := newClockImpl()
+	limit := RateLimit{PerSecond: 1, Burst: 1}
+
+	first := newRateLimiterSUT(t, NewMetrics(), limit, RateLimit{}, RateLimitQueueToDisk, directory, stub.NewPublisherImpl(), clock)
+	first.Publish(newDeviceMessage("device", "1", &pushedImpl{}))
+	first.Publish(newDeviceMessage("device", "2", &pushedImpl{}))
+	first.CleanUp()
+	files, _ := filepath.Glob(filepath.Join(directory, "*"+spoolFileExtension))
+	assert.Equal(t, 1, len(files))
+
+	publisher := stub.NewPublisherImpl()
+	second := newRateLimiterSUT(t, NewMetrics(), limit, RateLimit{}, RateLimitQueueToDisk, directory, publisher, clock)
+	defer second.CleanUp()
+	advanceAndWaitForPublished(second, clock, 0, publisher, 1)
+	publisher.PushAll()
+
+	assert.Equal(t, []string{"2"}, publishedData(publisher))
+	assert.Equal(t, "device", publisher.Published()[0].Device)
+	files, _ = filepath.Glob(filepath.Join(directory, "*"+spoolFileExtension))
+	assert.Equal(t, 0, len(files))
+}
+
+func TestRateLimitQueueToDiskCallsOriginalPushed(t *testing.T) {
+	directory, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	clock := newClockImpl()
+	publisher := stub.NewPublisherImpl()
+	sut := newRateLimiterSUT(
+		t, NewMetrics(), RateLimit{PerSecond: 1, Burst: 1}, RateLimit{}, RateLimitQueueToDisk, directory, publisher, clock)
+	defer sut.CleanUp()
+	pushed := &pushedImpl{}
+
+	sut.Publish(newDeviceMessage("device", "1", &pushedImpl{}))
+	sut.Publish(newDeviceMessage("device", "2", pushed))
+	advanceAndWaitForPublished(sut, clock, time.Second, publisher, 2)
+	publisher.PushAll()
+
+	assert.Equal(t, []string{"1", "2"}, publishedData(publisher))
+	assert.Equal(t, 1, pushed.PushedCalledCount)
+}
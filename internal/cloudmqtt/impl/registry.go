@@ -0,0 +1,126 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+	"time"
+)
+
+// endpointUrl is a receiver wrapping the current URL of an EdgeX service endpoint.
+type endpointUrl struct {
+	mutex sync.Mutex
+	url   string
+}
+
+// newEndpointUrl function returns an instance of endpointUrl for the endpoint described by params; as for the EdgeX
+// clients, endpoint resolves the endpoint if params.UseRegistry is true.
+func newEndpointUrl(params types.EndpointParams, endpoint clients.Endpointer) *endpointUrl {
+	e := &endpointUrl{url: params.Url}
+	if params.UseRegistry {
+		ch := make(chan string, 1)
+		go endpoint.Monitor(params, ch)
+		go func() {
+			for url := range ch {
+				e.mutex.Lock()
+				e.url = url
+				e.mutex.Unlock()
+			}
+		}()
+	}
+	return e
+}
+
+// get method returns the endpoint's current URL.
+func (e *endpointUrl) get() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.url
+}
+
+// registryEndpoint is a receiver wrapping a service registry client; it implements the EdgeX clients' Endpointer
+// interface, falling back to the explicitly configured URL while the registry cannot resolve a service.
+type registryEndpoint struct {
+	loggingClient logger.LoggingClient
+	client        contract.RegistryClient
+	done          chan struct{}
+}
+
+// NewRegistryEndpoint is a constructor that returns an instance of registryEndpoint configured to resolve services
+// using client.
+func NewRegistryEndpoint(loggingClient logger.LoggingClient, client contract.RegistryClient) *registryEndpoint {
+	return &registryEndpoint{
+		loggingClient: loggingClient,
+		client:        client,
+		done:          make(chan struct{}),
+	}
+}
+
+// registryLookupFailedLogMessage function formats and returns the log message for when the registry cannot resolve a
+// service.
+func registryLookupFailedLogMessage(serviceKey string, fallbackUrl string, errorMessage string) string {
+	return fmt.Sprintf("registry lookup failed for %s; using %s (%s)", serviceKey, fallbackUrl, errorMessage)
+}
+
+// registryResolvedLogMessage function formats and returns the log message for when a service's URL changes.
+func registryResolvedLogMessage(serviceKey string, url string) string {
+	return fmt.Sprintf("resolved %s to %s", serviceKey, url)
+}
+
+// url method returns the URL for the service identified by params, or params.Url if the registry cannot resolve it.
+func (r *registryEndpoint) url(params types.EndpointParams) string {
+	endpoint, err := r.client.GetServiceEndpoint(params.ServiceKey)
+	if err != nil {
+		r.loggingClient.Warn(
+			registryLookupFailedLogMessage(params.ServiceKey, params.Url, err.Error()),
+			LogFieldError, err.Error())
+		return params.Url
+	}
+	return fmt.Sprintf("http://%s:%d%s", endpoint.Host, endpoint.Port, params.Path)
+}
+
+// Monitor method implements the EdgeX clients' Endpointer interface; it is executed as goroutine by the EdgeX clients
+// and is responsible for pushing the service's URL to ch at startup and whenever it changes, checking every
+// params.Interval milliseconds.
+func (r *registryEndpoint) Monitor(params types.EndpointParams, ch chan string) {
+	var current string
+	for {
+		if url := r.url(params); len(url) > 0 && url != current {
+			select {
+			case ch <- url:
+				current = url
+				r.loggingClient.Info(registryResolvedLogMessage(params.ServiceKey, url))
+			case <-r.done:
+				return
+			}
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Duration(params.Interval) * time.Millisecond):
+		}
+	}
+}
+
+// CleanUp method stops monitoring services.
+func (r *registryEndpoint) CleanUp() {
+	close(r.done)
+}
@@ -0,0 +1,108 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"errors"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/types"
+	registryTypes "github.com/edgexfoundry/go-mod-registry/pkg/types"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+// registryClientImpl returns the endpoint set most recently, or err if not nil.
+type registryClientImpl struct {
+	mutex    sync.Mutex
+	endpoint registryTypes.ServiceEndpoint
+	err      error
+}
+
+func (c *registryClientImpl) GetServiceEndpoint(serviceId string) (registryTypes.ServiceEndpoint, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.endpoint, c.err
+}
+
+func (c *registryClientImpl) Set(endpoint registryTypes.ServiceEndpoint, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.endpoint, c.err = endpoint, err
+}
+
+//
+//  utility and helper functions
+//
+
+func newEndpointParams() types.EndpointParams {
+	return types.EndpointParams{
+		ServiceKey:  "service",
+		Path:        "/api/v1/device",
+		UseRegistry: true,
+		Url:         "http://fallback:48081/api/v1/device",
+		Interval:    1,
+	}
+}
+
+func receiveUrl(t *testing.T, ch chan string) string {
+	select {
+	case url := <-ch:
+		return url
+	case <-time.After(time.Second):
+		assert.Fail(t, "no url pushed")
+		return ""
+	}
+}
+
+//
+//  unit tests
+//
+
+func TestRegistryEndpointPushesResolvedUrlAndChanges(t *testing.T) {
+	client := &registryClientImpl{endpoint: registryTypes.ServiceEndpoint{Host: "host1", Port: 1}}
+	sut := NewRegistryEndpoint(stub.NewLoggerStub(), client)
+	ch := make(chan string, 1)
+	go sut.Monitor(newEndpointParams(), ch)
+
+	first := receiveUrl(t, ch)
+	client.Set(registryTypes.ServiceEndpoint{Host: "host2", Port: 2}, nil)
+	second := receiveUrl(t, ch)
+	sut.CleanUp()
+
+	assert.Equal(t, "http://host1:1/api/v1/device", first)
+	assert.Equal(t, "http://host2:2/api/v1/device", second)
+}
+
+func TestRegistryEndpointFallsBackToConfiguredUrl(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	client := &registryClientImpl{err: errors.New("errorMessage")}
+	sut := NewRegistryEndpoint(loggingClient, client)
+	ch := make(chan string, 1)
+	params := newEndpointParams()
+	go sut.Monitor(params, ch)
+
+	url := receiveUrl(t, ch)
+	sut.CleanUp()
+
+	assert.Equal(t, params.Url, url)
+	assert.True(t, loggingClient.SpecificWarningOccurred(
+		registryLookupFailedLogMessage(params.ServiceKey, params.Url, "errorMessage")))
+}
@@ -0,0 +1,69 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is the time allowed for in-progress requests to complete when the server stops.
+const shutdownTimeout = 5 * time.Second
+
+// server is a receiver wrapping an HTTP server for the service's operational endpoints.
+type server struct {
+	loggingClient logger.LoggingClient
+	mux           *http.ServeMux
+	httpServer    *http.Server
+}
+
+// NewServer is a constructor that returns an instance of server configured to listen on address once started.
+func NewServer(loggingClient logger.LoggingClient, address string) *server {
+	mux := http.NewServeMux()
+	return &server{
+		loggingClient: loggingClient,
+		mux:           mux,
+		httpServer:    &http.Server{Addr: address, Handler: mux},
+	}
+}
+
+// serverFailedLogMessage function formats and returns the log message for when the server fails.
+func serverFailedLogMessage(address string, errorMessage string) string {
+	return fmt.Sprintf("http server on %s failed (%s)", address, errorMessage)
+}
+
+// Handle method registers handler for path; must be called before Start().
+func (s *server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// Start method starts serving requests in a separate goroutine.
+func (s *server) Start() {
+	go func() {
+		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.loggingClient.Error(serverFailedLogMessage(s.httpServer.Addr, err.Error()), LogFieldError, err.Error())
+		}
+	}()
+}
+
+// CleanUp method stops the server, allowing in-progress requests to complete.
+func (s *server) CleanUp() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,207 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tracingServiceName   = "cloudmqtt"
+	otlpTracesPath       = "/v1/traces"
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// otlpValue is the OTLP/JSON representation of a string attribute value.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpAttribute is the OTLP/JSON representation of an attribute.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpStatus is the OTLP/JSON representation of a span's status.
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan is the OTLP/JSON representation of a span.
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpScope is the OTLP/JSON representation of the instrumentation scope.
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// otlpScopeSpans is the OTLP/JSON representation of the spans recorded by an instrumentation scope.
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// otlpResource is the OTLP/JSON representation of the resource recording spans.
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+// otlpResourceSpans is the OTLP/JSON representation of the spans recorded by a resource.
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpTraces is the OTLP/JSON representation of an export request.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpAttributes function translates key/value pairs to their OTLP/JSON representation; an unpaired key is ignored.
+func otlpAttributes(pairs []string) []otlpAttribute {
+	var attributes []otlpAttribute
+	for i := 0; i+1 < len(pairs); i += 2 {
+		attributes = append(attributes, otlpAttribute{Key: pairs[i], Value: otlpValue{StringValue: pairs[i+1]}})
+	}
+	return attributes
+}
+
+// otlpTime function translates t to its OTLP/JSON representation.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// marshalOtlp function returns the OTLP/JSON export request for spans.
+func marshalOtlp(spans []contract.Span) ([]byte, error) {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		status := otlpStatus{}
+		if len(span.Error) > 0 {
+			status = otlpStatus{Code: otlpStatusCodeError, Message: span.Error}
+		}
+		converted = append(
+			converted,
+			otlpSpan{
+				TraceId:           span.TraceId,
+				SpanId:            span.SpanId,
+				ParentSpanId:      span.ParentSpanId,
+				Name:              span.Name,
+				Kind:              otlpSpanKindInternal,
+				StartTimeUnixNano: otlpTime(span.Start),
+				EndTimeUnixNano:   otlpTime(span.End),
+				Attributes:        otlpAttributes(span.Attributes),
+				Status:            status,
+			})
+	}
+
+	return json.Marshal(
+		otlpTraces{
+			ResourceSpans: []otlpResourceSpans{
+				{
+					Resource:   otlpResource{Attributes: otlpAttributes([]string{"service.name", tracingServiceName})},
+					ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: tracingServiceName}, Spans: converted}},
+				},
+			},
+		})
+}
+
+// otlpExporter is a receiver wrapping a SpanExporter implementation that sends spans to an OTLP/HTTP collector.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewOtlpExporter is a constructor that returns an instance of otlpExporter configured to send spans to the OTLP/HTTP
+// collector at endpoint (e.g. http://localhost:4318), abandoning each request after timeout.
+func NewOtlpExporter(endpoint string, timeout time.Duration) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Export method implements SpanExporter contract.
+func (o *otlpExporter) Export(spans []contract.Span) error {
+	body, err := marshalOtlp(spans)
+	if err != nil {
+		return err
+	}
+
+	response, err := o.client.Post(o.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("collector responded %s", response.Status)
+	}
+	return nil
+}
+
+// fileExporter is a receiver wrapping a SpanExporter implementation that appends spans to a file.
+type fileExporter struct {
+	fileName string
+	mutex    sync.Mutex
+}
+
+// NewFileExporter is a constructor that returns an instance of fileExporter configured to append each batch of spans
+// to fileName as a line of OTLP/JSON.
+func NewFileExporter(fileName string) *fileExporter {
+	return &fileExporter{fileName: fileName}
+}
+
+// Export method implements SpanExporter contract.
+func (f *fileExporter) Export(spans []contract.Span) error {
+	line, err := marshalOtlp(spans)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	file, err := os.OpenFile(f.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
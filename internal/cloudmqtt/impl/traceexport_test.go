@@ -0,0 +1,117 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//
+//  utility and helper functions
+//
+
+func newSpanForTesting(name string, err string) contract.Span {
+	start := time.Unix(1559920000, 0)
+	return contract.Span{
+		TraceId:      "0af7651916cd43dd8448eb211c80319c",
+		SpanId:       "b7ad6b7169203331",
+		ParentSpanId: "00f067aa0ba902b7",
+		Name:         name,
+		Start:        start,
+		End:          start.Add(time.Millisecond),
+		Attributes:   []string{"device", "device1"},
+		Error:        err,
+	}
+}
+
+const expectedOtlpForTesting = `{"resourceSpans":[{"resource":` +
+	`{"attributes":[{"key":"service.name","value":{"stringValue":"cloudmqtt"}}]},` +
+	`"scopeSpans":[{"scope":{"name":"cloudmqtt"},"spans":[{"traceId":"0af7651916cd43dd8448eb211c80319c",` +
+	`"spanId":"b7ad6b7169203331","parentSpanId":"00f067aa0ba902b7","name":"publish","kind":1,` +
+	`"startTimeUnixNano":"1559920000000000000","endTimeUnixNano":"1559920000001000000",` +
+	`"attributes":[{"key":"device","value":{"stringValue":"device1"}}],"status":{"code":2,"message":"failed"}}]}]}]}`
+
+//
+//  unit tests
+//
+
+func TestMarshalOtlpProducesOtlpJson(t *testing.T) {
+	result, err := marshalOtlp([]contract.Span{newSpanForTesting("publish", "failed")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, expectedOtlpForTesting, string(result))
+}
+
+func TestOtlpExporterPostsSpansToCollector(t *testing.T) {
+	var path, contentType, body string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		bytes, _ := ioutil.ReadAll(r.Body)
+		body = string(bytes)
+	}))
+	defer collector.Close()
+	sut := NewOtlpExporter(collector.URL+"/", time.Second)
+
+	err := sut.Export([]contract.Span{newSpanForTesting("publish", "failed")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, expectedOtlpForTesting, body)
+}
+
+func TestOtlpExporterReturnsErrorWhenCollectorRejectsSpans(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	sut := NewOtlpExporter(collector.URL, time.Second)
+
+	err := sut.Export([]contract.Span{newSpanForTesting("publish", "")})
+
+	assert.NotNil(t, err)
+}
+
+func TestFileExporterAppendsOneLinePerExport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "traces")
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "traces.json")
+	sut := NewFileExporter(fileName)
+
+	assert.Nil(t, sut.Export([]contract.Span{newSpanForTesting("first", "")}))
+	assert.Nil(t, sut.Export([]contract.Span{newSpanForTesting("second", "")}))
+
+	file, err := os.Open(fileName)
+	assert.Nil(t, err)
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var traces otlpTraces
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &traces))
+		names = append(names, traces.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+	}
+	assert.Equal(t, []string{"first", "second"}, names)
+}
@@ -0,0 +1,214 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricTracingDroppedSpans   = "cloudmqtt_tracing_dropped_spans_total"
+	MetricTracingExportFailures = "cloudmqtt_tracing_export_failures_total"
+	tracingExportBatchSize      = 512
+	traceparentFormat           = "00-%s-%s-%s"
+	traceFlagsSampled           = "01"
+)
+
+// traceparentPattern matches a W3C trace context traceparent header value; version ff is invalid.
+var traceparentPattern = regexp.MustCompile(
+	`^(?:[0-9a-e][0-9a-f]|f[0-9a-e])-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// traceContextKey is the context key for the span carried by a context.
+type traceContextKey struct{}
+
+// spanContext identifies a span.
+type spanContext struct {
+	traceId    string
+	spanId     string
+	traceFlags string
+}
+
+// Traceparent function returns the W3C trace context traceparent value of the span carried by ctx (empty if none).
+func Traceparent(ctx context.Context) string {
+	if s, ok := ctx.Value(traceContextKey{}).(spanContext); ok {
+		return fmt.Sprintf(traceparentFormat, s.traceId, s.spanId, s.traceFlags)
+	}
+	return ""
+}
+
+// WithTraceparent function returns a copy of ctx carrying the span identified by a W3C trace context traceparent
+// value; ctx is returned unchanged if traceparent is not valid.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	matches := traceparentPattern.FindStringSubmatch(strings.ToLower(traceparent))
+	if matches == nil || strings.Trim(matches[1], "0") == "" || strings.Trim(matches[2], "0") == "" {
+		return ctx
+	}
+	return context.WithValue(
+		ctx,
+		traceContextKey{},
+		spanContext{traceId: matches[1], spanId: matches[2], traceFlags: matches[3]})
+}
+
+// newId function returns size random bytes hex-encoded.
+func newId(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// tracer is a receiver wrapping a Tracer implementation that exports completed spans in batches.
+type tracer struct {
+	loggingClient logger.LoggingClient
+	metrics       contract.Metrics
+	export        contract.SpanExporter
+	interval      time.Duration
+	spans         chan contract.Span
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewTracer is a constructor that returns an instance of tracer configured to export completed spans every interval,
+// or sooner once a batch is full; up to queueSize completed spans may await export, further spans are dropped.
+func NewTracer(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	export contract.SpanExporter,
+	queueSize int,
+	interval time.Duration) *tracer {
+
+	t := &tracer{
+		loggingClient: loggingClient,
+		metrics:       metrics,
+		export:        export,
+		interval:      interval,
+		spans:         make(chan contract.Span, queueSize),
+		done:          make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.exporter()
+	return t
+}
+
+// tracingExportFailedLogMessage function formats and returns the log message for when spans cannot be exported.
+func tracingExportFailedLogMessage(count int, errorMessage string) string {
+	return fmt.Sprintf("export of %d spans failed (%s)", count, errorMessage)
+}
+
+// Start method implements Tracer contract.
+func (t *tracer) Start(ctx context.Context, name string, attributes ...string) (context.Context, contract.EndSpan) {
+	span := contract.Span{
+		SpanId:     newId(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: append([]string(nil), attributes...),
+	}
+	traceFlags := traceFlagsSampled
+	if parent, ok := ctx.Value(traceContextKey{}).(spanContext); ok {
+		span.TraceId, span.ParentSpanId, traceFlags = parent.traceId, parent.spanId, parent.traceFlags
+	} else {
+		span.TraceId = newId(16)
+	}
+
+	spanCtx := spanContext{traceId: span.TraceId, spanId: span.SpanId, traceFlags: traceFlags}
+	var once sync.Once
+	return context.WithValue(ctx, traceContextKey{}, spanCtx),
+		func(err error, attributes ...string) {
+			once.Do(func() {
+				span.End = time.Now()
+				span.Attributes = append(span.Attributes, attributes...)
+				if err != nil {
+					span.Error = err.Error()
+				}
+				select {
+				case t.spans <- span:
+				default:
+					t.metrics.Increment(MetricTracingDroppedSpans, 1)
+				}
+			})
+		}
+}
+
+// flush method exports spans; a batch that cannot be exported is dropped.
+func (t *tracer) flush(spans []contract.Span) {
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(spans); err != nil {
+		t.metrics.Increment(MetricTracingExportFailures, 1)
+		t.metrics.Increment(MetricTracingDroppedSpans, int64(len(spans)))
+		t.loggingClient.Warn(tracingExportFailedLogMessage(len(spans), err.Error()), LogFieldError, err.Error())
+	}
+}
+
+// exporter method is executed as goroutine by constructor and is responsible for exporting completed spans.
+func (t *tracer) exporter() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var batch []contract.Span
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= tracingExportBatchSize {
+				t.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.flush(batch)
+			batch = nil
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// CleanUp method exports the spans completed so far and ensures the exporter() goroutine has completed.
+func (t *tracer) CleanUp() {
+	close(t.done)
+	t.wg.Wait()
+}
+
+// nopTracer is a receiver wrapping a Tracer implementation that records nothing; used when tracing is not enabled.
+type nopTracer struct{}
+
+// NewNopTracer is a constructor that returns an instance of nopTracer.
+func NewNopTracer() *nopTracer {
+	return &nopTracer{}
+}
+
+// Start method implements Tracer contract; it returns ctx unchanged.
+func (n *nopTracer) Start(ctx context.Context, name string, attributes ...string) (context.Context, contract.EndSpan) {
+	return ctx, func(error, ...string) {}
+}
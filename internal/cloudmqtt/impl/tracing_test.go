@@ -0,0 +1,184 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"errors"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  test stubs
+//
+
+type spanExporterImpl struct {
+	mutex sync.Mutex
+	spans []contract.Span
+	err   error
+}
+
+func (e *spanExporterImpl) export(spans []contract.Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *spanExporterImpl) Spans() []contract.Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]contract.Span(nil), e.spans...)
+}
+
+//
+//  SUT factory
+//
+
+func newTracerSUT(metrics contract.Metrics, exporter *spanExporterImpl, queueSize int) *tracer {
+	return NewTracer(stub.NewLoggerStub(), metrics, exporter.export, queueSize, time.Hour)
+}
+
+//
+//  unit tests
+//
+
+func TestTraceparentRoundTrips(t *testing.T) {
+	for _, traceparent := range []string{
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00",
+	} {
+		assert.Equal(t, traceparent, Traceparent(WithTraceparent(context.Background(), traceparent)), traceparent)
+	}
+}
+
+func TestTraceparentCarriesInboundTraceFlags(t *testing.T) {
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	sut := newTracerSUT(NewMetrics(), &spanExporterImpl{}, 16)
+	defer sut.CleanUp()
+
+	ctx, end := sut.Start(WithTraceparent(context.Background(), traceparent), "name")
+	end(nil)
+
+	assert.True(t, strings.HasSuffix(Traceparent(ctx), "-00"))
+}
+
+func TestInvalidTraceparentIsIgnored(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"invalid",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+	} {
+		assert.Empty(t, Traceparent(WithTraceparent(context.Background(), traceparent)), traceparent)
+	}
+}
+
+func TestStartWithoutParentStartsNewTrace(t *testing.T) {
+	exporter := &spanExporterImpl{}
+	sut := newTracerSUT(NewMetrics(), exporter, 16)
+
+	ctx, end := sut.Start(context.Background(), "name", "key", "value")
+	end(nil, "other", "value")
+	sut.CleanUp()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "name", spans[0].Name)
+	assert.Len(t, spans[0].TraceId, 32)
+	assert.Len(t, spans[0].SpanId, 16)
+	assert.Empty(t, spans[0].ParentSpanId)
+	assert.Equal(t, []string{"key", "value", "other", "value"}, spans[0].Attributes)
+	assert.False(t, spans[0].End.Before(spans[0].Start))
+	assert.Equal(t, "00-"+spans[0].TraceId+"-"+spans[0].SpanId+"-01", Traceparent(ctx))
+}
+
+func TestStartWithParentStartsChildSpan(t *testing.T) {
+	exporter := &spanExporterImpl{}
+	sut := newTracerSUT(NewMetrics(), exporter, 16)
+
+	parentCtx, endParent := sut.Start(context.Background(), "parent")
+	_, endChild := sut.Start(parentCtx, "child")
+	endChild(errors.New("failed"))
+	endParent(nil)
+	sut.CleanUp()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, spans[1].TraceId, spans[0].TraceId)
+	assert.Equal(t, spans[1].SpanId, spans[0].ParentSpanId)
+	assert.Equal(t, "failed", spans[0].Error)
+	assert.Empty(t, spans[1].Error)
+}
+
+func TestEndingSpanTwiceRecordsItOnce(t *testing.T) {
+	exporter := &spanExporterImpl{}
+	sut := newTracerSUT(NewMetrics(), exporter, 16)
+
+	_, end := sut.Start(context.Background(), "name")
+	end(nil)
+	end(nil)
+	sut.CleanUp()
+
+	assert.Equal(t, 1, len(exporter.Spans()))
+}
+
+func TestSpansBeyondQueueSizeAreDropped(t *testing.T) {
+	metrics := NewMetrics()
+	exporter := &spanExporterImpl{}
+	sut := &tracer{loggingClient: stub.NewLoggerStub(), metrics: metrics, spans: make(chan contract.Span, 1)}
+
+	for i := 0; i < 3; i++ {
+		_, end := sut.Start(context.Background(), "name")
+		end(nil)
+	}
+
+	assert.Equal(t, int64(2), metrics.Counter(MetricTracingDroppedSpans))
+	assert.Equal(t, 0, len(exporter.Spans()))
+}
+
+func TestExportFailureIsCountedAndLogged(t *testing.T) {
+	metrics := NewMetrics()
+	loggingClient := stub.NewLoggerStub()
+	exporter := &spanExporterImpl{err: errors.New("failed")}
+	sut := NewTracer(loggingClient, metrics, exporter.export, 16, time.Hour)
+
+	_, end := sut.Start(context.Background(), "name")
+	end(nil)
+	sut.CleanUp()
+
+	assert.Equal(t, int64(1), metrics.Counter(MetricTracingExportFailures))
+	assert.Equal(t, int64(1), metrics.Counter(MetricTracingDroppedSpans))
+	assert.True(t, loggingClient.SpecificWarningOccurred(tracingExportFailedLogMessage(1, "failed")))
+}
+
+func TestNopTracerReturnsContextUnchanged(t *testing.T) {
+	ctx := WithTraceparent(context.Background(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	result, end := NewNopTracer().Start(ctx, "name")
+	end(nil)
+
+	assert.Equal(t, ctx, result)
+}
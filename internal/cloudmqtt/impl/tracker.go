@@ -0,0 +1,291 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sort"
+	"sync"
+	"time"
+)
+
+const MetricPendingNotifications = "cloudmqtt_pending_notifications"
+
+// PendingNotification describes a device whose metadata has not yet been notified successfully; NextAttempt is zero
+// while an attempt is queued or in progress.
+type PendingNotification struct {
+	Device      string
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// tracked is a device's event queued for notification along with the correlation ID and trace context of the EdgeX
+// request it originated from.
+type tracked struct {
+	correlationId string
+	traceparent   string
+	event         *models.Event
+}
+
+// pendingNotification is the retry state of a device whose notification has failed.
+type pendingNotification struct {
+	tracked     tracked
+	attempts    int
+	nextAttempt time.Time
+	timer       *time.Timer
+}
+
+// tracker is a receiver wrapping known device tracking; new devices are notified by a pool of workers so tracking
+// never blocks, and failed notifications are retried with exponential backoff.
+type tracker struct {
+	loggingClient  logger.LoggingClient
+	metrics        contract.Metrics
+	notify         contract.Notifier
+	timeout        time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	notified       func(deviceName string)
+	mutex          sync.Mutex
+	known          map[string]bool
+	inFlight       map[string]bool
+	pending        map[string]*pendingNotification
+	closed         bool
+	work           chan tracked
+	wg             sync.WaitGroup
+}
+
+// NewDeviceTracker is a constructor that returns an instance of tracker configured to notify new devices using
+// workers goroutines, each notification abandoned after timeout; up to queueSize new devices may await a worker.  A
+// failed notification is retried after initialBackoff, doubling for each further failure up to maxBackoff.  If notified
+// is not nil it is called with each device's name once the device's metadata has been notified successfully.
+func NewDeviceTracker(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	notify contract.Notifier,
+	workers int,
+	timeout time.Duration,
+	queueSize int,
+	initialBackoff time.Duration,
+	maxBackoff time.Duration,
+	notified func(deviceName string)) *tracker {
+
+	if workers < 1 {
+		workers = 1
+	}
+	t := &tracker{
+		loggingClient:  loggingClient,
+		metrics:        metrics,
+		notify:         notify,
+		timeout:        timeout,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		notified:       notified,
+		known:          make(map[string]bool),
+		inFlight:       make(map[string]bool),
+		pending:        make(map[string]*pendingNotification),
+		work:           make(chan tracked, queueSize),
+	}
+	t.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go t.worker()
+	}
+	return t
+}
+
+// DetectedNewDeviceLogMessage function formats and returns the log message for when a new device is detected.
+func DetectedNewDeviceLogMessage(deviceName string) string {
+	return fmt.Sprintf("detected new device %s", deviceName)
+}
+
+// trackerQueueFullLogMessage function formats and returns the log message for when a new device cannot be queued for
+// notification.
+func trackerQueueFullLogMessage(deviceName string) string {
+	return fmt.Sprintf("notification deferred for %s (queue full)", deviceName)
+}
+
+// notifyRetryLogMessage function formats and returns the log message for when a failed notification is scheduled to be
+// retried.
+func notifyRetryLogMessage(deviceName string, attempts int, backoff time.Duration) string {
+	return fmt.Sprintf("notification failed for %s (attempt %d); retrying in %v", deviceName, attempts, backoff)
+}
+
+// backoff method returns the time to wait before retrying a notification that has failed attempts times.
+func (t *tracker) backoff(attempts int) time.Duration {
+	backoff := t.initialBackoff
+	for i := 1; i < attempts && backoff < t.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > t.maxBackoff {
+		backoff = t.maxBackoff
+	}
+	return backoff
+}
+
+// retry method queues a device's notification once its backoff has elapsed; if the queue is full, the retry is
+// rescheduled after the same backoff.
+func (t *tracker) retry(deviceName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p, ok := t.pending[deviceName]
+	if !ok || t.closed {
+		return
+	}
+
+	select {
+	case t.work <- p.tracked:
+		t.inFlight[deviceName] = true
+		p.nextAttempt = time.Time{}
+		p.timer = nil
+	default:
+		t.loggingClient.Debug(
+			trackerQueueFullLogMessage(deviceName),
+			LogFieldCorrelationId, p.tracked.correlationId,
+			LogFieldDevice, deviceName)
+		t.schedule(p, t.backoff(p.attempts))
+	}
+}
+
+// schedule method arranges for a device's notification to be retried after backoff; must be called with mutex held.
+func (t *tracker) schedule(p *pendingNotification, backoff time.Duration) {
+	deviceName := p.tracked.event.Device
+	p.nextAttempt = time.Now().Add(backoff)
+	p.timer = time.AfterFunc(backoff, func() { t.retry(deviceName) })
+}
+
+// completed method records the result of a device's notification.
+func (t *tracker) completed(work tracked, notified bool) {
+	event := work.event
+	t.mutex.Lock()
+	delete(t.inFlight, event.Device)
+	p, wasPending := t.pending[event.Device]
+
+	if notified {
+		t.known[event.Device] = true
+		if wasPending {
+			delete(t.pending, event.Device)
+			t.metrics.Increment(MetricPendingNotifications, -1)
+		}
+		t.mutex.Unlock()
+
+		t.loggingClient.Debug(
+			DetectedNewDeviceLogMessage(event.Device),
+			LogFieldCorrelationId, work.correlationId,
+			LogFieldEventId, event.ID,
+			LogFieldDevice, event.Device)
+		if t.notified != nil {
+			t.notified(event.Device)
+		}
+		return
+	}
+	defer t.mutex.Unlock()
+
+	if !wasPending {
+		p = &pendingNotification{tracked: work}
+		t.pending[event.Device] = p
+		t.metrics.Increment(MetricPendingNotifications, 1)
+	}
+	p.attempts++
+	if t.closed {
+		return
+	}
+
+	backoff := t.backoff(p.attempts)
+	t.loggingClient.Debug(
+		notifyRetryLogMessage(event.Device, p.attempts, backoff),
+		LogFieldCorrelationId, work.correlationId,
+		LogFieldEventId, event.ID,
+		LogFieldDevice, event.Device,
+		LogFieldAttempt, p.attempts)
+	t.schedule(p, backoff)
+}
+
+// worker method is executed as goroutine by constructor and is responsible for notifying new devices; the
+// notification's context carries the correlation ID and trace context of the EdgeX request the device's event
+// originated from.
+func (t *tracker) worker() {
+	defer t.wg.Done()
+
+	for work := range t.work {
+		ctx := WithTraceparent(WithCorrelationId(context.Background(), work.correlationId), work.traceparent)
+		ctx, cancel := context.WithTimeout(ctx, t.timeout)
+		notified := t.notify(ctx, work.event)
+		cancel()
+		t.completed(work, notified)
+	}
+}
+
+// Track method implements Tracker contract; it queues the event for notification if its device is not known, not
+// already being notified, and not awaiting a retry.  If the queue is full the device remains unknown and is queued by
+// a later event; events tracked after CleanUp are ignored.
+func (t *tracker) Track(ctx context.Context, event *models.Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.known[event.Device] || t.inFlight[event.Device] || t.pending[event.Device] != nil {
+		return
+	}
+
+	select {
+	case t.work <- tracked{correlationId: CorrelationId(ctx), traceparent: Traceparent(ctx), event: event}:
+		t.inFlight[event.Device] = true
+	default:
+		t.loggingClient.Debug(
+			trackerQueueFullLogMessage(event.Device),
+			LogFieldCorrelationId, CorrelationId(ctx),
+			LogFieldEventId, event.ID,
+			LogFieldDevice, event.Device)
+	}
+}
+
+// Known method returns the number of devices whose metadata has been notified successfully.
+func (t *tracker) Known() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.known)
+}
+
+// Pending method returns the devices whose metadata has not yet been notified successfully, ordered by device name.
+func (t *tracker) Pending() []PendingNotification {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := make([]PendingNotification, 0, len(t.pending))
+	for deviceName, p := range t.pending {
+		result = append(result, PendingNotification{Device: deviceName, Attempts: p.attempts, NextAttempt: p.nextAttempt})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// CleanUp method cancels scheduled retries, notifies queued devices, and ensures the worker() goroutines have
+// completed.
+func (t *tracker) CleanUp() {
+	t.mutex.Lock()
+	t.closed = true
+	for _, p := range t.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	close(t.work)
+	t.mutex.Unlock()
+
+	t.wg.Wait()
+}
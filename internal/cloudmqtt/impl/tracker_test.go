@@ -0,0 +1,371 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	notifyTimeoutForTesting  = time.Second
+	initialBackoffForTesting = 10 * time.Millisecond
+	maxBackoffForTesting     = 40 * time.Millisecond
+)
+
+//
+//  test stubs
+//
+
+// trackerNotifierImpl records notified devices; each call signals entered and, if release is not nil, blocks until
+// release is closed or ctx is done.
+type trackerNotifierImpl struct {
+	mutex     sync.Mutex
+	notified  []string
+	when      []time.Time
+	errs      []error
+	corrIds   []string
+	result    bool
+	failFirst int
+	entered   chan string
+	release   chan struct{}
+}
+
+func newTrackerNotifierImpl(result bool, release chan struct{}) *trackerNotifierImpl {
+	return &trackerNotifierImpl{result: result, entered: make(chan string, 16), release: release}
+}
+
+// newTrackerNotifierImplFailingFirst returns a notifier that fails the first failFirst calls and then succeeds.
+func newTrackerNotifierImplFailingFirst(failFirst int) *trackerNotifierImpl {
+	notifier := newTrackerNotifierImpl(true, nil)
+	notifier.failFirst = failFirst
+	return notifier
+}
+
+func (n *trackerNotifierImpl) notify(ctx context.Context, event *models.Event) bool {
+	n.entered <- event.Device
+	var err error
+	if n.release != nil {
+		select {
+		case <-n.release:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.notified = append(n.notified, event.Device)
+	n.when = append(n.when, time.Now())
+	n.errs = append(n.errs, err)
+	n.corrIds = append(n.corrIds, CorrelationId(ctx))
+	return n.result && err == nil && len(n.notified) > n.failFirst
+}
+
+func (n *trackerNotifierImpl) Notified() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]string(nil), n.notified...)
+}
+
+//
+//  SUT factory
+//
+
+func newTrackerSUT(loggingClient logger.LoggingClient, notifier *trackerNotifierImpl, workers int) *tracker {
+	return newTrackerSUTWithQueueSize(loggingClient, NewMetrics(), notifier, workers, 1)
+}
+
+func newTrackerSUTWithQueueSize(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	notifier *trackerNotifierImpl,
+	workers int,
+	queueSize int) *tracker {
+
+	return NewDeviceTracker(
+		loggingClient,
+		metrics,
+		notifier.notify,
+		workers,
+		notifyTimeoutForTesting,
+		queueSize,
+		initialBackoffForTesting,
+		maxBackoffForTesting,
+		nil)
+}
+
+//
+//  utility and helper functions
+//
+
+func track(sut *tracker, deviceNames ...string) {
+	for _, deviceName := range deviceNames {
+		event := stub.NewEventForDevice(deviceName)
+		sut.Track(WithCorrelationId(context.Background(), event.ID), &event)
+	}
+}
+
+// waitForIdle waits until no notification is queued or in progress.
+func waitForIdle(sut *tracker) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sut.mutex.Lock()
+		idle := len(sut.inFlight) == 0
+		sut.mutex.Unlock()
+		if idle {
+			return
+		}
+	}
+}
+
+// waitForNotified waits until the notifier has been called count times.
+func waitForNotified(notifier *trackerNotifierImpl, count int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(notifier.Notified()) >= count {
+			return
+		}
+	}
+}
+
+func waitForEntered(t *testing.T, notifier *trackerNotifierImpl) string {
+	select {
+	case deviceName := <-notifier.entered:
+		return deviceName
+	case <-time.After(time.Second):
+		assert.Fail(t, "notifier not called")
+		return ""
+	}
+}
+
+//
+//  unit tests
+//
+
+func TestTrackDeduplicatesNotificationInProgress(t *testing.T) {
+	release := make(chan struct{})
+	notifier := newTrackerNotifierImpl(true, release)
+	sut := newTrackerSUT(stub.NewLoggerStub(), notifier, 2)
+
+	track(sut, "device", "device", "device")
+	close(release)
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"device"}, notifier.Notified())
+}
+
+func TestTrackKnownDeviceIsNotNotifiedAgain(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	notifier := newTrackerNotifierImpl(true, nil)
+	sut := newTrackerSUT(loggingClient, notifier, 1)
+
+	track(sut, "device")
+	waitForIdle(sut)
+	track(sut, "device")
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"device"}, notifier.Notified())
+	assert.True(t, loggingClient.SpecificDebugOccurred(DetectedNewDeviceLogMessage("device")))
+}
+
+func TestTrackFailureIsRetriedWithoutLaterEvent(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	notifier := newTrackerNotifierImplFailingFirst(2)
+	sut := newTrackerSUT(loggingClient, notifier, 1)
+
+	track(sut, "device")
+	waitForNotified(notifier, 3)
+	waitForIdle(sut)
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"device", "device", "device"}, notifier.Notified())
+	assert.True(t, loggingClient.SpecificDebugOccurred(DetectedNewDeviceLogMessage("device")))
+	assert.Empty(t, sut.Pending())
+}
+
+func TestTrackRetriesBackOffExponentially(t *testing.T) {
+	notifier := newTrackerNotifierImplFailingFirst(3)
+	sut := newTrackerSUT(stub.NewLoggerStub(), notifier, 1)
+
+	track(sut, "device")
+	waitForNotified(notifier, 4)
+	sut.CleanUp()
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	assert.True(t, notifier.when[1].Sub(notifier.when[0]) >= initialBackoffForTesting)
+	assert.True(t, notifier.when[2].Sub(notifier.when[1]) >= 2*initialBackoffForTesting)
+	assert.True(t, notifier.when[3].Sub(notifier.when[2]) >= 4*initialBackoffForTesting)
+}
+
+func TestTrackBackoffIsLimitedToMaximum(t *testing.T) {
+	sut := newTrackerSUT(stub.NewLoggerStub(), newTrackerNotifierImpl(true, nil), 1)
+	defer sut.CleanUp()
+
+	assert.Equal(
+		t,
+		[]time.Duration{
+			initialBackoffForTesting,
+			2 * initialBackoffForTesting,
+			4 * initialBackoffForTesting,
+			maxBackoffForTesting,
+			maxBackoffForTesting,
+		},
+		[]time.Duration{sut.backoff(1), sut.backoff(2), sut.backoff(3), sut.backoff(4), sut.backoff(100)})
+}
+
+func TestTrackLaterEventDoesNotNotifyDeviceAwaitingRetry(t *testing.T) {
+	notifier := newTrackerNotifierImpl(false, nil)
+	sut := NewDeviceTracker(stub.NewLoggerStub(), NewMetrics(), notifier.notify, 1, notifyTimeoutForTesting, 1, time.Hour, time.Hour, nil)
+
+	track(sut, "device")
+	waitForIdle(sut)
+	track(sut, "device")
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"device"}, notifier.Notified())
+}
+
+func TestTrackPendingNotificationsAreExposed(t *testing.T) {
+	metrics := NewMetrics()
+	notifier := newTrackerNotifierImpl(false, nil)
+	sut := NewDeviceTracker(stub.NewLoggerStub(), metrics, notifier.notify, 1, notifyTimeoutForTesting, 1, time.Hour, time.Hour, nil)
+	before := time.Now()
+
+	track(sut, "device")
+	waitForIdle(sut)
+	pending := sut.Pending()
+	sut.CleanUp()
+
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "device", pending[0].Device)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.True(t, pending[0].NextAttempt.After(before.Add(time.Hour-time.Second)))
+	assert.Equal(t, int64(1), metrics.Counter(MetricPendingNotifications))
+}
+
+func TestTrackNotifiesDevicesConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	notifier := newTrackerNotifierImpl(true, release)
+	sut := newTrackerSUTWithQueueSize(stub.NewLoggerStub(), NewMetrics(), notifier, 2, 2)
+
+	track(sut, "device1", "device2")
+	entered := []string{waitForEntered(t, notifier), waitForEntered(t, notifier)}
+	close(release)
+	sut.CleanUp()
+
+	assert.ElementsMatch(t, []string{"device1", "device2"}, entered)
+}
+
+func TestTrackNotificationIsAbandonedAfterTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	notifier := newTrackerNotifierImpl(true, release)
+	sut := NewDeviceTracker(stub.NewLoggerStub(), NewMetrics(), notifier.notify, 1, 10*time.Millisecond, 1, time.Hour, time.Hour, nil)
+
+	track(sut, "device")
+	sut.CleanUp()
+
+	assert.Equal(t, []error{context.DeadlineExceeded}, notifier.errs)
+}
+
+func TestTrackDefersDeviceWhenQueueFull(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	release := make(chan struct{})
+	notifier := newTrackerNotifierImpl(true, release)
+	sut := newTrackerSUT(loggingClient, notifier, 1)
+
+	track(sut, "device1")
+	waitForEntered(t, notifier)
+	track(sut, "device2", "device3")
+	close(release)
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"device1", "device2"}, notifier.Notified())
+	assert.True(t, loggingClient.SpecificDebugOccurred(trackerQueueFullLogMessage("device3")))
+}
+
+func TestTrackAfterCleanUpIsIgnored(t *testing.T) {
+	notifier := newTrackerNotifierImpl(true, nil)
+	sut := newTrackerSUT(stub.NewLoggerStub(), notifier, 1)
+	sut.CleanUp()
+
+	track(sut, "device")
+
+	assert.Empty(t, notifier.Notified())
+	assert.Equal(t, 0, sut.Known())
+}
+
+func TestTrackCallsNotifiedOnlyAfterSuccessfulNotification(t *testing.T) {
+	notifier := newTrackerNotifierImplFailingFirst(1)
+	var mutex sync.Mutex
+	var released []string
+	sut := NewDeviceTracker(
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		notifier.notify,
+		1,
+		notifyTimeoutForTesting,
+		1,
+		initialBackoffForTesting,
+		maxBackoffForTesting,
+		func(deviceName string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			released = append(released, deviceName)
+		})
+
+	track(sut, "device")
+	waitForNotified(notifier, 2)
+	waitForIdle(sut)
+	sut.CleanUp()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"device"}, released)
+}
+
+func TestKnownCountsNotifiedDevices(t *testing.T) {
+	notifier := newTrackerNotifierImpl(true, nil)
+	sut := newTrackerSUTWithQueueSize(stub.NewLoggerStub(), NewMetrics(), notifier, 1, 2)
+
+	track(sut, "device1", "device2")
+	waitForNotified(notifier, 2)
+	waitForIdle(sut)
+	sut.CleanUp()
+
+	assert.Equal(t, 2, sut.Known())
+}
+
+func TestNotifierContextCarriesCorrelationId(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	notifier := newTrackerNotifierImpl(true, nil)
+	sut := newTrackerSUT(loggingClient, notifier, 1)
+	event := stub.NewEventForDevice("device")
+
+	sut.Track(WithCorrelationId(context.Background(), "correlation"), &event)
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"correlation"}, notifier.corrIds)
+	assert.True(
+		t,
+		loggingClient.SpecificFieldOccurred(DetectedNewDeviceLogMessage("device"), LogFieldCorrelationId, "correlation"))
+}
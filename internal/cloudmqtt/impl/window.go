@@ -0,0 +1,127 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+	"time"
+)
+
+// inFlight is a published message, whether its transmission has completed, and whether it was transmitted (rather
+// than abandoned).
+type inFlight struct {
+	message     contract.Message
+	sent        bool
+	transmitted bool
+}
+
+// window is a receiver wrapping a Sender implementation that keeps up to a fixed number of messages in flight,
+// retrying each until it succeeds; Pushed (or Dropped, if abandoned) is called for each message in the order the
+// messages were published.
+type window struct {
+	loggingClient                logger.LoggingClient
+	metrics                      contract.Metrics
+	tracer                       contract.Tracer
+	sendFailureWaitInNanoseconds time.Duration
+	shutdown                     *shutdown
+	send                         contract.Sender
+	slots                        chan struct{}
+	mutex                        sync.Mutex
+	completeMutex                sync.Mutex
+	pending                      []*inFlight
+	wg                           sync.WaitGroup
+}
+
+// NewWindowPublisher is a constructor that returns an instance of window configured to keep up to size messages in
+// flight and to wait sendFailureWaitInNanoseconds between failed transmission attempts until shutdown's grace period
+// has elapsed.
+func NewWindowPublisher(
+	loggingClient logger.LoggingClient,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
+	size int,
+	sendFailureWaitInNanoseconds time.Duration,
+	shutdown *shutdown,
+	send contract.Sender) *window {
+
+	if size < 1 {
+		size = 1
+	}
+	return &window{
+		loggingClient:                loggingClient,
+		metrics:                      metrics,
+		tracer:                       tracer,
+		sendFailureWaitInNanoseconds: sendFailureWaitInNanoseconds,
+		shutdown:                     shutdown,
+		send:                         send,
+		slots:                        make(chan struct{}, size),
+	}
+}
+
+// transmit method is executed as goroutine by Publish() and is responsible for transmitting a single message.
+func (w *window) transmit(entry *inFlight) {
+	defer w.wg.Done()
+
+	transmitted := transmit(
+		w.loggingClient,
+		w.metrics,
+		w.tracer,
+		w.sendFailureWaitInNanoseconds,
+		w.shutdown,
+		w.send,
+		entry.message)
+
+	w.completeMutex.Lock()
+	defer w.completeMutex.Unlock()
+
+	w.mutex.Lock()
+	entry.sent, entry.transmitted = true, transmitted
+	var completed []*inFlight
+	for len(w.pending) > 0 && w.pending[0].sent {
+		completed = append(completed, w.pending[0])
+		w.pending = w.pending[1:]
+	}
+	w.mutex.Unlock()
+
+	for _, entry := range completed {
+		if entry.transmitted {
+			entry.message.Pushed()
+		} else {
+			discard(entry.message)
+		}
+		<-w.slots
+	}
+}
+
+// Publish method implements Publisher contract; it blocks until fewer than the configured number of messages are in
+// flight and then transmits the message asynchronously.
+func (w *window) Publish(message contract.Message) {
+	w.slots <- struct{}{}
+
+	entry := &inFlight{message: message}
+	w.mutex.Lock()
+	w.pending = append(w.pending, entry)
+	w.mutex.Unlock()
+
+	w.wg.Add(1)
+	go w.transmit(entry)
+}
+
+// CleanUp method waits for messages in flight to be transmitted (or abandoned).
+func (w *window) CleanUp() {
+	w.wg.Wait()
+}
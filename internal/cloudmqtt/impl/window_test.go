@@ -0,0 +1,236 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkServerEnvironmentVariable names the environment variable identifying the local broker (e.g.
+// tcp://localhost:1883) used by BenchmarkWindowPublisherLocalBroker.
+const benchmarkServerEnvironmentVariable = "CLOUDMQTT_BENCHMARK_SERVER"
+
+//
+//  test stubs
+//
+
+// concurrentSenderImpl is a thread-safe Sender whose result and duration are determined per call by resultFunc.
+type concurrentSenderImpl struct {
+	inFlight    int32
+	maxInFlight int32
+	resultFunc  func(data []byte) bool
+}
+
+func newConcurrentSenderImpl(resultFunc func(data []byte) bool) *concurrentSenderImpl {
+	return &concurrentSenderImpl{resultFunc: resultFunc}
+}
+
+func (s *concurrentSenderImpl) Send(ctx context.Context, data []byte) bool {
+	inFlight := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if inFlight <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+	return s.resultFunc(data)
+}
+
+// pushedRecorderImpl records the order in which messages are pushed.
+type pushedRecorderImpl struct {
+	mutex  sync.Mutex
+	pushed []string
+}
+
+func (p *pushedRecorderImpl) message(data string) contract.Message {
+	return contract.Message{
+		Data: []byte(data),
+		Pushed: func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			p.pushed = append(p.pushed, data)
+		},
+	}
+}
+
+func (p *pushedRecorderImpl) Pushed() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.pushed...)
+}
+
+//
+//  SUT factory
+//
+
+func newWindowPublisherSUT(size int, sender contract.Sender) *window {
+	return NewWindowPublisher(
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		NewNopTracer(),
+		size,
+		sendFailureWaitInNanosecondsForTesting,
+		NewShutdown(0),
+		sender)
+}
+
+//
+//  utility and helper functions
+//
+
+func publishAndWait(b *testing.B, size int, sender contract.Sender) {
+	sut := newWindowPublisherSUT(size, sender)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sut.Publish(contract.Message{Data: []byte(fmt.Sprintf(`{"sequence":%d}`, i)), Pushed: func() {}})
+	}
+	sut.CleanUp()
+}
+
+//
+//  unit tests
+//
+
+func TestWindowPushedCalledInPublishOrder(t *testing.T) {
+	fastSent := make(chan struct{})
+	sender := newConcurrentSenderImpl(func(data []byte) bool {
+		switch string(data) {
+		case "slow":
+			<-fastSent
+		case "fast2":
+			close(fastSent)
+		}
+		return true
+	})
+	recorder := &pushedRecorderImpl{}
+	sut := newWindowPublisherSUT(4, sender.Send)
+
+	for _, data := range []string{"slow", "fast1", "fast2"} {
+		sut.Publish(recorder.message(data))
+	}
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"slow", "fast1", "fast2"}, recorder.Pushed())
+}
+
+func TestWindowLimitsMessagesInFlight(t *testing.T) {
+	release := make(chan struct{})
+	sender := newConcurrentSenderImpl(func(data []byte) bool {
+		<-release
+		return true
+	})
+	recorder := &pushedRecorderImpl{}
+	sut := newWindowPublisherSUT(2, sender.Send)
+	sut.Publish(recorder.message("1"))
+	sut.Publish(recorder.message("2"))
+
+	published := make(chan struct{})
+	go func() {
+		sut.Publish(recorder.message("3"))
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		assert.Fail(t, "publish did not wait for window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-published
+	sut.CleanUp()
+
+	assert.Equal(t, []string{"1", "2", "3"}, recorder.Pushed())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&sender.maxInFlight))
+}
+
+func TestWindowRetriesUntilSendSucceeds(t *testing.T) {
+	var calls int32
+	sender := newConcurrentSenderImpl(func(data []byte) bool {
+		return atomic.AddInt32(&calls, 1) > 2
+	})
+	recorder := &pushedRecorderImpl{}
+	sut := newWindowPublisherSUT(4, sender.Send)
+
+	sut.Publish(recorder.message("data"))
+	sut.CleanUp()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"data"}, recorder.Pushed())
+}
+
+//
+//  benchmarks
+//
+
+// BenchmarkWindowPublisherSimulatedRoundTrip demonstrates the effect of the window size when each send waits for a
+// simulated 1ms broker round trip.
+func BenchmarkWindowPublisherSimulatedRoundTrip(b *testing.B) {
+	sender := func(ctx context.Context, data []byte) bool {
+		time.Sleep(time.Millisecond)
+		return true
+	}
+	for _, size := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("window=%d", size), func(b *testing.B) {
+			publishAndWait(b, size, sender)
+		})
+	}
+}
+
+// BenchmarkWindowPublisherLocalBroker demonstrates the effect of the window size when publishing to the local broker
+// identified by the CLOUDMQTT_BENCHMARK_SERVER environment variable; e.g.:
+//
+//	CLOUDMQTT_BENCHMARK_SERVER=tcp://localhost:1883 go test -run none -bench LocalBroker ./internal/cloudmqtt/impl
+func BenchmarkWindowPublisherLocalBroker(b *testing.B) {
+	server := os.Getenv(benchmarkServerEnvironmentVariable)
+	if len(server) == 0 {
+		b.Skip(benchmarkServerEnvironmentVariable + " not set")
+	}
+
+	topic := "cloudmqtt/benchmark/" + uuid.New().String()
+	q, err := NewMqttInstanceForCloud(
+		stub.NewLoggerStub(),
+		NewMetrics(),
+		"",
+		"",
+		uuid.New().String(),
+		"",
+		"",
+		server,
+		topic,
+		topic,
+		topic+"/commands",
+		func(contract.Command) {})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer q.CleanUp()
+
+	for _, size := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("window=%d", size), func(b *testing.B) {
+			publishAndWait(b, size, q.EventSender)
+		})
+	}
+}
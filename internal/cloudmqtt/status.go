@@ -0,0 +1,96 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package cloudmqtt
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
+	"time"
+)
+
+// Version identifies the service's build; set at build time with -ldflags "-X
+// github.com/michaelestrin/cloudmqtt/internal/cloudmqtt.Version=<version>".
+var Version = "dev"
+
+// PendingNotificationStatus describes a device whose metadata has not yet been notified successfully for the
+// heartbeat; NextAttempt is milliseconds since the epoch (zero while an attempt is queued or in progress).
+type PendingNotificationStatus struct {
+	Device      string `json:"device"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"nextAttempt"`
+}
+
+// GatewayStatus describes the service's state for the heartbeat; Uptime is in seconds and LastErrorTime is
+// milliseconds since the epoch (zero if no error has been logged).
+type GatewayStatus struct {
+	Uptime               int64                       `json:"uptime"`
+	Version              string                      `json:"version"`
+	KnownDevices         int                         `json:"knownDevices"`
+	PendingNotifications []PendingNotificationStatus `json:"pendingNotifications"`
+	ActiveServer         string                      `json:"activeServer"`
+	OutboundBacklog      int64                       `json:"outboundBacklog"`
+	EventsReceived       int64                       `json:"eventsReceived"`
+	EventsSent           int64                       `json:"eventsSent"`
+	EventsFailed         int64                       `json:"eventsFailed"`
+	MessagesSent         int64                       `json:"messagesSent"`
+	SendFailures         int64                       `json:"sendFailures"`
+	LastError            string                      `json:"lastError"`
+	LastErrorTime        int64                       `json:"lastErrorTime"`
+}
+
+// statusCounter defines interface for reading the counters reported in GatewayStatus.
+type statusCounter interface {
+	Counter(name string) int64
+	Sum(name string) int64
+}
+
+// gatewayStatus function returns the service's status as of now given the service's start time, its counters, the
+// number of devices whose metadata has been sent, the devices whose metadata is awaiting a retry, the MQTT server in
+// use, and the last error logged.
+func gatewayStatus(
+	started time.Time,
+	now time.Time,
+	counters statusCounter,
+	knownDevices int,
+	pending []impl.PendingNotification,
+	activeServer string,
+	lastError string,
+	lastErrorTime time.Time) GatewayStatus {
+
+	status := GatewayStatus{
+		Uptime:               int64(now.Sub(started) / time.Second),
+		Version:              Version,
+		KnownDevices:         knownDevices,
+		PendingNotifications: make([]PendingNotificationStatus, 0, len(pending)),
+		ActiveServer:         activeServer,
+		OutboundBacklog:      counters.Counter(MetricOutboundBacklog),
+		EventsReceived:       counters.Counter(MetricEventsReceived),
+		EventsSent:           counters.Counter(MetricEventsSent),
+		EventsFailed:         counters.Counter(MetricEventsFailed),
+		MessagesSent:         counters.Sum(impl.MetricMqttSentBase),
+		SendFailures:         counters.Sum(impl.MetricMqttFailuresBase),
+		LastError:            lastError,
+	}
+	for _, p := range pending {
+		notification := PendingNotificationStatus{Device: p.Device, Attempts: p.Attempts}
+		if !p.NextAttempt.IsZero() {
+			notification.NextAttempt = p.NextAttempt.UnixNano() / int64(time.Millisecond)
+		}
+		status.PendingNotifications = append(status.PendingNotifications, notification)
+	}
+	if !lastErrorTime.IsZero() {
+		status.LastErrorTime = lastErrorTime.UnixNano() / int64(time.Millisecond)
+	}
+	return status
+}
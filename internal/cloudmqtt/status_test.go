@@ -0,0 +1,85 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package cloudmqtt
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+//  unit tests
+//
+
+func TestGatewayStatusReportsCounters(t *testing.T) {
+	metrics := impl.NewMetrics()
+	metrics.Increment(MetricEventsReceived, 5)
+	metrics.Increment(MetricEventsSent, 3)
+	metrics.Increment(MetricEventsFailed, 1)
+	metrics.Increment(MetricOutboundBacklog, 1)
+	metrics.Increment(impl.MetricMqttSent("events"), 3)
+	metrics.Increment(impl.MetricMqttSent("newDevices"), 2)
+	metrics.Increment(impl.MetricMqttSendFailures("events"), 4)
+	started := time.Now()
+	lastErrorTime := started.Add(time.Second)
+
+	nextAttempt := started.Add(time.Minute)
+	pending := []impl.PendingNotification{
+		{Device: "device1", Attempts: 1},
+		{Device: "device2", Attempts: 3, NextAttempt: nextAttempt},
+	}
+
+	status := gatewayStatus(
+		started,
+		started.Add(90*time.Second),
+		metrics,
+		2,
+		pending,
+		"ssl://primary:8883",
+		"error",
+		lastErrorTime)
+
+	assert.Equal(
+		t,
+		GatewayStatus{
+			Uptime:       90,
+			Version:      Version,
+			KnownDevices: 2,
+			PendingNotifications: []PendingNotificationStatus{
+				{Device: "device1", Attempts: 1},
+				{Device: "device2", Attempts: 3, NextAttempt: nextAttempt.UnixNano() / int64(time.Millisecond)},
+			},
+			ActiveServer:    "ssl://primary:8883",
+			OutboundBacklog: 1,
+			EventsReceived:  5,
+			EventsSent:      3,
+			EventsFailed:    1,
+			MessagesSent:    5,
+			SendFailures:    4,
+			LastError:       "error",
+			LastErrorTime:   lastErrorTime.UnixNano() / int64(time.Millisecond),
+		},
+		status)
+}
+
+func TestGatewayStatusWithoutErrorHasZeroLastErrorTime(t *testing.T) {
+	started := time.Now()
+
+	status := gatewayStatus(started, started, impl.NewMetrics(), 0, nil, "", "", time.Time{})
+
+	assert.Equal(t, int64(0), status.LastErrorTime)
+}
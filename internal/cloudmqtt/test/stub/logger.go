@@ -14,10 +14,18 @@
 
 package stub
 
+import "sync"
+
+type logEntry struct {
+	msg  string
+	args []interface{}
+}
+
 type loggingClient struct {
-	errors   []string
-	warnings []string
-	debugs   []string
+	mutex    sync.Mutex
+	errors   []logEntry
+	warnings []logEntry
+	debugs   []logEntry
 }
 
 func NewLoggerStub() *loggingClient {
@@ -29,23 +37,31 @@ func (l *loggingClient) SetLogLevel(logLevel string) error {
 }
 
 func (l *loggingClient) Debug(msg string, args ...interface{}) {
-	l.debugs = append(l.debugs, msg)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.debugs = append(l.debugs, logEntry{msg: msg, args: args})
 }
 
 func (l *loggingClient) Error(msg string, args ...interface{}) {
-	l.errors = append(l.errors, msg)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.errors = append(l.errors, logEntry{msg: msg, args: args})
 }
 
 func (l *loggingClient) Info(msg string, args ...interface{})  {}
 func (l *loggingClient) Trace(msg string, args ...interface{}) {}
 
 func (l *loggingClient) Warn(msg string, args ...interface{}) {
-	l.warnings = append(l.warnings, msg)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.warnings = append(l.warnings, logEntry{msg: msg, args: args})
 }
 
-func (l *loggingClient) occurred(msgs []string, expectedMessage string) bool {
-	for _, msg := range msgs {
-		if msg == expectedMessage {
+func (l *loggingClient) occurred(entries *[]logEntry, expectedMessage string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, entry := range *entries {
+		if entry.msg == expectedMessage {
 			return true
 		}
 	}
@@ -53,17 +69,37 @@ func (l *loggingClient) occurred(msgs []string, expectedMessage string) bool {
 }
 
 func (l *loggingClient) SpecificDebugOccurred(expectedMessage string) bool {
-	return l.occurred(l.debugs, expectedMessage)
+	return l.occurred(&l.debugs, expectedMessage)
 }
 
 func (l *loggingClient) ErrorsOccurred() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return len(l.errors) > 0
 }
 
 func (l *loggingClient) SpecificErrorOccurred(expectedMessage string) bool {
-	return l.occurred(l.errors, expectedMessage)
+	return l.occurred(&l.errors, expectedMessage)
 }
 
 func (l *loggingClient) SpecificWarningOccurred(expectedMessage string) bool {
-	return l.occurred(l.warnings, expectedMessage)
+	return l.occurred(&l.warnings, expectedMessage)
+}
+
+func (l *loggingClient) SpecificFieldOccurred(expectedMessage string, key string, value interface{}) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, entries := range [][]logEntry{l.errors, l.warnings, l.debugs} {
+		for _, entry := range entries {
+			if entry.msg != expectedMessage {
+				continue
+			}
+			for i := 0; i+1 < len(entry.args); i += 2 {
+				if entry.args[i] == key && entry.args[i+1] == value {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
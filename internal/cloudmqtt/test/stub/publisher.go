@@ -0,0 +1,48 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *******************************************************************************/
+
+package stub
+
+import (
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"sync"
+)
+
+type Publisher struct {
+	mutex     sync.Mutex
+	published []contract.Message
+}
+
+func NewPublisherImpl() *Publisher {
+	return &Publisher{}
+}
+
+func (p *Publisher) Publish(message contract.Message) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.published = append(p.published, message)
+}
+
+func (p *Publisher) Published() []contract.Message {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]contract.Message(nil), p.published...)
+}
+
+// PushAll calls Pushed() for each message published so far.
+func (p *Publisher) PushAll() {
+	for _, message := range p.Published() {
+		message.Pushed()
+	}
+}
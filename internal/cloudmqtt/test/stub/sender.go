@@ -14,12 +14,16 @@
 
 package stub
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type SendResultFunc func() bool
 
 type SentInstance struct {
 	When time.Time
+	Ctx  context.Context
 	Data []byte
 }
 
@@ -43,8 +47,8 @@ func NewSenderImpl() *Sender {
 		})
 }
 
-func (s *Sender) Send(data []byte) bool {
+func (s *Sender) Send(ctx context.Context, data []byte) bool {
 	s.SendCalledCount++
-	s.Sent = append(s.Sent, SentInstance{When: time.Now(), Data: data})
+	s.Sent = append(s.Sent, SentInstance{When: time.Now(), Ctx: ctx, Data: data})
 	return s.sendResultFunc()
 }
@@ -15,74 +15,66 @@
 package cloudmqtt
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/edgexfoundry/app-functions-sdk-go/appcontext"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	"github.com/edgexfoundry/go-mod-core-contracts/models"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
-	"sync"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
 	"time"
 )
 
+const (
+	MetricEventsReceived       = "cloudmqtt_events_received_total"
+	MetricEventsSent           = "cloudmqtt_events_sent_total"
+	MetricEventsFailed         = "cloudmqtt_events_failed_total"
+	MetricEventMarshalFailures = `cloudmqtt_marshal_failures_total{type="event"}`
+	MetricOutboundBacklog      = "cloudmqtt_outbound_backlog"
+	MetricPublishLatency       = "cloudmqtt_publish_latency_seconds"
+)
+
 // transport is a receiver wrapping a generic event and metadata export adapter.
 type transport struct {
-	loggingClient                logger.LoggingClient
-	sendFailureWaitInNanoseconds time.Duration
-	send                         contract.Sender
-	notify                       contract.Notifier
-	marshal                      contract.Marshaller
-	cleanUp                      contract.CleanUp
-	wg                           sync.WaitGroup
-	events                       chan *models.Event
+	loggingClient logger.LoggingClient
+	metrics       contract.Metrics
+	tracer        contract.Tracer
+	filter        contract.Filter
+	prioritize    contract.Prioritizer
+	publish       contract.Publisher
+	track         contract.Tracker
+	marshal       contract.Marshaller
+	cleanUp       contract.CleanUp
 }
 
 // NewTransport is a constructor that returns a configured transport receiver whose Run() method can be included in
 // a call to the EdgeX Applications Functions SDK's SetFunctionsPipeline() method.
 func NewTransport(
 	loggingClient logger.LoggingClient,
-	sendFailureWaitInNanoseconds time.Duration,
-	send contract.Sender,
-	notify contract.Notifier,
+	metrics contract.Metrics,
+	tracer contract.Tracer,
+	filter contract.Filter,
+	prioritize contract.Prioritizer,
+	publish contract.Publisher,
+	track contract.Tracker,
 	marshal contract.Marshaller,
 	cleanUp contract.CleanUp) *transport {
 
-	t := &transport{
-		loggingClient:                loggingClient,
-		sendFailureWaitInNanoseconds: sendFailureWaitInNanoseconds,
-		send:                         send,
-		notify:                       notify,
-		marshal:                      marshal,
-		cleanUp:                      cleanUp,
-		events:                       make(chan *models.Event, 16),
+	return &transport{
+		loggingClient: loggingClient,
+		metrics:       metrics,
+		tracer:        tracer,
+		filter:        filter,
+		prioritize:    prioritize,
+		publish:       publish,
+		track:         track,
+		marshal:       marshal,
+		cleanUp:       cleanUp,
 	}
-	t.wg.Add(1)
-	go t.newDeviceHandler()
-	return t
-}
-
-// detectedNewDeviceLogMessage function formats and returns the log message for when a new device is detected.
-func detectedNewDeviceLogMessage(deviceName string) string {
-	return fmt.Sprintf("detected new device %s", deviceName)
 }
 
-// newDeviceHandler method is executed as goroutine by constructor and is responsible for tracking known devices and
-// calling Notifier implementation for new devices.
-func (t *transport) newDeviceHandler() {
-	defer t.wg.Done()
-
-	devices := make(map[string]bool)
-	for event := range t.events {
-		_, ok := devices[event.Device]
-		if !ok {
-			if t.notify(event) {
-				devices[event.Device] = true
-				t.loggingClient.Debug(detectedNewDeviceLogMessage(event.Device))
-			}
-		}
-	}
-}
-
-// newDeviceHandler function formats and returns the log message for when an attempt to marshal a type fails.
+// marshalFailedLogMessage function formats and returns the log message for when an attempt to marshal a type fails.
 func marshalFailedLogMessage(eventId string, errorMessage string) string {
 	return fmt.Sprintf("marshal failed for %s (%s)", eventId, errorMessage)
 }
@@ -92,27 +84,94 @@ func sentLogMessage(eventId string) string {
 	return fmt.Sprintf("sent for %s", eventId)
 }
 
-// handleEvent method transmits an event northbound.
-func (t *transport) handleEvent(EdgeXContext contract.EdgeXContext, event *models.Event) {
+// droppedLogMessage function formats and returns the log message for when an event will not be sent northbound because
+// it was dropped or abandoned.
+func droppedLogMessage(eventId string) string {
+	return fmt.Sprintf("dropped %s", eventId)
+}
+
+// correlationIdFor function returns the correlation ID of the EdgeX request that delivered an event; the event's ID is
+// used if the request has none.
+func correlationIdFor(EdgeXContext contract.EdgeXContext, event *models.Event) string {
+	if c, ok := EdgeXContext.(*sharedContext); ok {
+		return correlationIdFor(c.EdgeXContext, event)
+	}
+	if c, ok := EdgeXContext.(*appcontext.Context); ok && len(c.CorrelationID) > 0 {
+		return c.CorrelationID
+	}
+	return event.ID
+}
+
+// handleEvent method queues an event for northbound transmission; the event is marked as pushed and leaves the
+// outbound backlog once it has been transmitted or dropped (it is also marked as pushed if it cannot be marshalled).
+// Publish latency is measured from received; ctx carries the event's correlation ID and span.
+func (t *transport) handleEvent(
+	ctx context.Context,
+	EdgeXContext contract.EdgeXContext,
+	event *models.Event,
+	received time.Time) error {
+
+	correlationId := impl.CorrelationId(ctx)
+	_, endMarshal := t.tracer.Start(ctx, "marshal")
 	bytes, err := t.marshal(event)
+	endMarshal(err)
 	if err != nil {
-		t.loggingClient.Warn(marshalFailedLogMessage(event.ID, err.Error()))
-		return
+		t.loggingClient.Warn(
+			marshalFailedLogMessage(event.ID, err.Error()),
+			impl.LogFieldCorrelationId, correlationId,
+			impl.LogFieldEventId, event.ID,
+			impl.LogFieldDevice, event.Device,
+			impl.LogFieldError, err.Error())
+		t.metrics.Increment(MetricEventMarshalFailures, 1)
+		t.metrics.Increment(MetricEventsFailed, 1)
+		skipped(t.loggingClient, EdgeXContext, correlationId, event.ID, event.Device)
+		return err
 	}
 
-	for {
-		if t.send(bytes) {
-			t.loggingClient.Debug(sentLogMessage(event.ID))
-
-			err = EdgeXContext.MarkAsPushed()
-			if err != nil {
-				t.loggingClient.Error(err.Error())
-			}
-
-			return
-		}
-		time.Sleep(t.sendFailureWaitInNanoseconds)
-	}
+	eventId, deviceName := event.ID, event.Device
+	queueCtx, endQueue := t.tracer.Start(ctx, "queue")
+	t.metrics.Increment(MetricOutboundBacklog, 1)
+	t.publish(
+		contract.Message{
+			Data:          bytes,
+			Device:        deviceName,
+			CorrelationId: correlationId,
+			Traceparent:   impl.Traceparent(queueCtx),
+			Priority:      t.prioritize(event),
+			Pushed: func() {
+				latency := time.Since(received)
+				endQueue(nil)
+				t.loggingClient.Debug(
+					sentLogMessage(eventId),
+					impl.LogFieldCorrelationId, correlationId,
+					impl.LogFieldEventId, eventId,
+					impl.LogFieldDevice, deviceName,
+					impl.LogFieldLatency, latency)
+				t.metrics.Increment(MetricOutboundBacklog, -1)
+				t.metrics.Increment(MetricEventsSent, 1)
+				t.metrics.Observe(MetricPublishLatency, latency.Seconds())
+
+				if err := EdgeXContext.MarkAsPushed(); err != nil {
+					t.loggingClient.Error(
+						err.Error(),
+						impl.LogFieldCorrelationId, correlationId,
+						impl.LogFieldEventId, eventId,
+						impl.LogFieldDevice, deviceName,
+						impl.LogFieldError, err.Error())
+				}
+			},
+			Dropped: func() {
+				endQueue(errors.New("dropped"))
+				t.loggingClient.Debug(
+					droppedLogMessage(eventId),
+					impl.LogFieldCorrelationId, correlationId,
+					impl.LogFieldEventId, eventId,
+					impl.LogFieldDevice, deviceName)
+				t.metrics.Increment(MetricOutboundBacklog, -1)
+				skipped(t.loggingClient, EdgeXContext, correlationId, eventId, deviceName)
+			},
+		})
+	return nil
 }
 
 // run method is internal implementation delegated to by publicly accessible Run(); implemented to facilitate
@@ -120,8 +179,22 @@ func (t *transport) handleEvent(EdgeXContext contract.EdgeXContext, event *model
 func (t *transport) run(EdgeXContext contract.EdgeXContext, params ...interface{}) (bool, interface{}) {
 	for _, param := range params {
 		if event, ok := param.(models.Event); ok {
-			t.events <- &event
-			t.handleEvent(EdgeXContext, &event)
+			received := time.Now()
+			t.metrics.Increment(MetricEventsReceived, 1)
+			correlationId := correlationIdFor(EdgeXContext, &event)
+			ctx, end := t.tracer.Start(
+				impl.WithCorrelationId(context.Background(), correlationId),
+				"transport.Run",
+				impl.LogFieldCorrelationId, correlationId,
+				impl.LogFieldEventId, event.ID,
+				impl.LogFieldDevice, event.Device)
+			if !t.filter(&event) {
+				end(nil, "filtered", "true")
+				skipped(t.loggingClient, EdgeXContext, correlationId, event.ID, event.Device)
+				continue
+			}
+			t.track(ctx, &event)
+			end(t.handleEvent(ctx, EdgeXContext, &event, received))
 		}
 	}
 	return true, params
@@ -133,9 +206,7 @@ func (t *transport) Run(EdgeXContext *appcontext.Context, params ...interface{})
 	return t.run(EdgeXContext, params[0])
 }
 
-// CleanUp method ensures the newDeviceHandler() goroutine has completed.
+// CleanUp method performs end of execution clean up activity.
 func (t *transport) CleanUp() {
-	close(t.events)
-	t.wg.Wait()
 	t.cleanUp()
 }
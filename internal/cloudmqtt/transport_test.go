@@ -15,27 +15,38 @@
 package cloudmqtt
 
 import (
+	"context"
 	"encoding/json"
+	"github.com/edgexfoundry/app-functions-sdk-go/appcontext"
 	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	"github.com/edgexfoundry/go-mod-core-contracts/models"
 	"github.com/google/uuid"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/contract"
+	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/impl"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/helper"
 	"github.com/michaelestrin/cloudmqtt/internal/cloudmqtt/test/stub"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
-const sendFailureWaitInNanosecondsForTesting = 50000000
+const (
+	sendFailureWaitInNanosecondsForTesting = 50000000
+	notifyTimeoutForTesting                = time.Second
+	notifyBackoffForTesting                = time.Hour
+)
 
 //
 //  test stubs
 //
 
 type notifierImpl struct {
+	mutex             sync.Mutex
 	NotifyCalledCount int
 	Notified          []models.Event
+	CorrelationIds    []string
 	notifyResult      bool
 }
 
@@ -50,9 +61,12 @@ func newNotifierImpl() *notifierImpl {
 	return newNotifierImplWithSpecificResult(true)
 }
 
-func (n *notifierImpl) notify(event *models.Event) bool {
+func (n *notifierImpl) notify(ctx context.Context, event *models.Event) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.NotifyCalledCount++
 	n.Notified = append(n.Notified, *event)
+	n.CorrelationIds = append(n.CorrelationIds, impl.CorrelationId(ctx))
 	return n.notifyResult
 }
 
@@ -77,6 +91,27 @@ func (e *edgeXContextImpl) MarkAsPushed() error {
 	return e.markAsPushedResult
 }
 
+type filterImpl struct {
+	FilterCalledCount int
+	filterResult      bool
+}
+
+func newFilterImplWithSpecificResult(filterResult bool) *filterImpl {
+	return &filterImpl{
+		FilterCalledCount: 0,
+		filterResult:      filterResult,
+	}
+}
+
+func newFilterImpl() *filterImpl {
+	return newFilterImplWithSpecificResult(true)
+}
+
+func (f *filterImpl) filter(event *models.Event) bool {
+	f.FilterCalledCount++
+	return f.filterResult
+}
+
 type cleanUpImpl struct {
 	CleanUpCalledCount int
 }
@@ -91,6 +126,12 @@ func (c *cleanUpImpl) CleanUp() {
 	c.CleanUpCalledCount++
 }
 
+func prioritizeImpl(priority int) contract.Prioritizer {
+	return func(event *models.Event) int {
+		return priority
+	}
+}
+
 //
 //  SUT factory
 //
@@ -102,7 +143,46 @@ func newTransportSUT(
 	marshal contract.Marshaller,
 	cleanUp contract.CleanUp) *transport {
 
-	return NewTransport(loggingClient, sendFailureWaitInNanosecondsForTesting, sender, notifier, marshal, cleanUp)
+	return newTransportSUTWithFilter(loggingClient, newFilterImpl().filter, sender, notifier, marshal, cleanUp)
+}
+
+func newTransportSUTWithFilter(
+	loggingClient logger.LoggingClient,
+	filter contract.Filter,
+	sender contract.Sender,
+	notifier contract.Notifier,
+	marshal contract.Marshaller,
+	cleanUp contract.CleanUp) *transport {
+
+	tracker := impl.NewDeviceTracker(
+		loggingClient,
+		impl.NewMetrics(),
+		notifier,
+		1,
+		notifyTimeoutForTesting,
+		16,
+		notifyBackoffForTesting,
+		notifyBackoffForTesting,
+		nil)
+	return NewTransport(
+		loggingClient,
+		impl.NewMetrics(),
+		impl.NewNopTracer(),
+		filter,
+		prioritizeImpl(impl.PriorityNormal),
+		impl.NewRetryPublisher(
+			loggingClient,
+			impl.NewMetrics(),
+			impl.NewNopTracer(),
+			sendFailureWaitInNanosecondsForTesting,
+			impl.NewShutdown(0),
+			sender).Publish,
+		tracker.Track,
+		marshal,
+		func() {
+			tracker.CleanUp()
+			cleanUp()
+		})
 }
 
 //
@@ -317,6 +397,21 @@ func TestMarshalFailureDoesNotCallSender(t *testing.T) {
 	assert.Equal(t, 0, sender.SendCalledCount)
 }
 
+func TestMarshalFailureMarksEventAsPushed(t *testing.T) {
+	edgeXContext := newEdgeXContextImpl()
+	sut := newTransportSUT(
+		stub.NewLoggerStub(),
+		stub.NewSenderImpl().Send,
+		newNotifierImpl().notify,
+		helper.FactoryJsonMarshalFuncReturnsFailureOnFirstCall(),
+		newCleanUpImpl().CleanUp)
+
+	sut.run(edgeXContext, stub.NewEvent())
+	sut.CleanUp()
+
+	assert.Equal(t, 1, edgeXContext.MarkAsPushedCalledCount)
+}
+
 func TestMarshalFailureOnlyAffectsFailedParameter(t *testing.T) {
 	sender := stub.NewSenderImpl()
 	sut := newTransportSUT(
@@ -461,7 +556,7 @@ func TestNotifierSuccessLogsDebug(t *testing.T) {
 	sut.run(newEdgeXContextImpl(), event)
 	sut.CleanUp()
 
-	assert.True(t, loggingClient.SpecificDebugOccurred(detectedNewDeviceLogMessage(event.Device)))
+	assert.True(t, loggingClient.SpecificDebugOccurred(impl.DetectedNewDeviceLogMessage(event.Device)))
 }
 
 func TestNotifierFailureDoesNotCauseLoggedDebug(t *testing.T) {
@@ -473,7 +568,7 @@ func TestNotifierFailureDoesNotCauseLoggedDebug(t *testing.T) {
 	sut.run(newEdgeXContextImpl(), event)
 	sut.CleanUp()
 
-	assert.False(t, loggingClient.SpecificDebugOccurred(detectedNewDeviceLogMessage(event.Device)))
+	assert.False(t, loggingClient.SpecificDebugOccurred(impl.DetectedNewDeviceLogMessage(event.Device)))
 }
 
 func TestNotifierSuccessDoesNotCallNotifierAgainForSameDevice(t *testing.T) {
@@ -488,15 +583,62 @@ func TestNotifierSuccessDoesNotCallNotifierAgainForSameDevice(t *testing.T) {
 	assert.Equal(t, event, notifier.Notified[0])
 }
 
-func TestNotifierFailureCallsNotifierAgainForSameDevice(t *testing.T) {
-	notifier := newNotifierImplWithSpecificResult(false)
-	sut := newTransportSUT(stub.NewLoggerStub(), stub.NewSenderImpl().Send, notifier.notify, json.Marshal, newCleanUpImpl().CleanUp)
+func TestCallWithEventParameterCallsFilterOnce(t *testing.T) {
+	filter := newFilterImpl()
+	sut := newTransportSUTWithFilter(
+		stub.NewLoggerStub(),
+		filter.filter,
+		stub.NewSenderImpl().Send,
+		newNotifierImpl().notify,
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	sut.CleanUp()
+
+	assert.Equal(t, 1, filter.FilterCalledCount)
+}
+
+func TestFilterRejectionDoesNotCallSenderOrNotifierButMarksEventAsPushed(t *testing.T) {
+	sender := stub.NewSenderImpl()
+	notifier := newNotifierImpl()
+	edgeXContext := newEdgeXContextImpl()
+	sut := newTransportSUTWithFilter(
+		stub.NewLoggerStub(),
+		newFilterImplWithSpecificResult(false).filter,
+		sender.Send,
+		notifier.notify,
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+
+	sut.run(edgeXContext, stub.NewEvent())
+	sut.CleanUp()
+
+	assert.Equal(t, 0, sender.SendCalledCount)
+	assert.Equal(t, 0, notifier.NotifyCalledCount)
+	assert.Equal(t, 1, edgeXContext.MarkAsPushedCalledCount)
+}
+
+func TestPublishedMessageHasEventDeviceAndPriority(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	sut := NewTransport(
+		stub.NewLoggerStub(),
+		impl.NewMetrics(),
+		impl.NewNopTracer(),
+		newFilterImpl().filter,
+		prioritizeImpl(impl.PriorityHigh),
+		publisher.Publish,
+		func(ctx context.Context, event *models.Event) {},
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
 	event := stub.NewEvent()
 
-	sut.run(newEdgeXContextImpl(), event, event)
+	sut.run(newEdgeXContextImpl(), event)
 	sut.CleanUp()
 
-	assert.Equal(t, 2, notifier.NotifyCalledCount)
+	assert.Equal(t, 1, len(publisher.Published()))
+	assert.Equal(t, event.Device, publisher.Published()[0].Device)
+	assert.Equal(t, impl.PriorityHigh, publisher.Published()[0].Priority)
 }
 
 func TestCleanUpCallsCleanUpImpl(t *testing.T) {
@@ -507,3 +649,175 @@ func TestCleanUpCallsCleanUpImpl(t *testing.T) {
 
 	assert.Equal(t, 1, cleanUp.CleanUpCalledCount)
 }
+
+func TestTransportRecordsEventMetrics(t *testing.T) {
+	metrics := impl.NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	sut := NewTransport(
+		stub.NewLoggerStub(),
+		metrics,
+		impl.NewNopTracer(),
+		newFilterImpl().filter,
+		prioritizeImpl(impl.PriorityNormal),
+		publisher.Publish,
+		func(ctx context.Context, event *models.Event) {},
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	backlog := metrics.Counter(MetricOutboundBacklog)
+	publisher.Published()[0].Pushed()
+	sut.CleanUp()
+
+	assert.Equal(t, int64(2), metrics.Counter(MetricEventsReceived))
+	assert.Equal(t, int64(2), backlog)
+	assert.Equal(t, int64(1), metrics.Counter(MetricOutboundBacklog))
+	assert.Equal(t, int64(1), metrics.Counter(MetricEventsSent))
+	assert.Equal(t, int64(1), metrics.Count(MetricPublishLatency))
+}
+
+func TestEventDroppedByRateLimiterLeavesOutboundBacklogAndIsMarkedAsPushed(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	metrics := impl.NewMetrics()
+	publisher := stub.NewPublisherImpl()
+	limiter, err := impl.NewRateLimiter(
+		loggingClient,
+		metrics,
+		impl.RateLimit{PerSecond: 0.001, Burst: 1},
+		impl.RateLimit{},
+		impl.RateLimitDropNewest,
+		0,
+		1,
+		"",
+		publisher.Publish)
+	assert.Nil(t, err)
+	sut := NewTransport(
+		loggingClient,
+		metrics,
+		impl.NewNopTracer(),
+		newFilterImpl().filter,
+		prioritizeImpl(impl.PriorityNormal),
+		limiter.Publish,
+		func(ctx context.Context, event *models.Event) {},
+		json.Marshal,
+		limiter.CleanUp)
+	dropped, droppedContext := stub.NewEvent(), newEdgeXContextImpl()
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	sut.run(droppedContext, dropped)
+	backlog := metrics.Counter(MetricOutboundBacklog)
+	publisher.PushAll()
+	sut.CleanUp()
+
+	assert.Equal(t, int64(1), backlog)
+	assert.Equal(t, int64(0), metrics.Counter(MetricOutboundBacklog))
+	assert.Equal(t, int64(1), metrics.Counter(MetricEventsSent))
+	assert.Equal(t, 1, droppedContext.MarkAsPushedCalledCount)
+	assert.True(t, loggingClient.SpecificDebugOccurred(droppedLogMessage(dropped.ID)))
+}
+
+func TestSentDebugLogHasCorrelationFields(t *testing.T) {
+	loggingClient := stub.NewLoggerStub()
+	sut := newTransportSUT(
+		loggingClient,
+		stub.NewSenderImpl().Send,
+		newNotifierImpl().notify,
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+	event := stub.NewEvent()
+
+	sut.run(newEdgeXContextImpl(), event)
+	sut.CleanUp()
+
+	assert.True(t, loggingClient.SpecificFieldOccurred(sentLogMessage(event.ID), impl.LogFieldCorrelationId, event.ID))
+	assert.True(t, loggingClient.SpecificFieldOccurred(sentLogMessage(event.ID), impl.LogFieldEventId, event.ID))
+	assert.True(t, loggingClient.SpecificFieldOccurred(sentLogMessage(event.ID), impl.LogFieldDevice, event.Device))
+}
+
+func TestCorrelationIdPropagatesFromEventToNotifier(t *testing.T) {
+	notifier := newNotifierImpl()
+	sut := newTransportSUT(
+		stub.NewLoggerStub(),
+		stub.NewSenderImpl().Send,
+		notifier.notify,
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+	event := stub.NewEvent()
+
+	sut.run(newEdgeXContextImpl(), event)
+	sut.CleanUp()
+
+	assert.Equal(t, []string{event.ID}, notifier.CorrelationIds)
+}
+
+func TestPublishedMessageHasEdgeXCorrelationId(t *testing.T) {
+	publisher := stub.NewPublisherImpl()
+	var tracked []string
+	sut := NewTransport(
+		stub.NewLoggerStub(),
+		impl.NewMetrics(),
+		impl.NewNopTracer(),
+		newFilterImpl().filter,
+		prioritizeImpl(impl.PriorityNormal),
+		publisher.Publish,
+		func(ctx context.Context, event *models.Event) { tracked = append(tracked, impl.CorrelationId(ctx)) },
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+
+	sut.run(&appcontext.Context{CorrelationID: "correlation"}, stub.NewEvent())
+
+	assert.Equal(t, 1, len(publisher.Published()))
+	assert.Equal(t, "correlation", publisher.Published()[0].CorrelationId)
+	assert.Equal(t, []string{"correlation"}, tracked)
+}
+
+func TestEventIsTracedFromRunToPublish(t *testing.T) {
+	var mutex sync.Mutex
+	spans := make(map[string]contract.Span)
+	tracer := impl.NewTracer(
+		stub.NewLoggerStub(),
+		impl.NewMetrics(),
+		func(exported []contract.Span) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, span := range exported {
+				spans[span.Name] = span
+			}
+			return nil
+		},
+		16,
+		time.Hour)
+	var traceparent string
+	sut := NewTransport(
+		stub.NewLoggerStub(),
+		impl.NewMetrics(),
+		tracer,
+		newFilterImpl().filter,
+		prioritizeImpl(impl.PriorityNormal),
+		impl.NewRetryPublisher(
+			stub.NewLoggerStub(),
+			impl.NewMetrics(),
+			tracer,
+			sendFailureWaitInNanosecondsForTesting,
+			impl.NewShutdown(0),
+			stub.NewSenderImpl().Send).Publish,
+		func(ctx context.Context, event *models.Event) { traceparent = impl.Traceparent(ctx) },
+		json.Marshal,
+		newCleanUpImpl().CleanUp)
+
+	sut.run(newEdgeXContextImpl(), stub.NewEvent())
+	tracer.CleanUp()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	run, marshal, queue, publish := spans["transport.Run"], spans["marshal"], spans["queue"], spans["publish"]
+	assert.Empty(t, run.ParentSpanId)
+	assert.Equal(t, run.SpanId, marshal.ParentSpanId)
+	assert.Equal(t, run.SpanId, queue.ParentSpanId)
+	assert.Equal(t, queue.SpanId, publish.ParentSpanId)
+	for _, span := range []contract.Span{marshal, queue, publish} {
+		assert.Equal(t, run.TraceId, span.TraceId)
+	}
+	assert.Equal(t, "00-"+run.TraceId+"-"+run.SpanId+"-01", traceparent)
+}